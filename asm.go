@@ -0,0 +1,570 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Disassemble the pattern into a listing that Assemble() reads back.
+// Jump targets get labels, named after the rule for calls to named
+// rules, and L1, L2, ... otherwise. A call to a rule whose name is not
+// its label is followed by the quoted name, like `call L3 'my rule'`:
+//
+//		call S
+//		jump L1
+//	S:
+//		choice L2
+//		char 'a'
+//		...
+//	L1:
+//		end
+func Disassemble(p *Pattern) string {
+	code := *p
+	labels := make(map[int]string)
+	used := make(map[string]bool)
+	for i, op := range code {
+		if op, ok := op.(*ICall); ok && asmRuleLabel(op.name) && !used[op.name] {
+			if _, ok := labels[i+op.offset]; !ok {
+				labels[i+op.offset] = op.name
+				used[op.name] = true
+			}
+		}
+	}
+	targets := make(map[int]bool)
+	for i, op := range code {
+		if offset, ok := jumpOffset(op); ok {
+			targets[i+offset] = true
+		}
+	}
+	n := 0
+	for i := 0; i <= len(code); i++ {
+		if _, ok := labels[i]; ok || !targets[i] {
+			continue
+		}
+		for n++; used[fmt.Sprintf("L%d", n)]; n++ {
+		}
+		labels[i] = fmt.Sprintf("L%d", n)
+	}
+
+	var b strings.Builder
+	for i, op := range code {
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(&b, "%s:\n", label)
+		}
+		b.WriteString("\t")
+		if offset, ok := jumpOffset(op); ok {
+			label, ok := labels[i+offset]
+			if !ok {
+				// Out of range.
+				label = fmt.Sprintf("%+d", offset)
+			}
+			switch op := op.(type) {
+			case *ILoop:
+				fmt.Fprintf(&b, "loop %s %d", label, op.count)
+			case *ICall:
+				fmt.Fprintf(&b, "call %s", label)
+				if op.name != "" && (op.name != label || isGenericLabel(label)) {
+					fmt.Fprintf(&b, " %s", quotePEG(op.name))
+				}
+			default:
+				fmt.Fprintf(&b, "%s %s", asmMnemonic(op), label)
+			}
+		} else {
+			disassembleOp(&b, op)
+		}
+		b.WriteString("\n")
+	}
+	if label, ok := labels[len(code)]; ok {
+		fmt.Fprintf(&b, "%s:\n", label)
+	}
+	return b.String()
+}
+
+// Can the name be used as a rule label? Names like L1 are kept for
+// the other labels.
+func asmRuleLabel(name string) bool {
+	return validName(name) && !isGenericLabel(name)
+}
+
+func isGenericLabel(name string) bool {
+	if len(name) < 2 || name[0] != 'L' {
+		return false
+	}
+	_, err := strconv.Atoi(name[1:])
+	return err == nil && name[1] != '-' && name[1] != '+'
+}
+
+func asmMnemonic(op Instruction) string {
+	switch op.(type) {
+	case *IJump:
+		return "jump"
+	case *IChoice:
+		return "choice"
+	case *ICall:
+		return "call"
+	case *ICommit:
+		return "commit"
+	case *IPartialCommit:
+		return "partialcommit"
+	case *IBackCommit:
+		return "backcommit"
+	}
+	return "loop"
+}
+
+func disassembleOp(b *strings.Builder, op Instruction) {
+	switch op := op.(type) {
+	case nil:
+		b.WriteString("noop")
+	case *IChar:
+		fmt.Fprintf(b, "char %s", quotePEG(string([]byte{op.char})))
+	case *ICharset:
+		fmt.Fprintf(b, "charset %s", classPEG(op))
+	case *ISpan:
+		fmt.Fprintf(b, "span %s", classPEG(&op.ICharset))
+		if op.max >= 0 {
+			fmt.Fprintf(b, " %d", op.max)
+		}
+	case *IAny:
+		fmt.Fprintf(b, "any %d", op.count)
+	case *IKeywords:
+		b.WriteString("keywords")
+		for _, w := range op.words {
+			fmt.Fprintf(b, " %s", quotePEG(w))
+		}
+	case *IOpenCall:
+		fmt.Fprintf(b, "opencall %s", quotePEG(op.name))
+	case *IReturn:
+		b.WriteString("return")
+	case *IFail:
+		b.WriteString("fail")
+	case *IFailTwice:
+		b.WriteString("failtwice")
+	case *IEnd:
+		b.WriteString("end")
+	case *IPushCounter:
+		b.WriteString("pushcounter")
+	case *IPopCounter:
+		b.WriteString("popcounter")
+	case *IGiveUp:
+		b.WriteString("giveup")
+	case *IOpenCapture:
+		disassembleCapture(b, "opencapture", op.capOffset, op.handler)
+	case *ICloseCapture:
+		b.WriteString("closecapture")
+		if op.capOffset != 0 {
+			fmt.Fprintf(b, " %d", op.capOffset)
+		}
+	case *IFullCapture:
+		disassembleCapture(b, "fullcapture", op.capOffset, op.handler)
+	case *IEmptyCapture:
+		disassembleCapture(b, "emptycapture", op.capOffset, op.handler)
+	case *IDFA:
+		disassembleDFA(b, op)
+	default:
+		fmt.Fprintf(b, "-- %v", op)
+	}
+}
+
+func disassembleCapture(b *strings.Builder, mnemonic string, offset int, h CaptureHandler) {
+	b.WriteString(mnemonic)
+	if offset != 0 {
+		fmt.Fprintf(b, " %d", offset)
+	}
+	b.WriteString(" ")
+	if name, ok := handlerName(h); ok {
+		fmt.Fprintf(b, "named %s", quotePEG(name))
+		return
+	}
+	switch h := h.(type) {
+	case nil:
+		b.WriteString("default")
+	case *SimpleCapture:
+		b.WriteString("simple")
+	case *PositionCapture:
+		b.WriteString("position")
+	case *ListCapture:
+		b.WriteString("list")
+	case *SubstCapture:
+		b.WriteString("subst")
+	case *TableCapture:
+		b.WriteString("table")
+	case *GroupCapture:
+		fmt.Fprintf(b, "group %s", quotePEG(h.name))
+	case *StringCapture:
+		fmt.Fprintf(b, "string %s", quotePEG(h.format))
+	case *ConstCapture:
+		switch v := h.value.(type) {
+		case nil:
+			b.WriteString("const nil")
+		case bool, int:
+			fmt.Fprintf(b, "const %v", v)
+		case float64:
+			s := strconv.FormatFloat(v, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eIN") {
+				s += ".0"
+			}
+			fmt.Fprintf(b, "const %s", s)
+		case string:
+			fmt.Fprintf(b, "const %s", quotePEG(v))
+		default:
+			fmt.Fprintf(b, "const ? -- %v", v)
+		}
+	default:
+		fmt.Fprintf(b, "? -- %v", h)
+	}
+}
+
+// The states of an automaton, one per line. Transitions are grouped by
+// their result, and the ones that fail are left out:
+//
+//	dfa {
+//		0: [a-z] -> 1, [0-9] -> save 2, eof -> accept
+//		...
+//	}
+func disassembleDFA(b *strings.Builder, op *IDFA) {
+	b.WriteString("dfa {\n")
+	for s, edges := range op.states {
+		fmt.Fprintf(b, "\t\t%d:", s)
+		done := make(map[dfaEdge]bool)
+		sep := " "
+		for c := 0; c < 256; c++ {
+			e := edges[c]
+			if e.to == dfaFail || done[e] {
+				continue
+			}
+			done[e] = true
+			set := &ICharset{}
+			for d := c; d < 256; d++ {
+				if edges[d] == e {
+					set.add(byte(d), byte(d))
+				}
+			}
+			fmt.Fprintf(b, "%s%s -> %s", sep, classPEG(set), dfaTarget(e))
+			sep = ", "
+		}
+		if e := edges[256]; e.to != dfaFail {
+			fmt.Fprintf(b, "%seof -> %s", sep, dfaTarget(e))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\t}")
+}
+
+func dfaTarget(e dfaEdge) string {
+	var to string
+	switch e.to {
+	case dfaFail:
+		to = "fail"
+	case dfaAccept:
+		to = "accept"
+	case dfaAcceptSaved:
+		to = "saved"
+	default:
+		to = strconv.Itoa(int(e.to))
+	}
+	if e.save {
+		return "save " + to
+	}
+	return to
+}
+
+// Read a listing in the format of Disassemble(). Instructions and
+// their operands are separated by whitespace, labels end with ':', and
+// comments start with "--". Calls to labels other than L1, L2, ... keep
+// the label as the rule name, unless a quoted name follows. The code is
+// not checked, see Verify.
+func Assemble(text string) (pat *Pattern, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			se, ok := e.(*SyntaxError)
+			if !ok {
+				panic(e)
+			}
+			pat, err = nil, se
+		}
+	}()
+	a := &assembler{pegParser: &pegParser{src: text}, labels: make(map[string]int)}
+	a.skip()
+	for a.pos < len(a.src) {
+		start := a.pos
+		word := a.name()
+		if a.accept(":") {
+			if _, ok := a.labels[word]; ok {
+				a.pos = start
+				a.fail("Label %q defined twice", word)
+			}
+			a.labels[word] = len(a.code)
+			continue
+		}
+		a.code = append(a.code, a.instruction(word, start))
+	}
+	for _, ref := range a.refs {
+		t, ok := a.labels[ref.label]
+		if !ok {
+			a.pos = ref.pos
+			a.fail("Undefined label %q", ref.label)
+		}
+		a.code[ref.pc] = withOffset(a.code[ref.pc], t-ref.pc)
+	}
+	return &a.code, nil
+}
+
+type assembler struct {
+	*pegParser
+	code   Pattern
+	labels map[string]int
+	refs   []asmRef
+}
+
+// Jump to a label, resolved at the end.
+type asmRef struct {
+	label string
+	pos   int // Position in the source
+	pc    int
+}
+
+// Read the target of the jump being assembled.
+func (a *assembler) target() string {
+	pos := a.pos
+	label := a.name()
+	a.refs = append(a.refs, asmRef{label, pos, len(a.code)})
+	return label
+}
+
+func (a *assembler) instruction(mnemonic string, start int) Instruction {
+	switch mnemonic {
+	case "noop":
+		return nil
+	case "char":
+		s := a.literal()
+		if len(s) != 1 {
+			a.fail("Expected a single character")
+		}
+		return &IChar{s[0]}
+	case "charset":
+		set := a.charset()
+		return &set
+	case "span":
+		op := &ISpan{ICharset: a.charset(), max: -1}
+		if a.digit() {
+			op.max = a.number()
+		}
+		return op
+	case "any":
+		return &IAny{a.number()}
+	case "keywords":
+		var words []string
+		for a.pos < len(a.src) && (a.src[a.pos] == '\'' || a.src[a.pos] == '"') {
+			words = append(words, a.literal())
+		}
+		if len(words) == 0 {
+			a.fail("Expected keywords")
+		}
+		return newKeywords(words)
+	case "jump":
+		a.target()
+		return &IJump{}
+	case "choice":
+		a.target()
+		return &IChoice{}
+	case "call":
+		name := a.target()
+		if isGenericLabel(name) {
+			name = ""
+		}
+		if a.pos < len(a.src) && (a.src[a.pos] == '\'' || a.src[a.pos] == '"') {
+			name = a.literal()
+		}
+		return &ICall{0, name}
+	case "commit":
+		a.target()
+		return &ICommit{}
+	case "partialcommit":
+		a.target()
+		return &IPartialCommit{}
+	case "backcommit":
+		a.target()
+		return &IBackCommit{}
+	case "loop":
+		a.target()
+		return &ILoop{0, a.number()}
+	case "opencall":
+		return &IOpenCall{a.literal()}
+	case "return":
+		return &IReturn{}
+	case "fail":
+		return &IFail{}
+	case "failtwice":
+		return &IFailTwice{}
+	case "end":
+		return &IEnd{}
+	case "pushcounter":
+		return &IPushCounter{}
+	case "popcounter":
+		return &IPopCounter{}
+	case "giveup":
+		return &IGiveUp{}
+	case "opencapture":
+		offset := a.offset()
+		return &IOpenCapture{offset, a.handler()}
+	case "closecapture":
+		return &ICloseCapture{a.offset()}
+	case "fullcapture":
+		offset := a.offset()
+		return &IFullCapture{offset, a.handler()}
+	case "emptycapture":
+		offset := a.offset()
+		return &IEmptyCapture{offset, a.handler()}
+	case "dfa":
+		return a.dfa()
+	}
+	a.pos = start
+	a.fail("Unknown instruction %q", mnemonic)
+	return nil
+}
+
+func (a *assembler) digit() bool {
+	return a.pos < len(a.src) && '0' <= a.src[a.pos] && a.src[a.pos] <= '9'
+}
+
+// Optional capture offset.
+func (a *assembler) offset() int {
+	if a.digit() {
+		return a.number()
+	}
+	return 0
+}
+
+// A class, or '.' for all characters.
+func (a *assembler) charset() ICharset {
+	if a.accept(".") {
+		var set ICharset
+		set.negate()
+		return set
+	}
+	if a.pos >= len(a.src) || a.src[a.pos] != '[' {
+		a.fail("Expected a class")
+	}
+	return *a.class()
+}
+
+func (a *assembler) handler() CaptureHandler {
+	start := a.pos
+	switch kind := a.name(); kind {
+	case "default":
+		return nil
+	case "simple":
+		return &SimpleCapture{}
+	case "position":
+		return &PositionCapture{}
+	case "list":
+		return &ListCapture{}
+	case "subst":
+		return &SubstCapture{}
+	case "table":
+		return &TableCapture{}
+	case "group":
+		return &GroupCapture{a.literal()}
+	case "string":
+		return &StringCapture{a.literal()}
+	case "const":
+		return &ConstCapture{a.constant()}
+	case "named":
+		pos := a.pos
+		name := a.literal()
+		handlers.RLock()
+		h, ok := handlers.byName[name]
+		handlers.RUnlock()
+		if !ok {
+			a.pos = pos
+			a.fail("Capture %q is not registered", name)
+		}
+		return h
+	}
+	a.pos = start
+	a.fail("Unknown capture handler")
+	return nil
+}
+
+func (a *assembler) constant() interface{} {
+	if a.pos < len(a.src) && (a.src[a.pos] == '\'' || a.src[a.pos] == '"') {
+		return a.literal()
+	}
+	start := a.pos
+	for a.pos < len(a.src) && strings.IndexByte(" \t\r\n", a.src[a.pos]) < 0 {
+		a.pos++
+	}
+	token := a.src[start:a.pos]
+	a.skip()
+	switch token {
+	case "nil":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if n, err := strconv.Atoi(token); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return f
+	}
+	a.pos = start
+	a.fail("Expected a constant")
+	return nil
+}
+
+func (a *assembler) dfa() *IDFA {
+	op := &IDFA{}
+	a.expect("{")
+	for !a.accept("}") {
+		if s := a.number(); s != len(op.states) {
+			a.fail("Expected state %d", len(op.states))
+		}
+		a.expect(":")
+		op.states = append(op.states, [257]dfaEdge{})
+		edges := &op.states[len(op.states)-1]
+		for i := range edges {
+			edges[i].to = dfaFail
+		}
+		for a.pos < len(a.src) && !a.digit() && a.src[a.pos] != '}' {
+			eof := a.accept("eof")
+			var set ICharset
+			if !eof {
+				set = a.charset()
+			}
+			a.expect("->")
+			e := dfaEdge{save: !strings.HasPrefix(a.src[a.pos:], "saved") && a.accept("save")}
+			switch {
+			case a.accept("fail"):
+				e.to = dfaFail
+			case a.accept("accept"):
+				e.to = dfaAccept
+			case a.accept("saved"):
+				e.to = dfaAcceptSaved
+			default:
+				e.to = int32(a.number())
+			}
+			if eof {
+				edges[256] = e
+			}
+			for c := 0; c < 256; c++ {
+				if !eof && set.Has(byte(c)) {
+					edges[c] = e
+				}
+			}
+			if !a.accept(",") {
+				break
+			}
+		}
+	}
+	if !validDFA(op) {
+		a.fail("Invalid automaton")
+	}
+	return op
+}
@@ -0,0 +1,615 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Start of the binary format, followed by the format version.
+const (
+	binaryMagic   = "pego"
+	binaryVersion = 1
+)
+
+// Opcodes of the binary format. The values are part of the format, so
+// new instructions must be added at the end.
+const (
+	opNoop = iota
+	opChar
+	opJump
+	opChoice
+	opOpenCall
+	opCall
+	opCommit
+	opPartialCommit
+	opBackCommit
+	opReturn
+	opFail
+	opFailTwice
+	opEnd
+	opKeywords
+	opPushCounter
+	opLoop
+	opPopCounter
+	opGiveUp
+	opOpenCapture
+	opCloseCapture
+	opFullCapture
+	opEmptyCapture
+	opCharset
+	opSpan
+	opAny
+	opDFA
+)
+
+// Kinds of capture handlers in the binary format.
+const (
+	handlerDefault = iota
+	handlerSimple
+	handlerPosition
+	handlerList
+	handlerSubst
+	handlerString
+	handlerConst
+	handlerNamed
+	handlerTable
+	handlerGroup
+)
+
+// Kinds of constant capture values in the binary format.
+const (
+	constNil = iota
+	constBool
+	constInt
+	constFloat
+	constString
+)
+
+// Registered capture handlers.
+var handlers = struct {
+	sync.RWMutex
+	byName map[string]CaptureHandler
+	names  map[CaptureHandler]string
+}{byName: make(map[string]CaptureHandler), names: make(map[CaptureHandler]string)}
+
+// Register a capture handler under a name. MarshalBinary stores the
+// handler by its name, and UnmarshalBinary puts the registered handler
+// back, so function captures and other handlers that can not be stored
+// must be registered, and used through Cnamed().
+func RegisterCapture(name string, h CaptureHandler) {
+	if name == "" || h == nil || !reflect.TypeOf(h).Comparable() {
+		panic("Invalid capture handler")
+	}
+	handlers.Lock()
+	defer handlers.Unlock()
+	if old, ok := handlers.byName[name]; ok {
+		delete(handlers.names, old)
+	}
+	handlers.byName[name] = h
+	handlers.names[h] = name
+}
+
+// Register a function for function captures. Same as
+// RegisterCapture(name, &FunctionCapture{f}).
+func RegisterFunc(name string, f func([]*CaptureResult) (interface{}, error)) {
+	RegisterCapture(name, &FunctionCapture{f})
+}
+
+// The name the handler is registered under.
+func handlerName(h CaptureHandler) (string, bool) {
+	if h == nil || !reflect.TypeOf(h).Comparable() {
+		return "", false
+	}
+	handlers.RLock()
+	defer handlers.RUnlock()
+	name, ok := handlers.names[h]
+	return name, ok
+}
+
+// Does a capture with the handler registered under the name.
+func Cnamed(p *Pattern, name string) *Pattern {
+	handlers.RLock()
+	h, ok := handlers.byName[name]
+	handlers.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("Capture %q is not registered", name))
+	}
+	return Seq(
+		&IOpenCapture{0, h},
+		p,
+		&ICloseCapture{},
+	)
+}
+
+// Encode the pattern in a versioned binary format. Capture handlers are
+// stored by their registered name, or by their contents for the
+// built-in handlers that only hold plain data.
+func (p *Pattern) MarshalBinary() ([]byte, error) {
+	b := binWriter(binaryMagic)
+	b.uint(binaryVersion)
+	b.uint(uint64(len(*p)))
+	for pc, op := range *p {
+		if err := b.op(op); err != nil {
+			return nil, fmt.Errorf("Instruction %d: %v", pc, err)
+		}
+	}
+	return b, nil
+}
+
+// Decode a pattern written by MarshalBinary, replacing the contents of
+// p. The code is validated, so that corrupt data gives an error
+// instead of a pattern that crashes the VM. Use Verify to also check
+// the stack discipline.
+func (p *Pattern) UnmarshalBinary(data []byte) error {
+	if len(data) < len(binaryMagic) || string(data[:len(binaryMagic)]) != binaryMagic {
+		return errors.New("Not a binary pattern")
+	}
+	r := &binReader{data: data[len(binaryMagic):]}
+	if v := r.uint(); r.err == nil && v != binaryVersion {
+		return fmt.Errorf("Unsupported binary pattern version %d", v)
+	}
+	n := r.count(1)
+	code := make(Pattern, 0, n)
+	for pc := 0; pc < n && r.err == nil; pc++ {
+		code = append(code, r.op())
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errors.New("Trailing data")
+	}
+	if r.err != nil {
+		return fmt.Errorf("Invalid binary pattern at instruction %d: %v", len(code), r.err)
+	}
+	if err := validate(code); err != nil {
+		return err
+	}
+	*p = code
+	return nil
+}
+
+// Check that code loaded from outside can not crash the VM.
+func validate(code Pattern) error {
+	if len(code) == 0 {
+		return errors.New("Empty pattern")
+	}
+	if _, ok := code[len(code)-1].(*IEnd); !ok {
+		return errors.New("Pattern does not end with End")
+	}
+	for pc, op := range code {
+		if offset, ok := jumpOffset(op); ok {
+			if t := pc + offset; t < 0 || t >= len(code) {
+				return fmt.Errorf("Instruction %d: jump target %d out of range", pc, t)
+			}
+		}
+		bad := false
+		switch op := op.(type) {
+		case *IAny:
+			bad = op.count < 0
+		case *ISpan:
+			bad = op.max < -1
+		case *ILoop:
+			bad = op.count < 0
+		case *IOpenCapture:
+			bad = op.capOffset != 0
+		case *ICloseCapture:
+			bad = op.capOffset != 0
+		case *IEmptyCapture:
+			bad = op.capOffset != 0
+		case *IFullCapture:
+			bad = op.capOffset < 0
+		case *IDFA:
+			bad = !validDFA(op)
+		}
+		if bad {
+			return fmt.Errorf("Instruction %d: invalid %v", pc, op)
+		}
+	}
+	return nil
+}
+
+// Every transition must lead to a state or a result, and the end of
+// input must not lead to a state, or the automaton would never stop.
+func validDFA(op *IDFA) bool {
+	if len(op.states) == 0 {
+		return false
+	}
+	for _, s := range op.states {
+		for b, e := range s {
+			if e.to < dfaAcceptSaved || int(e.to) >= len(op.states) || b == 256 && e.to >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Encoder for the binary format. Numbers are varints.
+type binWriter []byte
+
+func (b *binWriter) uint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *binWriter) int(x int) {
+	b.uint(uint64(x<<1) ^ uint64(x>>63))
+}
+
+func (b *binWriter) str(s string) {
+	b.uint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *binWriter) op(op Instruction) error {
+	if offset, ok := jumpOffset(op); ok {
+		switch op := op.(type) {
+		case *IJump:
+			b.uint(opJump)
+		case *IChoice:
+			b.uint(opChoice)
+		case *ICall:
+			b.uint(opCall)
+			b.str(op.name)
+		case *ICommit:
+			b.uint(opCommit)
+		case *IPartialCommit:
+			b.uint(opPartialCommit)
+		case *IBackCommit:
+			b.uint(opBackCommit)
+		case *ILoop:
+			b.uint(opLoop)
+			b.int(op.count)
+		}
+		b.int(offset)
+		return nil
+	}
+	switch op := op.(type) {
+	case nil:
+		b.uint(opNoop)
+	case *IChar:
+		b.uint(opChar)
+		*b = append(*b, op.char)
+	case *IOpenCall:
+		b.uint(opOpenCall)
+		b.str(op.name)
+	case *IReturn:
+		b.uint(opReturn)
+	case *IFail:
+		b.uint(opFail)
+	case *IFailTwice:
+		b.uint(opFailTwice)
+	case *IEnd:
+		b.uint(opEnd)
+	case *IKeywords:
+		b.uint(opKeywords)
+		b.uint(uint64(len(op.words)))
+		for _, w := range op.words {
+			b.str(w)
+		}
+	case *IPushCounter:
+		b.uint(opPushCounter)
+	case *IPopCounter:
+		b.uint(opPopCounter)
+	case *IGiveUp:
+		b.uint(opGiveUp)
+	case *IOpenCapture:
+		b.uint(opOpenCapture)
+		b.int(op.capOffset)
+		return b.handler(op.handler)
+	case *ICloseCapture:
+		b.uint(opCloseCapture)
+		b.int(op.capOffset)
+	case *IFullCapture:
+		b.uint(opFullCapture)
+		b.int(op.capOffset)
+		return b.handler(op.handler)
+	case *IEmptyCapture:
+		b.uint(opEmptyCapture)
+		b.int(op.capOffset)
+		return b.handler(op.handler)
+	case *ICharset:
+		b.uint(opCharset)
+		b.charset(op)
+	case *ISpan:
+		b.uint(opSpan)
+		b.charset(&op.ICharset)
+		b.int(op.max)
+	case *IAny:
+		b.uint(opAny)
+		b.int(op.count)
+	case *IDFA:
+		b.uint(opDFA)
+		b.uint(uint64(len(op.states)))
+		for _, s := range op.states {
+			for _, e := range s {
+				to := int(e.to) << 1
+				if e.save {
+					to |= 1
+				}
+				b.int(to)
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown instruction %v", op)
+	}
+	return nil
+}
+
+func (b *binWriter) charset(op *ICharset) {
+	for _, c := range op.chars {
+		*b = append(*b, byte(c), byte(c>>8), byte(c>>16), byte(c>>24))
+	}
+}
+
+func (b *binWriter) handler(h CaptureHandler) error {
+	if name, ok := handlerName(h); ok {
+		b.uint(handlerNamed)
+		b.str(name)
+		return nil
+	}
+	switch h := h.(type) {
+	case nil:
+		b.uint(handlerDefault)
+	case *SimpleCapture:
+		b.uint(handlerSimple)
+	case *PositionCapture:
+		b.uint(handlerPosition)
+	case *ListCapture:
+		b.uint(handlerList)
+	case *SubstCapture:
+		b.uint(handlerSubst)
+	case *TableCapture:
+		b.uint(handlerTable)
+	case *GroupCapture:
+		b.uint(handlerGroup)
+		b.str(h.name)
+	case *StringCapture:
+		b.uint(handlerString)
+		b.str(h.format)
+	case *ConstCapture:
+		b.uint(handlerConst)
+		switch v := h.value.(type) {
+		case nil:
+			b.uint(constNil)
+		case bool:
+			b.uint(constBool)
+			if v {
+				b.uint(1)
+			} else {
+				b.uint(0)
+			}
+		case int:
+			b.uint(constInt)
+			b.int(v)
+		case float64:
+			b.uint(constFloat)
+			b.uint(math.Float64bits(v))
+		case string:
+			b.uint(constString)
+			b.str(v)
+		default:
+			return fmt.Errorf("Constant capture of %T must be registered", h.value)
+		}
+	default:
+		return fmt.Errorf("Capture handler %v must be registered", h)
+	}
+	return nil
+}
+
+// Decoder for the binary format. The first error is kept in err, and
+// later reads return zero values.
+type binReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (r *binReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.fail("Unexpected end of data")
+		return 0
+	}
+	c := r.data[0]
+	r.data = r.data[1:]
+	return c
+}
+
+func (r *binReader) uint() uint64 {
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		c := r.byte()
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x
+		}
+	}
+	r.fail("Invalid number")
+	return 0
+}
+
+func (r *binReader) int() int {
+	x := r.uint()
+	return int(x>>1) ^ -int(x&1)
+}
+
+// Read a count of items that take at least `size` bytes each, so that
+// corrupt counts can not make huge allocations.
+func (r *binReader) count(size int) int {
+	n := r.uint()
+	if n > uint64(len(r.data)/size) {
+		r.fail("Invalid count %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binReader) str() string {
+	n := r.count(1)
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binReader) charset() ICharset {
+	var op ICharset
+	for i := range op.chars {
+		op.chars[i] = uint32(r.byte()) | uint32(r.byte())<<8 | uint32(r.byte())<<16 | uint32(r.byte())<<24
+	}
+	return op
+}
+
+func (r *binReader) op() Instruction {
+	switch code := r.uint(); code {
+	case opNoop:
+		return nil
+	case opChar:
+		return &IChar{r.byte()}
+	case opJump:
+		return &IJump{r.int()}
+	case opChoice:
+		return &IChoice{r.int()}
+	case opOpenCall:
+		return &IOpenCall{r.str()}
+	case opCall:
+		name := r.str()
+		return &ICall{r.int(), name}
+	case opCommit:
+		return &ICommit{r.int()}
+	case opPartialCommit:
+		return &IPartialCommit{r.int()}
+	case opBackCommit:
+		return &IBackCommit{r.int()}
+	case opReturn:
+		return &IReturn{}
+	case opFail:
+		return &IFail{}
+	case opFailTwice:
+		return &IFailTwice{}
+	case opEnd:
+		return &IEnd{}
+	case opKeywords:
+		words := make([]string, r.count(1))
+		for i := range words {
+			words[i] = r.str()
+		}
+		if len(words) == 0 {
+			r.fail("No keywords")
+		}
+		return newKeywords(words)
+	case opPushCounter:
+		return &IPushCounter{}
+	case opLoop:
+		count := r.int()
+		return &ILoop{r.int(), count}
+	case opPopCounter:
+		return &IPopCounter{}
+	case opGiveUp:
+		return &IGiveUp{}
+	case opOpenCapture:
+		offset := r.int()
+		return &IOpenCapture{offset, r.handler()}
+	case opCloseCapture:
+		return &ICloseCapture{r.int()}
+	case opFullCapture:
+		offset := r.int()
+		return &IFullCapture{offset, r.handler()}
+	case opEmptyCapture:
+		offset := r.int()
+		return &IEmptyCapture{offset, r.handler()}
+	case opCharset:
+		op := r.charset()
+		return &op
+	case opSpan:
+		op := &ISpan{ICharset: r.charset()}
+		op.max = r.int()
+		return op
+	case opAny:
+		return &IAny{r.int()}
+	case opDFA:
+		op := &IDFA{states: make([][257]dfaEdge, r.count(257))}
+		for s := range op.states {
+			for b := range op.states[s] {
+				to := r.int()
+				op.states[s][b] = dfaEdge{int32(to >> 1), to&1 != 0}
+				if to>>1 != int(int32(to>>1)) {
+					r.fail("Invalid DFA transition")
+				}
+			}
+		}
+		return op
+	default:
+		r.fail("Unknown opcode %d", code)
+	}
+	return nil
+}
+
+func (r *binReader) handler() CaptureHandler {
+	switch kind := r.uint(); kind {
+	case handlerDefault:
+		return nil
+	case handlerSimple:
+		return &SimpleCapture{}
+	case handlerPosition:
+		return &PositionCapture{}
+	case handlerList:
+		return &ListCapture{}
+	case handlerSubst:
+		return &SubstCapture{}
+	case handlerTable:
+		return &TableCapture{}
+	case handlerGroup:
+		return &GroupCapture{r.str()}
+	case handlerString:
+		return &StringCapture{r.str()}
+	case handlerConst:
+		return &ConstCapture{r.constant()}
+	case handlerNamed:
+		name := r.str()
+		handlers.RLock()
+		h, ok := handlers.byName[name]
+		handlers.RUnlock()
+		if !ok && r.err == nil {
+			r.fail("Capture %q is not registered", name)
+		}
+		return h
+	default:
+		r.fail("Unknown capture handler %d", kind)
+	}
+	return nil
+}
+
+func (r *binReader) constant() interface{} {
+	switch kind := r.uint(); kind {
+	case constNil:
+		return nil
+	case constBool:
+		return r.uint() != 0
+	case constInt:
+		return r.int()
+	case constFloat:
+		return math.Float64frombits(r.uint())
+	case constString:
+		return r.str()
+	default:
+		r.fail("Unknown constant %d", kind)
+	}
+	return nil
+}
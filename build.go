@@ -0,0 +1,269 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A parser built by Build, which fills values of type T.
+type Parser[T any] struct {
+	pattern *Pattern
+}
+
+// The grammar of the parser.
+func (p *Parser[T]) Pattern() *Pattern {
+	return p.pattern
+}
+
+// Error of Parse for an input that does not match.
+type ParseError struct {
+	Pos int // Farthest position where the match failed
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Pos, e.Msg)
+}
+
+// Parse the whole input into a new T. An input that does not match
+// gives a *ParseError.
+func (p *Parser[T]) Parse(input string) (*T, error) {
+	r, err, _ := MatchWithOptions(p.pattern, input, &MatchOptions{Spans: true})
+	if err == errNoMatch {
+		return nil, parseError(p.pattern, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, ok := r.(*CaptureNode)
+	if !ok {
+		n = nodeOf(r)
+	}
+	v := new(T)
+	if err := (&decoder{}).unmarshal(n, reflect.ValueOf(v).Elem(), "", ""); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Match the input again to find where it failed.
+func parseError(pat *Pattern, input string) *ParseError {
+	var f farthest
+	_, _, pos := MatchWithOptions(pat, input, &MatchOptions{Tracer: &f})
+	if int(f) > pos {
+		pos = int(f)
+	}
+	if pos >= len(input) {
+		return &ParseError{pos, "Unexpected end of input"}
+	}
+	return &ParseError{pos, fmt.Sprintf("Unexpected %q", input[pos:pos+1])}
+}
+
+// Tracer of the farthest position where a match failed.
+type farthest int
+
+func (f *farthest) Trace(e *TraceEvent) {
+	if e.Kind == TraceBacktrack && e.Failed > int(*f) {
+		*f = farthest(e.Failed)
+	}
+}
+
+// Build a parser from the tags of the fields of the struct type T, and
+// of the struct types of its fields. Each struct type is a rule named
+// after the type, which matches the tags of its fields in order:
+//
+//	type Let struct {
+//		Name  string `pego:"'let' @Ident '='"`
+//		Value *Expr  `pego:"@@ ';'"`
+//	}
+//
+// Tags are written in the notation of ParseGrammar, with `@p` to store
+// what p matched in the field, and `@@` to match the struct type of the
+// field, which may be repeated like `@@*`. A bool field is set when its
+// `@` matches some input, and a slice field gets a value for each `@`
+// matched. Fields without a tag are left alone.
+//
+// Other rules, like Ident above, are given in `rules`. They should not
+// capture anything, as their captures would be stored in slice fields
+// along with the values of `@`. If they define
+// Space, it is skipped before each literal, class, `.`, rule that is not
+// a struct and `@` of a field that is not a struct, and at the end of the
+// input. The start rule is Input, which `rules` may not define.
+func Build[T any](rules ...string) (*Parser[T], error) {
+	b := &builder{rules: make(map[string]*Pattern), structs: make(map[string]reflect.Type)}
+	for _, src := range rules {
+		_, r, err := ParseRules(src)
+		if err != nil {
+			return nil, err
+		}
+		for name, pat := range r {
+			if _, ok := b.rules[name]; ok {
+				return nil, fmt.Errorf("Rule %q defined twice", name)
+			}
+			b.rules[name] = pat
+		}
+	}
+	_, b.space = b.rules["Space"]
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if !isStruct(t) {
+		return nil, fmt.Errorf("%v is not a struct", t)
+	}
+	if _, ok := b.rules["Input"]; ok {
+		return nil, fmt.Errorf("Rule %q is reserved", "Input")
+	}
+	if err := b.add(t); err != nil {
+		return nil, err
+	}
+	for _, ref := range b.refs {
+		if _, ok := b.rules[ref.name]; !ok {
+			return nil, fmt.Errorf("%s: Undefined rule %q", ref.field, ref.name)
+		}
+	}
+	b.rules["Input"] = Seq(Ref(t.Name()), b.token(Not(Any(1))))
+	return &Parser[T]{Grm("Input", b.rules)}, nil
+}
+
+// State of Build.
+type builder struct {
+	rules   map[string]*Pattern
+	structs map[string]reflect.Type // Struct types by the names of their rules
+	space   bool                    // Is there a Space rule?
+	refs    []builderRef
+	field   reflect.StructField // Field whose tag is parsed
+	raw     bool                // In the `@` of a field that is not a struct
+}
+
+// Reference to a rule from a tag, kept to report undefined rules.
+type builderRef struct {
+	field string
+	name  string
+}
+
+// Is the type filled from a table capture?
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && !reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// The type of the values of a field, and whether it is a slice of
+// them.
+func fieldType(t reflect.Type) (elem reflect.Type, list bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+		t, list = t.Elem(), true
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	return t, list
+}
+
+// Add the rule of a struct type, and of the struct types of its fields.
+func (b *builder) add(t reflect.Type) error {
+	name := t.Name()
+	if b.structs[name] == t {
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("%v has no name", t)
+	}
+	if _, ok := b.rules[name]; ok || b.structs[name] != nil {
+		return fmt.Errorf("Rule %q defined twice", name)
+	}
+	b.structs[name] = t
+	var args []interface{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("pego")
+		if !ok || f.PkgPath != "" {
+			continue
+		}
+		elem, list := fieldType(f.Type)
+		if isStruct(elem) {
+			if err := b.add(elem); err != nil {
+				return err
+			}
+		}
+		b.field = f
+		p := &pegParser{src: tag, rules: b.rules, build: b}
+		pat, err := p.fragment()
+		if err != nil {
+			return fmt.Errorf("%v.%s: %v", t, f.Name, err)
+		}
+		for _, ref := range p.refs {
+			b.refs = append(b.refs, builderRef{fmt.Sprintf("%v.%s", t, f.Name), ref.name})
+		}
+		if list {
+			pat = Cg(Clist(pat), f.Name)
+		}
+		args = append(args, pat)
+	}
+	b.rules[name] = Ctable(Seq(args...))
+	return nil
+}
+
+// Parse the tag of a field.
+func (p *pegParser) fragment() (pat *Pattern, err error) {
+	defer catchSyntax(&err)
+	p.skip()
+	pat = p.expr()
+	if p.pos < len(p.src) {
+		p.fail("Unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return pat, nil
+}
+
+// Skip space before a token.
+func (b *builder) token(pat *Pattern) *Pattern {
+	if b.raw || !b.space {
+		return pat
+	}
+	return Seq(Ref("Space"), pat)
+}
+
+// Parse `@p` or `@@` after the `@`, and capture it for the field.
+func (b *builder) capture(p *pegParser) *Pattern {
+	if b.raw {
+		p.fail("Unexpected @ inside of @")
+	}
+	elem, list := fieldType(b.field.Type)
+	if p.accept("@") {
+		if !isStruct(elem) {
+			p.fail("@@ needs a struct field, not %v", b.field.Type)
+		}
+		return p.repeat(b.value(Ref(elem.Name()), list))
+	}
+	var pat *Pattern
+	switch {
+	case isStruct(elem):
+		pat = p.suffix()
+	default:
+		// The captured text does not include space.
+		b.raw = true
+		pat = p.suffix()
+		b.raw = false
+		if elem.Kind() == reflect.Bool {
+			// Only set if something matched, so that `@'x'?` can
+			// leave it false.
+			pat = Cfunc(Csimple(pat), func(caps []*CaptureResult) (interface{}, error) {
+				return caps[0].End() > caps[0].Start(), nil
+			})
+		} else {
+			pat = Csimple(pat)
+		}
+		pat = b.token(pat)
+	}
+	return b.value(pat, list)
+}
+
+// Store the capture of pat in the field.
+func (b *builder) value(pat *Pattern, list bool) *Pattern {
+	if list {
+		// One value for each match, in the list of the field.
+		return pat
+	}
+	return Cg(pat, b.field.Name)
+}
@@ -49,13 +49,54 @@ type ListCapture struct{}
 func (h *ListCapture) String() string { return "list" }
 func (h *ListCapture) Process(input string, start, end int, captures *CapStack, subcaps int) (interface{}, error) {
 	subs := captures.Pop(subcaps)
-	ret := make([]interface{}, len(subs))
-	for i := range subs {
-		ret[i] = subs[i].value
+	ret := make([]interface{}, 0, len(subs))
+	for _, sub := range subs {
+		// Named groups are only kept by table captures.
+		if sub.name == "" {
+			ret = append(ret, sub.value)
+		}
+	}
+	return ret, nil
+}
+
+// Captures a map of all sub-captures. Values of named groups are stored
+// under their names, and the other values under their positions as
+// strings, starting with "1" like in LPeg.
+type TableCapture struct{}
+
+func (h *TableCapture) String() string { return "table" }
+func (h *TableCapture) Process(input string, start, end int, captures *CapStack, subcaps int) (interface{}, error) {
+	subs := captures.Pop(subcaps)
+	ret := make(map[string]interface{}, len(subs))
+	n := 0
+	for _, sub := range subs {
+		if sub.name != "" {
+			ret[sub.name] = sub.value
+		} else {
+			n++
+			ret[strconv.Itoa(n)] = sub.value
+		}
 	}
 	return ret, nil
 }
 
+// Captures the value of the first sub-capture, or the matched substring
+// if there are none, as a named group.
+type GroupCapture struct {
+	name string
+}
+
+func (h *GroupCapture) String() string {
+	return fmt.Sprintf("group(%q)", h.name)
+}
+func (h *GroupCapture) Process(input string, start, end int, captures *CapStack, subcaps int) (interface{}, error) {
+	subs := captures.Pop(subcaps)
+	if len(subs) == 0 {
+		return input[start:end], nil
+	}
+	return subs[0].value, nil
+}
+
 // Calls a function with all sub-captures, and captures the return value.
 // If functions reports an error, let it bubble up.
 type FunctionCapture struct {
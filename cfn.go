@@ -0,0 +1,228 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var (
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+	captureResultType = reflect.TypeOf((*CaptureResult)(nil))
+)
+
+// Does a function capture with any function, like p / f in LPeg. The
+// captures of the pattern are passed as arguments, converted like
+// Unmarshal does: a simple capture may be passed as an int, a table
+// capture as a struct, and so on. An argument of type *CaptureResult
+// gets the capture itself, and a variadic function gets the captures
+// left over.
+//
+// The function may return nothing, a value, an error, or a value and an
+// error. The value is the value of the capture, and an error stops the
+// match.
+//
+// Cfn panics if f is not such a function, or if the captures of p do
+// not fit its arguments. When the number of captures depends on the
+// input, it is checked during the match instead.
+func Cfn(p *Pattern, f interface{}) *Pattern {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		panic(fmt.Sprintf("Cfn: %T is not a function", f))
+	}
+	ft := fv.Type()
+	switch {
+	case ft.NumOut() > 2,
+		ft.NumOut() == 2 && ft.Out(1) != errorType:
+		panic(fmt.Sprintf("Cfn: %v should return a value, an error, or both", ft))
+	}
+	arity := ft.NumIn()
+	if ft.IsVariadic() {
+		arity--
+	}
+	param := func(i int) reflect.Type {
+		if ft.IsVariadic() && i >= arity {
+			return ft.In(arity).Elem()
+		}
+		return ft.In(i)
+	}
+	fits := func(n int) bool {
+		return n == arity || ft.IsVariadic() && n > arity
+	}
+	if types, ok := captureTypes(decodeExpr(p)); ok {
+		if !fits(len(types)) {
+			panic(fmt.Sprintf("Cfn: %v can not take %d captures", ft, len(types)))
+		}
+		for i, t := range types {
+			if t != nil && !canStore(t, param(i)) {
+				panic(fmt.Sprintf("Cfn: capture %d of type %v does not fit argument of type %v", i+1, t, param(i)))
+			}
+		}
+	}
+	return Cfunc(p, func(subs []*CaptureResult) (interface{}, error) {
+		if !fits(len(subs)) {
+			return nil, fmt.Errorf("Cfn: %v can not take %d captures", ft, len(subs))
+		}
+		args := make([]reflect.Value, len(subs))
+		for i, sub := range subs {
+			args[i] = reflect.New(param(i)).Elem()
+			if err := storeArg(sub, args[i], i); err != nil {
+				return nil, err
+			}
+		}
+		out := fv.Call(args)
+		if len(out) > 0 && ft.Out(len(out)-1) == errorType {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return nil, nil
+		}
+		return out[0].Interface(), nil
+	})
+}
+
+// Store a capture in the argument i of a function.
+func storeArg(sub *CaptureResult, v reflect.Value, i int) error {
+	if v.Type() == captureResultType {
+		v.Set(reflect.ValueOf(sub))
+		return nil
+	}
+	if sub.value != nil && reflect.TypeOf(sub.value).AssignableTo(v.Type()) {
+		v.Set(reflect.ValueOf(sub.value))
+		return nil
+	}
+	n := nodeOf(sub.value)
+	n.Start, n.End = sub.start, sub.end
+	return (&decoder{tags: true}).unmarshal(n, v, fmt.Sprintf("Argument %d", i+1), "")
+}
+
+// The types of the values of the captures of x, nil where the type is
+// not known. ok is false if the number of captures is not known.
+func captureTypes(x *expr) (types []reflect.Type, ok bool) {
+	switch x.kind {
+	case exprOp:
+		switch op := x.op.(type) {
+		case *IEmptyCapture:
+			return []reflect.Type{handlerType(op.handler)}, true
+		case *IFullCapture:
+			return []reflect.Type{handlerType(op.handler)}, true
+		}
+		return nil, true
+	case exprSeq:
+		for _, arg := range x.args {
+			t, ok := captureTypes(arg)
+			if !ok {
+				return nil, false
+			}
+			types = append(types, t...)
+		}
+		return types, true
+	case exprOr:
+		// Only if every choice has the same number of captures.
+		types, ok = captureTypes(x.args[0])
+		for _, arg := range x.args[1:] {
+			t, ok2 := captureTypes(arg)
+			if !ok || !ok2 || len(t) != len(types) {
+				return nil, false
+			}
+			for i := range t {
+				if t[i] != types[i] {
+					types[i] = nil
+				}
+			}
+		}
+		return types, ok
+	case exprRep:
+		if t, ok := captureTypes(x.args[0]); ok && len(t) == 0 {
+			return nil, true
+		}
+	case exprNot:
+		return nil, true
+	case exprCapture:
+		types = []reflect.Type{handlerType(x.handler)}
+		if _, ok := x.handler.(*SimpleCapture); ok {
+			// The captures inside of a simple capture follow it.
+			t, ok := captureTypes(x.args[0])
+			if !ok {
+				return nil, false
+			}
+			types = append(types, t...)
+		}
+		return types, true
+	}
+	return nil, false
+}
+
+// The type of the values of a capture handler, or nil if not known.
+func handlerType(h CaptureHandler) reflect.Type {
+	switch h := h.(type) {
+	case *SimpleCapture, *StringCapture, *SubstCapture:
+		return reflect.TypeOf("")
+	case *PositionCapture:
+		return reflect.TypeOf(0)
+	case *ConstCapture:
+		return reflect.TypeOf(h.value)
+	case *ListCapture:
+		return reflect.TypeOf([]interface{}{})
+	case *TableCapture:
+		return reflect.TypeOf(map[string]interface{}{})
+	}
+	return nil
+}
+
+// Can storeArg store a value of type from in a value of type to?
+func canStore(from, to reflect.Type) bool {
+	if to == captureResultType || from.AssignableTo(to) {
+		return true
+	}
+	for to.Kind() == reflect.Ptr {
+		to = to.Elem()
+	}
+	if to.Kind() == reflect.Interface && to.NumMethod() == 0 {
+		return true
+	}
+	switch from {
+	case handlerType(&SimpleCapture{}):
+		if to == timeType || reflect.PtrTo(to).Implements(textUnmarshalerType) {
+			return true
+		}
+		switch to.Kind() {
+		case reflect.Slice:
+			return to.Elem().Kind() == reflect.Uint8
+		case reflect.String, reflect.Bool:
+			return true
+		}
+		return isNumber(to)
+	case handlerType(&PositionCapture{}):
+		return isNumber(to)
+	case reflect.TypeOf(0.0):
+		return to.Kind() == reflect.Float32 || to.Kind() == reflect.Float64
+	case reflect.TypeOf(true):
+		return to.Kind() == reflect.Bool
+	case handlerType(&ListCapture{}):
+		return to.Kind() == reflect.Slice || to.Kind() == reflect.Array
+	case handlerType(&TableCapture{}):
+		switch to.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Array:
+			return true
+		case reflect.Map:
+			return to.Key().Kind() == reflect.String
+		}
+	}
+	return false
+}
+
+// Is t an integer or float type?
+func isNumber(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
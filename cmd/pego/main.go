@@ -0,0 +1,216 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+// Pego is a tool for working with pego grammars.
+//
+// Usage:
+//
+//	pego lint grammar.peg...
+//	pego test [-update] grammar.peg tests.pegotest...
+//	pego railroad [-o dir] grammar.peg
+//	pego dot [-O] grammar.peg
+//
+// Grammars are read with pego.ParseGrammar, and tests with
+// pegotest.ParseFile.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/losinggeneration/pego"
+	"github.com/losinggeneration/pego/pegotest"
+)
+
+const usage = `usage: pego command [arguments]
+
+Commands:
+  lint grammar.peg...   report likely mistakes in grammars
+  test [-update] grammar.peg tests.pegotest...
+                        run golden-file tests of a grammar
+  railroad [-o dir] grammar.peg
+                        draw SVG railroad diagrams of the rules of a grammar
+  dot [-O] grammar.peg  write the control flow graph of a grammar for Graphviz
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "lint":
+		os.Exit(lint(os.Args[2:]))
+	case "test":
+		os.Exit(test(os.Args[2:]))
+	case "railroad":
+		os.Exit(railroad(os.Args[2:]))
+	case "dot":
+		os.Exit(dot(os.Args[2:]))
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "pego: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// Lint each grammar. Returns the exit status: 1 if there were any
+// warnings or errors.
+func lint(files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: pego lint grammar.peg...")
+		return 2
+	}
+	status := 0
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		var warnings []*pego.LintWarning
+		if start, rules, err := pego.ParseRules(string(src)); err == nil {
+			warnings = pego.LintGrammar(start, rules)
+		} else if pat, err := pego.ParseGrammar(string(src)); err == nil {
+			warnings = pego.Lint(pat)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", file, err)
+			status = 1
+			continue
+		}
+		for _, w := range warnings {
+			fmt.Printf("%s: %s\n", file, w)
+			status = 1
+		}
+	}
+	return status
+}
+
+// Run the tests of a grammar, or update their expectations. Returns
+// the exit status: 1 if any test failed.
+func test(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	update := flags.Bool("update", false, "replace the expectations with the current results")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pego test [-update] grammar.peg tests.pegotest...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+	src, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pat, err := pego.ParseGrammar(string(src))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", flags.Arg(0), err)
+		return 1
+	}
+	status := 0
+	for _, file := range flags.Args()[1:] {
+		f, err := pegotest.ParseFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if *update {
+			if err := f.Update(pat); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 1
+			} else if err := os.WriteFile(file, f.Format(), 0666); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 1
+			}
+			continue
+		}
+		failures := f.Run(pat)
+		for _, fail := range failures {
+			fmt.Println(fail)
+			status = 1
+		}
+		fmt.Printf("%s: %d passed, %d failed\n", file, len(f.Cases)-len(failures), len(failures))
+	}
+	return status
+}
+
+// Write a diagram of each rule of a grammar to <rule>.svg. A grammar
+// without rules gives one diagram, named after the grammar file.
+// Returns the exit status.
+func railroad(args []string) int {
+	flags := flag.NewFlagSet("railroad", flag.ExitOnError)
+	dir := flags.String("o", ".", "write the diagrams to `dir`")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pego railroad [-o dir] grammar.peg")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	file := flags.Arg(0)
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var diagrams map[string][]byte
+	if start, rules, err := pego.ParseRules(string(src)); err == nil {
+		diagrams = pego.RailroadGrammar(start, rules)
+	} else if pat, err := pego.ParseGrammar(string(src)); err == nil {
+		diagrams = pego.Railroad(pat)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", file, err)
+		return 1
+	}
+	for name, svg := range diagrams {
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if err := os.WriteFile(filepath.Join(*dir, name+".svg"), svg, 0666); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// Write the control flow graph of the code of a grammar. Returns the
+// exit status.
+func dot(args []string) int {
+	flags := flag.NewFlagSet("dot", flag.ExitOnError)
+	optimize := flags.Bool("O", false, "show the code after pego.Optimize")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pego dot [-O] grammar.peg")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	src, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pat, err := pego.ParseGrammar(string(src))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", flags.Arg(0), err)
+		return 1
+	}
+	if *optimize {
+		pat = pego.Optimize(pat)
+	}
+	fmt.Print(pego.Dot(pat))
+	return 0
+}
@@ -0,0 +1,267 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+// Pegobench compares the benchmarks of two versions of pego.
+//
+// Usage:
+//
+//	pegobench [-bench regexp] [-count n] [-benchtime d] [-o dir] old [new]
+//
+// Old and new are git revisions of the repository in the current
+// directory. Without new, the working tree is used. Each revision is
+// checked out in a temporary worktree, its benchmarks are run with
+// `go test`, and the mean time, bytes and allocations per match are
+// shown side by side. Times are followed by their spread: the largest
+// distance of a run from the mean. A delta is shown as ~ when the
+// runs of the two revisions overlap, as the change may well be noise.
+//
+// This is a quick check. With -o, the output of go test is also saved
+// as old.txt and new.txt in dir, for a proper statistical comparison
+// with benchstat (golang.org/x/perf/cmd/benchstat).
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Results of one benchmark, over all runs.
+type result struct {
+	ns, bytes, allocs []float64
+}
+
+// Results of a build, and the benchmark names in the order they ran.
+type results struct {
+	names  []string
+	byName map[string]*result
+}
+
+func main() {
+	bench := flag.String("bench", ".", "run only the benchmarks matching `regexp`")
+	count := flag.Int("count", 5, "run each benchmark `n` times")
+	benchtime := flag.String("benchtime", "", "run each benchmark for `d`, passed to go test")
+	outDir := flag.String("o", "", "save the output of go test in `dir`, for benchstat")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pegobench [flags] old [new]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	args := []string{"test", "-run", "^$", "-bench", *bench, "-benchmem", "-count", strconv.Itoa(*count)}
+	if *benchtime != "" {
+		args = append(args, "-benchtime", *benchtime)
+	}
+	if err := compare(flag.Arg(0), flag.Arg(1), args, *outDir); err != nil {
+		fatal(err)
+	}
+}
+
+// Run the benchmarks of both revisions with `go test args`, and report
+// them. The worktrees are removed before it returns.
+func compare(old, cur string, args []string, outDir string) error {
+	root, err := git("", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	var builds [2]*results
+	for i, rev := range []string{old, cur} {
+		dir := root
+		if rev != "" {
+			if dir, err = checkout(root, rev); err != nil {
+				return err
+			}
+			defer remove(root, dir)
+		} else {
+			rev = "working tree"
+		}
+		fmt.Fprintf(os.Stderr, "pegobench: running benchmarks of %s\n", rev)
+		out, err := run(dir, args)
+		if err != nil {
+			return err
+		}
+		if outDir != "" {
+			name := filepath.Join(outDir, []string{"old.txt", "new.txt"}[i])
+			if err := os.WriteFile(name, out, 0666); err != nil {
+				return err
+			}
+		}
+		builds[i] = parse(out)
+	}
+	report(builds[0], builds[1])
+	return nil
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "pegobench: %v\n", err)
+	os.Exit(1)
+}
+
+// Run git in dir, and return its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Check out the revision in a new temporary worktree.
+func checkout(root, rev string) (string, error) {
+	dir, err := os.MkdirTemp("", "pegobench")
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "pego")
+	if _, err := git(root, "worktree", "add", "--detach", dir, rev); err != nil {
+		os.RemoveAll(filepath.Dir(dir))
+		return "", err
+	}
+	return dir, nil
+}
+
+// Remove a worktree made by checkout.
+func remove(root, dir string) {
+	git(root, "worktree", "remove", "--force", dir)
+	os.RemoveAll(filepath.Dir(dir))
+}
+
+// Run the benchmarks in dir, and return the output of go test.
+func run(dir string, args []string) ([]byte, error) {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		os.Stderr.Write(out)
+		return nil, fmt.Errorf("go test in %s: %v", dir, err)
+	}
+	return out, nil
+}
+
+// Parse the output of `go test -bench`. Lines look like:
+//
+//	BenchmarkJSON/pego-8   58   4532843 ns/op   26.35 MB/s   1956008 B/op   81417 allocs/op
+func parse(out []byte) *results {
+	ret := &results{byName: make(map[string]*result)}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		name := fields[0]
+		// Drop the GOMAXPROCS suffix.
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+		r, ok := ret.byName[name]
+		if !ok {
+			r = &result{}
+			ret.byName[name] = r
+			ret.names = append(ret.names, name)
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				r.ns = append(r.ns, v)
+			case "B/op":
+				r.bytes = append(r.bytes, v)
+			case "allocs/op":
+				r.allocs = append(r.allocs, v)
+			}
+		}
+	}
+	return ret
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+func minMax(xs []float64) (lo, hi float64) {
+	for i, x := range xs {
+		if i == 0 || x < lo {
+			lo = x
+		}
+		if i == 0 || x > hi {
+			hi = x
+		}
+	}
+	return lo, hi
+}
+
+// Largest distance of a run from the mean, in percent of the mean.
+func spread(xs []float64) string {
+	m := mean(xs)
+	if m == 0 {
+		return "±0%"
+	}
+	lo, hi := minMax(xs)
+	d := hi - m
+	if m-lo > d {
+		d = m - lo
+	}
+	return fmt.Sprintf("±%.0f%%", 100*d/m)
+}
+
+// Change from the runs a to the runs b, in percent, or ~ if they
+// overlap.
+func delta(as, bs []float64) string {
+	alo, ahi := minMax(as)
+	blo, bhi := minMax(bs)
+	if alo <= bhi && blo <= ahi {
+		return "~"
+	}
+	a, b := mean(as), mean(bs)
+	if a == 0 {
+		if b == 0 {
+			return "~"
+		}
+		return "+inf%"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*(b-a)/a)
+}
+
+// Write the benchmarks of both builds side by side. Benchmarks that
+// only ran in one of them are left out.
+func report(old, cur *results) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "old ns/op\t\tnew ns/op\t\tdelta\told B/op\tnew B/op\tdelta\told allocs\tnew allocs\tdelta\t benchmark")
+	for _, name := range old.names {
+		a, b := old.byName[name], cur.byName[name]
+		if b == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%.0f\t%s\t%.0f\t%s\t%s\t%.0f\t%.0f\t%s\t%.0f\t%.0f\t%s\t %s\n",
+			mean(a.ns), spread(a.ns), mean(b.ns), spread(b.ns), delta(a.ns, b.ns),
+			mean(a.bytes), mean(b.bytes), delta(a.bytes, b.bytes),
+			mean(a.allocs), mean(b.allocs), delta(a.allocs, b.allocs), name)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,294 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+// Pegodbg is an interactive debugger for pego grammars.
+//
+// Usage:
+//
+//	pegodbg grammar.peg input.txt
+//
+// The grammar is read with pego.ParseGrammar. Type "help" at the prompt
+// for a list of commands.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/losinggeneration/pego"
+)
+
+const help = `Commands:
+  s, step [n]       run n instructions (default 1)
+  c, continue       run until a breakpoint or the end of the match
+  b, break RULE     stop when RULE is called
+  b, break @OFFSET  stop when the input position reaches OFFSET
+  d, delete [BREAK] remove a breakpoint, or all of them
+  i, info           list breakpoints
+  stack             show the backtrack stack
+  caps              show the capture stack
+  w, where          show the current instruction and input
+  l, list [n]       show n instructions around the current one
+  r, run            restart the match
+  f, failure        restart and stop at the last failure
+  q, quit           exit
+`
+
+// Raised from Trace to abort a match and start over.
+type restart struct{}
+
+type debugger struct {
+	prog  *pego.Pattern
+	input string
+	in    *bufio.Scanner
+	out   io.Writer
+
+	rules   map[string]bool
+	offsets map[int]bool
+
+	step     int // Number of instructions run
+	stopAt   int // Stop before this step, or never if -1
+	lastPos  int
+	lastFail int // Step where the last failure happened
+	event    *pego.TraceEvent
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: pegodbg grammar.peg input.txt")
+		os.Exit(2)
+	}
+	src, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	prog, err := pego.ParseGrammar(string(src))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+	input, err := os.ReadFile(os.Args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	d := &debugger{
+		prog:     prog,
+		input:    string(input),
+		in:       bufio.NewScanner(os.Stdin),
+		out:      os.Stdout,
+		rules:    make(map[string]bool),
+		offsets:  make(map[int]bool),
+		lastFail: -1,
+	}
+	d.session()
+}
+
+// Run the match over and over, until the user quits.
+func (d *debugger) session() {
+	d.stopAt = 1
+	for {
+		if d.run() {
+			return
+		}
+	}
+}
+
+// Run the match once. Returns true if the user wants to quit.
+func (d *debugger) run() (quit bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(restart); !ok {
+				panic(e)
+			}
+			quit = false
+		}
+	}()
+	d.step, d.lastPos, d.event = 0, -1, nil
+	r, err, pos := pego.MatchWithOptions(d.prog, d.input, &pego.MatchOptions{Tracer: d})
+	if err != nil {
+		// The failure that ended the match has no backtrack event.
+		d.lastFail = d.step
+		fmt.Fprintf(d.out, "Match failed at %d after %d steps: %v\n", pos, d.step, err)
+	} else {
+		fmt.Fprintf(d.out, "Matched %d of %d bytes after %d steps\n", pos, len(d.input), d.step)
+		if r != nil {
+			fmt.Fprintf(d.out, "Result: %v\n", r)
+		}
+	}
+	d.stopAt = -1
+	return d.prompt(false)
+}
+
+func (d *debugger) Trace(e *pego.TraceEvent) {
+	switch e.Kind {
+	case pego.TraceBacktrack:
+		d.lastFail = d.step
+	case pego.TraceCall:
+		if d.rules[e.Rule] {
+			fmt.Fprintf(d.out, "Breakpoint: call %s\n", e.Rule)
+			d.stopAt = d.step + 1
+		}
+	case pego.TraceStep:
+		d.step++
+		d.event = e
+		stop := d.step == d.stopAt
+		if d.offsets[e.Pos] && e.Pos != d.lastPos {
+			fmt.Fprintf(d.out, "Breakpoint: @%d\n", e.Pos)
+			stop = true
+		}
+		d.lastPos = e.Pos
+		if stop {
+			d.where()
+			d.prompt(true)
+		}
+	}
+}
+
+// Read and run commands. Returns when the match should continue, or
+// true if the user wants to quit.
+func (d *debugger) prompt(running bool) bool {
+	for {
+		fmt.Fprint(d.out, "(pegodbg) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			os.Exit(0)
+		}
+		args := strings.Fields(d.in.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "s", "step":
+			n := 1
+			if len(args) > 1 {
+				n, _ = strconv.Atoi(args[1])
+			}
+			if !running {
+				fmt.Fprintln(d.out, "The match has ended")
+				continue
+			}
+			d.stopAt = d.step + n
+			return false
+		case "c", "continue":
+			if !running {
+				fmt.Fprintln(d.out, "The match has ended")
+				continue
+			}
+			d.stopAt = -1
+			return false
+		case "b", "break":
+			if len(args) < 2 {
+				fmt.Fprintln(d.out, "Usage: break RULE or break @OFFSET")
+			} else if strings.HasPrefix(args[1], "@") {
+				n, err := strconv.Atoi(args[1][1:])
+				if err != nil {
+					fmt.Fprintln(d.out, err)
+					continue
+				}
+				d.offsets[n] = true
+			} else {
+				d.rules[args[1]] = true
+			}
+		case "d", "delete":
+			if len(args) < 2 {
+				d.rules = make(map[string]bool)
+				d.offsets = make(map[int]bool)
+			} else if n, err := strconv.Atoi(strings.TrimPrefix(args[1], "@")); err == nil && args[1][0] == '@' {
+				delete(d.offsets, n)
+			} else {
+				delete(d.rules, args[1])
+			}
+		case "i", "info":
+			for r := range d.rules {
+				fmt.Fprintf(d.out, "  %s\n", r)
+			}
+			for n := range d.offsets {
+				fmt.Fprintf(d.out, "  @%d\n", n)
+			}
+		case "stack":
+			if d.event != nil {
+				fmt.Fprintln(d.out, d.event.Stack)
+			}
+		case "caps":
+			if d.event != nil {
+				fmt.Fprintln(d.out, d.event.Captures)
+			}
+		case "w", "where":
+			d.where()
+		case "l", "list":
+			n := 10
+			if len(args) > 1 {
+				n, _ = strconv.Atoi(args[1])
+			}
+			d.list(n)
+		case "r", "run":
+			d.stopAt = 1
+			panic(restart{})
+		case "f", "failure":
+			if d.lastFail < 0 {
+				fmt.Fprintln(d.out, "No failure yet")
+				continue
+			}
+			d.stopAt = d.lastFail
+			panic(restart{})
+		case "q", "quit":
+			if running {
+				os.Exit(0)
+			}
+			return true
+		case "h", "help":
+			fmt.Fprint(d.out, help)
+		default:
+			fmt.Fprintf(d.out, "Unknown command %q. Try \"help\".\n", args[0])
+		}
+	}
+}
+
+// Show the current instruction and the input around the position.
+func (d *debugger) where() {
+	e := d.event
+	if e == nil {
+		return
+	}
+	const size = 30
+	lo, hi := e.Pos-size, e.Pos+size
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(d.input) {
+		hi = len(d.input)
+	}
+	before := strconv.Quote(d.input[lo:e.Pos])
+	after := strconv.Quote(d.input[e.Pos:hi])
+	fmt.Fprintf(d.out, "step %d: %6d  %s\n", d.step, e.PC, e.Op)
+	fmt.Fprintf(d.out, "  @%d  %s%s\n", e.Pos, before[:len(before)-1], after[1:])
+	fmt.Fprintf(d.out, "  %s^\n", strings.Repeat(" ", len(strconv.Itoa(e.Pos))+3+len(before)-1))
+}
+
+// Show the instructions around the current one.
+func (d *debugger) list(n int) {
+	lines := strings.Split(d.prog.String(), "\n")
+	pc := 0
+	if d.event != nil {
+		pc = d.event.PC
+	}
+	lo, hi := pc-n/2, pc+n/2+1
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(lines) {
+		hi = len(lines)
+	}
+	for i := lo; i < hi; i++ {
+		mark := " "
+		if i == pc {
+			mark = ">"
+		}
+		fmt.Fprintf(d.out, "%s%s\n", mark, lines[i])
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/losinggeneration/pego"
+)
+
+func TestFailure(t *testing.T) {
+	prog, err := pego.ParseGrammar("S <- ('xy' / 'a') 'b'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := &debugger{
+		prog:     prog,
+		input:    "ac",
+		in:       bufio.NewScanner(strings.NewReader("c\nf\nc\nq\n")),
+		out:      &out,
+		rules:    make(map[string]bool),
+		offsets:  make(map[int]bool),
+		lastFail: -1,
+	}
+	d.session()
+	// The match backtracks from 'xy', then ends when 'b' fails.
+	if !strings.Contains(out.String(), "Char 0x62\n  @1  \"ac\"\n") {
+		t.Errorf("Expected to stop at the failure of 'b', got\n%s", out.String())
+	}
+}
@@ -0,0 +1,530 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Growth of the matching time of a rule with the size of the input.
+type Complexity int
+
+const (
+	Linear Complexity = iota
+	Polynomial
+	Exponential
+	Nonterminating // Can loop forever
+	Unknown        // The code could not be analyzed
+)
+
+var complexityNames = [...]string{"linear", "polynomial", "exponential", "nonterminating", "unknown"}
+
+func (c Complexity) String() string {
+	if 0 <= c && int(c) < len(complexityNames) {
+		return complexityNames[c]
+	}
+	return fmt.Sprintf("Complexity(%d)", int(c))
+}
+
+// Worst case of a rule, found by AnalyzeBacktracking.
+type RuleComplexity struct {
+	Rule    string
+	Class   Complexity
+	Degree  int    // Estimated degree, for Polynomial
+	Witness string // Input that triggers the worst case, or "" if none was confirmed
+	Reason  string // Construct causing the worst case
+}
+
+func (c *RuleComplexity) String() string {
+	class := c.Class.String()
+	if c.Class == Polynomial {
+		class = fmt.Sprintf("polynomial (n^%d)", c.Degree)
+	}
+	if c.Class == Linear {
+		return fmt.Sprintf("%s: %s", c.Rule, class)
+	}
+	if c.Witness == "" {
+		return fmt.Sprintf("%s: %s, %s", c.Rule, class, c.Reason)
+	}
+	return fmt.Sprintf("%s: %s, %s; witness %q", c.Rule, class, c.Reason, c.Witness)
+}
+
+// Find the rules that can backtrack more than a linear amount, like
+// the ReDoS checks for regular expressions. Suspects are found from the
+// structure of the pattern:
+//   - choices whose alternatives can start alike, and both enter the
+//     rule again, are exponential, as each level of nesting is parsed
+//     more than once
+//   - choices inside unlimited repetitions, whose first alternative can
+//     consume any amount of input before failing, are polynomial
+//   - unlimited repetitions of patterns that can match the empty
+//     string, and left recursion, never terminate
+//
+// The class comes from the worst suspect. An input built to trigger it
+// is returned as the witness if matching it twice, at two sizes, shows
+// that the number of instructions run grows faster than the input.
+// Suspects that no input can reach, or that were not confirmed, are
+// reported without a witness.
+//
+// Only patterns made by the constructors are understood. Rules with
+// other code, such as the output of Optimize() or of Assemble(), are
+// Unknown.
+func AnalyzeBacktracking(p *Pattern) []*RuleComplexity {
+	a := &backtrackAnalysis{
+		program: p,
+		top:     decodeExpr(p),
+		calls:   make(map[*exprRule]map[*exprRule]bool),
+	}
+	if a.top.kind == exprCode {
+		return []*RuleComplexity{{Rule: profileMain, Class: Unknown, Reason: "the code can not be decoded"}}
+	}
+	a.lint = newLinter(a.top)
+	a.rules = a.top.allRules()
+	a.shortest = newShortestInputs(a.rules)
+	a.findCalls()
+	var ret []*RuleComplexity
+	if a.top.kind == exprGrammar {
+		for _, r := range a.rules {
+			ret = append(ret, a.analyze(r))
+		}
+	} else {
+		ret = append(ret, a.analyze(&exprRule{name: profileMain, body: a.top}))
+	}
+	return ret
+}
+
+type backtrackAnalysis struct {
+	program  *Pattern
+	top      *expr
+	lint     *linter
+	rules    []*exprRule
+	shortest shortestInputs
+	calls    map[*exprRule]map[*exprRule]bool // Rules reachable through calls
+}
+
+// A suspected worst case. The input triggering it is `prefix`, then
+// `n` times `unit`.
+type backtrackCase struct {
+	class        Complexity
+	degree       int // For Polynomial
+	reason       string
+	prefix, unit string
+}
+
+func (c *backtrackCase) witness(n int) string {
+	return c.prefix + strings.Repeat(c.unit, n)
+}
+
+// Shortest input matched by each rule.
+type shortestInputs map[*exprRule]string
+
+func newShortestInputs(rules []*exprRule) shortestInputs {
+	s := make(shortestInputs)
+	for changed := true; changed; {
+		changed = false
+		for _, r := range rules {
+			in, ok := s.of(r.body)
+			if old, found := s[r]; ok && (!found || len(in) < len(old)) {
+				s[r] = in
+				changed = true
+			}
+		}
+	}
+	return s
+}
+
+// The shortest input matched by x, ignoring predicates.
+func (s shortestInputs) of(x *expr) (string, bool) {
+	switch x.kind {
+	case exprOp:
+		if set, ok := byteset(x.op); ok {
+			return string([]byte{pickByte(set)}), true
+		}
+		switch op := x.op.(type) {
+		case *IAny:
+			return strings.Repeat("a", op.count), true
+		case *IKeywords:
+			best := op.words[0]
+			for _, w := range op.words {
+				if len(w) < len(best) {
+					best = w
+				}
+			}
+			return best, true
+		case *IDFA:
+			return dfaShortest(op)
+		case *IEmptyCapture, *IFullCapture:
+			return "", true
+		}
+	case exprSeq:
+		var b strings.Builder
+		for _, arg := range x.args {
+			in, ok := s.of(arg)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(in)
+		}
+		return b.String(), true
+	case exprOr:
+		best, found := "", false
+		for _, arg := range x.args {
+			if in, ok := s.of(arg); ok && (!found || len(in) < len(best)) {
+				best, found = in, true
+			}
+		}
+		return best, found
+	case exprRep:
+		if x.min == 0 {
+			return "", true
+		}
+		in, ok := s.of(x.args[0])
+		return strings.Repeat(in, x.min), ok
+	case exprNot, exprAnd:
+		return "", true
+	case exprCapture:
+		return s.of(x.args[0])
+	case exprCall:
+		if x.rule != nil {
+			in, ok := s[x.rule]
+			return in, ok
+		}
+	case exprGrammar:
+		in, ok := s[x.rules[0]]
+		return in, ok
+	}
+	return "", false
+}
+
+// A readable character from the set, if there is one.
+func pickByte(set *ICharset) byte {
+	for _, r := range []string{"az", "09", "AZ", "!~", " ~"} {
+		for c := r[0]; c <= r[1]; c++ {
+			if set.Has(c) {
+				return c
+			}
+		}
+	}
+	for c := 0; c < 256; c++ {
+		if set.Has(byte(c)) {
+			return byte(c)
+		}
+	}
+	return 0
+}
+
+func (a *backtrackAnalysis) findCalls() {
+	direct := make(map[*exprRule][]*exprRule)
+	for _, r := range a.rules {
+		r := r
+		r.body.walk(func(x *expr) {
+			if x.kind == exprCall && x.rule != nil {
+				direct[r] = append(direct[r], x.rule)
+			} else if x.kind == exprGrammar {
+				direct[r] = append(direct[r], x.rules[0])
+			}
+		})
+	}
+	for _, r := range a.rules {
+		seen := make(map[*exprRule]bool)
+		queue := append([]*exprRule(nil), direct[r]...)
+		for len(queue) > 0 {
+			q := queue[0]
+			queue = queue[1:]
+			if !seen[q] {
+				seen[q] = true
+				queue = append(queue, direct[q]...)
+			}
+		}
+		a.calls[r] = seen
+	}
+}
+
+// Does x call a rule that can call r, or r itself?
+func (a *backtrackAnalysis) recurses(x *expr, r *exprRule) bool {
+	found := false
+	x.walk(func(x *expr) {
+		if x.kind == exprCall && x.rule != nil && (x.rule == r || a.calls[x.rule][r]) {
+			found = true
+		}
+	})
+	return found
+}
+
+// The shortest input leading from the start of x to the point where
+// `goal` is about to run, or to a call of `rule`.
+func (a *backtrackAnalysis) reach(x *expr, goal *expr, rule *exprRule) (string, bool) {
+	return a.reachFrom(x, goal, rule, make(map[*exprRule]bool))
+}
+
+func (a *backtrackAnalysis) reachFrom(x, goal *expr, rule *exprRule, visited map[*exprRule]bool) (string, bool) {
+	if x == goal {
+		return "", true
+	}
+	switch x.kind {
+	case exprSeq:
+		var b strings.Builder
+		for _, arg := range x.args {
+			if s, ok := a.reachFrom(arg, goal, rule, visited); ok {
+				return b.String() + s, true
+			}
+			s, ok := a.shortest.of(arg)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(s)
+		}
+	case exprOr:
+		best, found := "", false
+		for _, arg := range x.args {
+			if s, ok := a.reachFrom(arg, goal, rule, visited); ok && (!found || len(s) < len(best)) {
+				best, found = s, true
+			}
+		}
+		return best, found
+	case exprRep, exprNot, exprAnd, exprCapture:
+		return a.reachFrom(x.args[0], goal, rule, visited)
+	case exprCall:
+		if x.rule == nil {
+			break
+		}
+		if x.rule == rule {
+			return "", true
+		}
+		if !visited[x.rule] {
+			visited[x.rule] = true
+			return a.reachFrom(x.rule.body, goal, rule, visited)
+		}
+	case exprGrammar:
+		if x.rules[0] == rule {
+			return "", true
+		}
+		if !visited[x.rules[0]] {
+			visited[x.rules[0]] = true
+			return a.reachFrom(x.rules[0].body, goal, rule, visited)
+		}
+	}
+	return "", false
+}
+
+// Find the worst case of a rule.
+func (a *backtrackAnalysis) analyze(r *exprRule) *RuleComplexity {
+	ret := &RuleComplexity{Rule: r.String(), Class: Linear}
+	decoded := true
+	r.body.walk(func(x *expr) {
+		decoded = decoded && x.kind != exprCode
+	})
+	if !decoded {
+		ret.Class, ret.Reason = Unknown, "the code can not be decoded"
+		return ret
+	}
+	// Input leading to the rule.
+	pre, reachable := "", true
+	if r.name != profileMain || r.body != a.top {
+		pre, reachable = a.reach(a.top, nil, r)
+	}
+	if a.leftRecursive(r) {
+		ret.Class, ret.Reason, ret.Witness = Nonterminating, "left recursion", pre
+		return ret
+	}
+	var cases []*backtrackCase
+	var visit func(x *expr, loops []*expr)
+	visit = func(x *expr, loops []*expr) {
+		switch x.kind {
+		case exprRep:
+			if x.max < 0 && a.lint.info(x.args[0]).empty {
+				s, _ := a.reach(r.body, x, nil)
+				cases = append(cases, &backtrackCase{
+					class:  Nonterminating,
+					reason: fmt.Sprintf("%s can repeat the empty string", x),
+					prefix: pre + s,
+				})
+			}
+			if x.max < 0 {
+				loops = append(loops, x)
+			}
+		case exprOr:
+			cases = append(cases, a.choiceCases(r, x, loops, pre)...)
+		case exprCall:
+			return
+		}
+		for _, arg := range x.args {
+			visit(arg, loops)
+		}
+	}
+	visit(r.body, nil)
+	for _, c := range cases {
+		if c.class == Nonterminating {
+			ret.Class, ret.Reason, ret.Witness = c.class, c.reason, c.prefix
+			return ret
+		}
+	}
+	var worst *backtrackCase
+	for _, c := range cases {
+		if worst == nil || c.class > worst.class || c.class == worst.class && c.degree > worst.degree {
+			worst = c
+		}
+	}
+	if worst == nil {
+		return ret
+	}
+	ret.Class, ret.Degree, ret.Reason = worst.class, worst.degree, worst.reason
+	if reachable {
+		ret.Witness = a.confirm(worst)
+	}
+	return ret
+}
+
+// Suspected worst cases of a choice in rule r, inside the unlimited
+// repetitions `loops`.
+func (a *backtrackAnalysis) choiceCases(r *exprRule, x *expr, loops []*expr, pre string) []*backtrackCase {
+	var ret []*backtrackCase
+	for i, alt := range x.args[:len(x.args)-1] {
+		ai := a.lint.info(alt)
+		for _, later := range x.args[i+1:] {
+			aj := a.lint.info(later)
+			if !ai.empty && !aj.empty && !ai.first.intersects(&aj.first) {
+				continue
+			}
+			if a.recurses(alt, r) && a.recurses(later, r) {
+				toChoice, ok1 := a.reach(r.body, x, nil)
+				toRule, ok2 := a.reach(alt, nil, r)
+				if ok1 && ok2 && toChoice+toRule != "" {
+					ret = append(ret, &backtrackCase{
+						class:  Exponential,
+						reason: fmt.Sprintf("%s parses %s again after %s fails", x, r, alt),
+						prefix: pre,
+						unit:   toChoice + toRule,
+					})
+				}
+			}
+			if len(loops) > 0 && a.unbounded(alt) {
+				loop := loops[len(loops)-1]
+				toLoop, ok1 := a.reach(r.body, loop, nil)
+				toChoice, ok2 := a.reach(loop.args[0], x, nil)
+				s, ok3 := a.shortest.of(later)
+				if ok1 && ok2 && ok3 && toChoice+s != "" {
+					// Each enclosing loop can rescan the input.
+					ret = append(ret, &backtrackCase{
+						class:  Polynomial,
+						degree: len(loops) + 1,
+						reason: fmt.Sprintf("%s can consume the input again after %s fails", later, alt),
+						prefix: pre + toLoop,
+						unit:   toChoice + s,
+					})
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// Can x consume any amount of input?
+func (a *backtrackAnalysis) unbounded(x *expr) bool {
+	found := false
+	x.walk(func(y *expr) {
+		switch {
+		case y.kind == exprRep && y.max < 0:
+			found = true
+		case y.kind == exprCall && y.rule != nil && a.calls[y.rule][y.rule]:
+			found = true
+		}
+	})
+	return found
+}
+
+// Can r call itself without consuming input?
+func (a *backtrackAnalysis) leftRecursive(r *exprRule) bool {
+	seen := make(map[*exprRule]bool)
+	queue := a.leftCalls(r.body, nil)
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+		if q == r {
+			return true
+		}
+		if !seen[q] {
+			seen[q] = true
+			queue = a.leftCalls(q.body, queue)
+		}
+	}
+	return false
+}
+
+// Rules called by x before it consumes any input.
+func (a *backtrackAnalysis) leftCalls(x *expr, ret []*exprRule) []*exprRule {
+	switch x.kind {
+	case exprSeq:
+		for _, arg := range x.args {
+			ret = a.leftCalls(arg, ret)
+			if !a.lint.info(arg).empty {
+				break
+			}
+		}
+	case exprOr:
+		for _, arg := range x.args {
+			ret = a.leftCalls(arg, ret)
+		}
+	case exprRep, exprNot, exprAnd, exprCapture:
+		ret = a.leftCalls(x.args[0], ret)
+	case exprCall:
+		if x.rule != nil {
+			ret = append(ret, x.rule)
+		}
+	case exprGrammar:
+		ret = append(ret, x.rules[0])
+	}
+	return ret
+}
+
+// Limit on the instructions run to confirm a witness.
+const maxAnalysisSteps = 1 << 16
+
+// Size of the smaller of the two witnesses matched by confirm().
+const confirmSize = 16
+
+// Counts the instructions of a match, and gives up past a limit.
+type stepCounter struct {
+	steps int
+}
+
+type stepLimit struct{}
+
+func (c *stepCounter) Trace(e *TraceEvent) {
+	if e.Kind == TraceStep {
+		if c.steps++; c.steps > maxAnalysisSteps {
+			panic(stepLimit{})
+		}
+	}
+}
+
+// Number of instructions run to match the input, or -1 past the limit.
+func (a *backtrackAnalysis) steps(input string) (steps int) {
+	c := &stepCounter{}
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(stepLimit); !ok {
+				panic(e)
+			}
+			steps = -1
+		}
+	}()
+	MatchWithOptions(a.program, input, &MatchOptions{Tracer: c})
+	return c.steps
+}
+
+// Match the witness at two sizes, and return the larger one if the
+// number of steps grows faster than the input, or "".
+func (a *backtrackAnalysis) confirm(c *backtrackCase) string {
+	small := a.steps(c.witness(confirmSize))
+	if small < 0 {
+		return c.witness(confirmSize)
+	}
+	witness := c.witness(2 * confirmSize)
+	// Doubling linear work about doubles the steps.
+	if big := a.steps(witness); big < 0 || big > 3*small {
+		return witness
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Collects which instructions of a pattern were run, over any number
+// of matches. Matches must be run through Coverage.Match(), or with
+// the coverage as the Tracer.
+type Coverage struct {
+	program *Pattern
+	rules   []Rule
+	counts  []int         // Runs of each instruction
+	words   map[int][]int // Matches of each keyword, by instruction
+	input   string
+	inMatch bool // Is the input known, while in Match()?
+	pending int  // Keyword instruction waiting for its result, or -1
+	pos     int  // Position of the pending keyword instruction
+}
+
+func NewCoverage(program *Pattern) *Coverage {
+	return &Coverage{
+		program: program,
+		rules:   Rules(program),
+		counts:  make([]int, len(*program)),
+		words:   make(map[int][]int),
+		pending: -1,
+	}
+}
+
+// Same as NewCoverage(Grm(start, grammar)), but rules that are never
+// called are named in the reports too.
+func NewCoverageGrammar(start string, grammar map[string]*Pattern) *Coverage {
+	program, starts := layoutGrammar(start, grammar)
+	c := NewCoverage(program)
+	// Keep the rules of nested grammars, found through their calls.
+	rules := make([]Rule, 0, len(starts))
+	for name, pc := range starts {
+		rules = append(rules, Rule{name, pc, pc + len(*grammar[name])})
+	}
+	for _, r := range c.rules {
+		if pc, ok := starts[r.Name]; !ok || pc != r.Start {
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Start < rules[j].Start })
+	c.rules = rules
+	return c
+}
+
+// Match and record the coverage. Same as Match().
+func (c *Coverage) Match(input string) (interface{}, error, int) {
+	c.input, c.inMatch, c.pending = input, true, -1
+	r, err, pos := MatchWithOptions(c.program, input, &MatchOptions{Tracer: c})
+	if c.pending >= 0 && err == nil {
+		c.keyword(pos)
+	}
+	c.input, c.inMatch = "", false
+	return r, err, pos
+}
+
+func (c *Coverage) Trace(e *TraceEvent) {
+	switch e.Kind {
+	case TraceStep:
+		if c.pending >= 0 && e.PC == c.pending+1 {
+			c.keyword(e.Pos)
+		}
+		c.pending = -1
+		if 0 <= e.PC && e.PC < len(c.counts) {
+			c.counts[e.PC]++
+		}
+		// Without the input, the keyword that matched is not known.
+		if _, ok := e.Op.(*IKeywords); ok && c.inMatch {
+			c.pending, c.pos = e.PC, e.Pos
+		}
+	case TraceBacktrack:
+		c.pending = -1
+	}
+}
+
+// Record which keyword the pending instruction matched, now that the
+// match continued at `pos`.
+func (c *Coverage) keyword(pos int) {
+	op := (*c.program)[c.pending].(*IKeywords)
+	hits, ok := c.words[c.pending]
+	if !ok {
+		hits = make([]int, len(op.words))
+		c.words[c.pending] = hits
+	}
+	word := c.input[c.pos:pos]
+	for i, w := range op.words {
+		if w == word {
+			hits[i]++
+			break
+		}
+	}
+}
+
+// Fraction of instructions that were run, in percent.
+func (c *Coverage) Percent() float64 {
+	run, total := c.covered(0, len(c.counts))
+	return percent(int64(run), int64(total))
+}
+
+// Number of instructions run in code[start:end], and the number of
+// instructions that count. The final End is not counted.
+func (c *Coverage) covered(start, end int) (int, int) {
+	run, total := 0, 0
+	for i := start; i < end && i < len(c.counts)-1; i++ {
+		total++
+		if c.counts[i] > 0 {
+			run++
+		}
+	}
+	return run, total
+}
+
+// An ordered choice, with the first instruction of each alternative.
+type orChoice struct {
+	pc   int
+	alts []int
+}
+
+// Is the instruction at `pc` the choice of an Or()? Returns the start
+// of the second alternative, and the end of the choice.
+func isOr(code Pattern, pc int) (int, int, bool) {
+	op, ok := code[pc].(*IChoice)
+	if !ok {
+		return 0, 0, false
+	}
+	alt := pc + op.offset
+	if alt <= pc+1 || alt > len(code) {
+		return 0, 0, false
+	}
+	commit, ok := code[alt-1].(*ICommit)
+	if !ok || alt-1+commit.offset < alt {
+		return 0, 0, false
+	}
+	return alt, alt - 1 + commit.offset, true
+}
+
+// All choices of Or() in the code. Nested choices from Or() with more
+// than two alternatives are combined.
+func orChoices(code Pattern) []orChoice {
+	var ret []orChoice
+	nested := make(map[int]bool)
+	for pc := range code {
+		alt, end, ok := isOr(code, pc)
+		if !ok || nested[pc] {
+			continue
+		}
+		choice := orChoice{pc, []int{pc + 1}}
+		for {
+			next, nextEnd, ok := isOr(code, alt)
+			if !ok || nextEnd != end {
+				break
+			}
+			nested[alt] = true
+			choice.alts = append(choice.alts, alt+1)
+			alt = next
+		}
+		choice.alts = append(choice.alts, alt)
+		ret = append(ret, choice)
+	}
+	return ret
+}
+
+// Name of the rule containing `pc`.
+func (c *Coverage) ruleName(pc int) string {
+	if r := ruleAt(c.rules, pc); r != nil {
+		return r.Name
+	}
+	return profileMain
+}
+
+// Write a summary per rule, and list the alternatives that were never
+// tried.
+func (c *Coverage) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "rule\tcovered\t\n")
+	for _, r := range c.rules {
+		run, total := c.covered(r.Start, r.End)
+		fmt.Fprintf(tw, "%s\t%.1f%%\t(%d/%d)\n", r.Name, percent(int64(run), int64(total)), run, total)
+	}
+	run, total := c.covered(0, len(c.counts))
+	fmt.Fprintf(tw, "total\t%.1f%%\t(%d/%d)\n", percent(int64(run), int64(total)), run, total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	missed := c.missed()
+	if len(missed) > 0 {
+		fmt.Fprintf(w, "\nNever exercised:\n")
+		for _, m := range missed {
+			fmt.Fprintf(w, "  %s\n", m)
+		}
+	}
+	return nil
+}
+
+// Descriptions of the rules, alternatives and keywords that were never
+// tried.
+func (c *Coverage) missed() []string {
+	var ret []string
+	for _, r := range c.rules {
+		if c.counts[r.Start] == 0 {
+			ret = append(ret, fmt.Sprintf("%s: rule never called", r.Name))
+		}
+	}
+	for _, choice := range orChoices(*c.program) {
+		if c.counts[choice.pc] == 0 {
+			continue
+		}
+		for i, alt := range choice.alts {
+			if alt < len(c.counts) && c.counts[alt] == 0 {
+				ret = append(ret, fmt.Sprintf("%s: alternative %d of %d of the choice at %d",
+					c.ruleName(choice.pc), i+1, len(choice.alts), choice.pc))
+			}
+		}
+	}
+	for pc, op := range *c.program {
+		op, ok := op.(*IKeywords)
+		if !ok || c.counts[pc] == 0 {
+			continue
+		}
+		hits := c.words[pc]
+		for i, w := range op.words {
+			if hits == nil || hits[i] == 0 {
+				ret = append(ret, fmt.Sprintf("%s: keyword %q at %d", c.ruleName(pc), w, pc))
+			}
+		}
+	}
+	return ret
+}
+
+// Write an HTML page with the instructions of each rule, colored by
+// whether they were run.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pego coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { line-height: 1.3; }
+.run { color: #2a7a2a; }
+.miss { color: #c02020; background: #fbeaea; }
+.count { color: #888; }
+</style>
+</head>
+<body>
+`)
+	fmt.Fprintf(&b, "<h1>Coverage: %.1f%%</h1>\n", c.Percent())
+	missed := c.missed()
+	if len(missed) > 0 {
+		b.WriteString("<h2>Never exercised</h2>\n<ul>\n")
+		for _, m := range missed {
+			fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(m))
+		}
+		b.WriteString("</ul>\n")
+	}
+	section := func(name string, start, end int) {
+		run, total := c.covered(start, end)
+		fmt.Fprintf(&b, "<h2 id=\"%s\">%s <small>%.1f%%</small></h2>\n<pre>\n",
+			html.EscapeString(name), html.EscapeString(name), percent(int64(run), int64(total)))
+		for pc := start; pc < end && pc < len(c.counts); pc++ {
+			class := "run"
+			if c.counts[pc] == 0 {
+				class = "miss"
+			}
+			fmt.Fprintf(&b, "<span class=\"%s\">%6d  %-40s</span> <span class=\"count\">%d</span>\n",
+				class, pc, html.EscapeString(fmt.Sprint((*c.program)[pc])), c.counts[pc])
+		}
+		b.WriteString("</pre>\n")
+	}
+	// Code outside of the rules first, then each rule.
+	inRule := make([]bool, len(c.counts))
+	for _, r := range c.rules {
+		for pc := r.Start; pc < r.End && pc < len(inRule); pc++ {
+			inRule[pc] = true
+		}
+	}
+	for pc := 0; pc < len(inRule); {
+		end := pc
+		for end < len(inRule) && !inRule[end] {
+			end++
+		}
+		if end > pc {
+			section(profileMain, pc, end)
+		}
+		for end < len(inRule) && inRule[end] {
+			end++
+		}
+		pc = end
+	}
+	for _, r := range c.rules {
+		section(r.Name, r.Start, r.End)
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
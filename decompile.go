@@ -0,0 +1,81 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Write a pattern in the notation of ParseGrammar. Grammars are written
+// as one rule per line, the start rule first and the others sorted by
+// name.
+//
+// Only patterns made by the constructors can be decompiled, and only
+// the captures that have a notation: simple, list and position
+// captures. Other parts are written as a description in <>, and an
+// error names the first of them.
+func Decompile(p *Pattern) (string, error) {
+	return decompile(decodeExpr(p))
+}
+
+// Same as Decompile(Grm(start, grammar)), but rules that are never used
+// are written too.
+func DecompileGrammar(start string, grammar map[string]*Pattern) (string, error) {
+	if _, ok := grammar[start]; !ok {
+		return "", fmt.Errorf("Undefined rule %q", start)
+	}
+	return decompile(exprGrammarOf(start, grammar))
+}
+
+func decompile(top *expr) (string, error) {
+	var err error
+	bad := func(x *expr) {
+		if err == nil {
+			err = fmt.Errorf("%v can not be written in PEG notation", x)
+		}
+	}
+	top.walk(func(x *expr) {
+		switch x.kind {
+		case exprOp:
+			switch op := x.op.(type) {
+			case *IChar, *ICharset, *IAny, *IKeywords, *IFail:
+			case *IEmptyCapture:
+				if _, ok := op.handler.(*PositionCapture); !ok {
+					bad(x)
+				}
+			default:
+				bad(x)
+			}
+		case exprRep:
+			if x.min > 0 && x.max >= 0 {
+				*x = *x.bounded()
+			}
+		case exprCall:
+			if !validName(x.name) && (x.rule == nil || !validName(x.rule.name)) {
+				bad(x)
+			}
+		case exprCapture:
+			switch x.handler.(type) {
+			case *SimpleCapture, *ListCapture:
+			default:
+				bad(x)
+			}
+		case exprGrammar:
+			if x != top {
+				bad(x)
+			}
+			// Grm() lays out the rules in no particular order.
+			rules := x.rules[1:]
+			sort.Slice(rules, func(i, j int) bool { return rules[i].name < rules[j].name })
+			for _, r := range x.rules {
+				if !validName(r.name) {
+					bad(&expr{kind: exprCall, rule: r})
+				}
+			}
+		case exprCode:
+			bad(x)
+		}
+	})
+	return top.String(), err
+}
@@ -0,0 +1,481 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Regular sub-patterns needing more states than this are left as they are.
+const maxDFAStates = 256
+
+// Match a regular sub-pattern with a deterministic automaton.
+// The automaton has one transition per byte, plus one for the end of
+// input, and does not use the stack.
+type IDFA struct {
+	states [][257]dfaEdge
+}
+
+// Transition of the automaton. `to` is either a state, or one of the
+// dfaFail, dfaAccept and dfaAcceptSaved results. If `save` is set, the
+// current position is saved before following the transition.
+type dfaEdge struct {
+	to   int32
+	save bool
+}
+
+const (
+	dfaFail        = -1 // No match
+	dfaAccept      = -2 // Match ending at the current position
+	dfaAcceptSaved = -3 // Match ending at the saved position
+)
+
+func (op *IDFA) String() string {
+	return fmt.Sprintf("DFA %d states", len(op.states))
+}
+
+// End position of the match starting at `i`, or -1.
+func (op *IDFA) match(input string, i int) int {
+	s, saved := 0, -1
+	for {
+		b := 256
+		if i < len(input) {
+			b = int(input[i])
+		}
+		e := op.states[s][b]
+		switch e.to {
+		case dfaFail:
+			return -1
+		case dfaAccept:
+			return i
+		case dfaAcceptSaved:
+			return saved
+		}
+		if e.save {
+			saved = i
+		}
+		s = int(e.to)
+		i++
+	}
+}
+
+// Replace regular sub-patterns with automata. A sub-pattern is regular
+// when it only matches characters, with choices and repetitions, and
+// has no captures, calls or predicates. The result matches the same
+// inputs as `p`, with the usual ordered choice. It works best on
+// patterns from Optimize().
+func CompileDFA(p *Pattern) *Pattern {
+	code := make(Pattern, len(*p))
+	copy(code, *p)
+	targets := jumpTargets(code)
+	changed := false
+	for s := 0; s < len(code); s++ {
+		e := s
+		for e < len(code) && dfaAllowed(code[e]) {
+			e++
+		}
+		for ; e > s; e-- {
+			if !dfaRegion(code, targets, s, e) {
+				continue
+			}
+			if op, ok := buildDFA(code, s, e); ok {
+				code[s] = op
+				for k := s + 1; k < e; k++ {
+					code[k] = nil
+				}
+				changed = true
+				s = e - 1
+				break
+			}
+		}
+	}
+	if changed {
+		code, _ = removeDead(code)
+	}
+	return &code
+}
+
+// Can the instruction be part of an automaton?
+func dfaAllowed(op Instruction) bool {
+	switch op.(type) {
+	case nil, *IChar, *ICharset, *ISpan, *IAny, *IKeywords,
+		*IJump, *IChoice, *ICommit, *IPartialCommit, *IFail:
+		return true
+	}
+	return false
+}
+
+// Is code[s:e] a self-contained sub-pattern worth an automaton? All
+// jumps inside must stay inside, and nothing outside may jump into it.
+func dfaRegion(code Pattern, targets map[int]int, s, e int) bool {
+	worth := false
+	inner := make(map[int]int)
+	for i := s; i < e; i++ {
+		switch code[i].(type) {
+		case *IChoice, *IKeywords:
+			worth = true
+		}
+		if offset, ok := jumpOffset(code[i]); ok {
+			if i+offset < s || i+offset > e {
+				return false
+			}
+			inner[i+offset]++
+		}
+	}
+	for i := s + 1; i < e; i++ {
+		if targets[i] != inner[i] {
+			return false
+		}
+	}
+	return worth
+}
+
+// The automaton is built by running all alternatives of the sub-pattern
+// side by side, as threads ordered by priority. A choice starts the
+// fallback alternative right away, as a thread that is killed when the
+// choice commits. A thread reaching the end of the sub-pattern becomes a
+// marker, which is the match if all threads before it fail.
+
+// Choice point on the stack of a thread.
+type dfaFrame struct {
+	id, fallback int
+}
+
+type dfaThread struct {
+	pc, sub int
+	word    int        // Keyword being matched, or -1
+	stack   []dfaFrame // Open choices
+	killers []int      // Choices whose commit kills this thread
+	marker  bool       // Reached the end of the sub-pattern
+	saved   bool       // Marker from an earlier position
+}
+
+func (t *dfaThread) fork() *dfaThread {
+	ret := *t
+	ret.stack = append([]dfaFrame(nil), t.stack...)
+	ret.killers = append([]int(nil), t.killers...)
+	return &ret
+}
+
+type dfaBuilder struct {
+	code   Pattern
+	end    int
+	frames int // Next frame id
+}
+
+func buildDFA(code Pattern, start, end int) (*IDFA, bool) {
+	d := &dfaBuilder{code: code, end: end}
+	init := []*dfaThread{{pc: start, word: -1}}
+	keys := map[string]int{d.canonical(init): 0}
+	states := [][]*dfaThread{init}
+	op := &IDFA{}
+	for s := 0; s < len(states); s++ {
+		var edges [257]dfaEdge
+		for b := range edges {
+			out, ok := d.closure(states[s], b)
+			if !ok {
+				return nil, false
+			}
+			switch {
+			case len(out) == 0:
+				edges[b].to = dfaFail
+			case out[0].marker && out[0].saved:
+				edges[b].to = dfaAcceptSaved
+			case out[0].marker:
+				edges[b].to = dfaAccept
+			default:
+				markers := 0
+				for _, t := range out {
+					if !t.marker {
+						d.advance(t)
+						continue
+					}
+					markers++
+					if !t.saved {
+						t.saved = true
+						edges[b].save = true
+					}
+				}
+				if markers > 1 {
+					// Would need more than one saved position.
+					return nil, false
+				}
+				key := d.canonical(out)
+				n, ok := keys[key]
+				if !ok {
+					if len(states) >= maxDFAStates {
+						return nil, false
+					}
+					n = len(states)
+					keys[key] = n
+					states = append(states, out)
+				}
+				edges[b].to = int32(n)
+			}
+		}
+		op.states = append(op.states, edges)
+	}
+	return op, true
+}
+
+func (d *dfaBuilder) frame(fallback int) dfaFrame {
+	d.frames++
+	return dfaFrame{d.frames, fallback}
+}
+
+// Run the threads up to the point where they consume `b`, or the end
+// of input if b == 256. Returns the surviving threads and markers in
+// priority order, or false if the sub-pattern can not be handled.
+func (d *dfaBuilder) closure(items []*dfaThread, b int) ([]*dfaThread, bool) {
+	out := make([]*dfaThread, 0, len(items))
+	committed := make(map[int]bool)
+	killed := func(t *dfaThread) bool {
+		for _, k := range t.killers {
+			if committed[k] {
+				return true
+			}
+		}
+		return false
+	}
+	commit := func(t *dfaThread) (dfaFrame, bool) {
+		if len(t.stack) == 0 {
+			return dfaFrame{}, false
+		}
+		f := t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+		committed[f.id] = true
+		return f, true
+	}
+	// Guards against loops that do not consume anything.
+	budget := 64*len(d.code) + 1024
+	var visit func(t *dfaThread) bool
+	visit = func(t *dfaThread) bool {
+		for {
+			if budget--; budget < 0 {
+				return false
+			}
+			if killed(t) {
+				return true
+			}
+			if t.pc == d.end {
+				if len(t.stack) > 0 {
+					// Choice closed outside the sub-pattern.
+					return false
+				}
+				t.marker = true
+				out = append(out, t)
+				return true
+			}
+			switch op := d.code[t.pc].(type) {
+			case nil:
+				t.pc++
+			case *IJump:
+				t.pc += op.offset
+			case *IChoice:
+				f := d.frame(t.pc + op.offset)
+				alt := t.fork()
+				alt.pc = f.fallback
+				alt.killers = append(alt.killers, f.id)
+				t.stack = append(t.stack, f)
+				t.pc++
+				return visit(t) && visit(alt)
+			case *ICommit:
+				if _, ok := commit(t); !ok {
+					return false
+				}
+				t.pc += op.offset
+			case *IPartialCommit:
+				f, ok := commit(t)
+				if !ok {
+					return false
+				}
+				f = d.frame(f.fallback)
+				alt := t.fork()
+				alt.pc = f.fallback
+				alt.killers = append(alt.killers, f.id)
+				t.stack = append(t.stack, f)
+				t.pc += op.offset
+				return visit(t) && visit(alt)
+			case *IFail:
+				return true
+			case *IChar:
+				if b == int(op.char) {
+					out = append(out, t)
+				}
+				return true
+			case *ICharset:
+				if b < 256 && op.Has(byte(b)) {
+					out = append(out, t)
+				}
+				return true
+			case *ISpan:
+				if b < 256 && op.Has(byte(b)) && (op.max < 0 || t.sub < op.max) {
+					out = append(out, t)
+					return true
+				}
+				t.pc++
+				t.sub = 0
+			case *IAny:
+				if t.sub == op.count {
+					t.pc++
+					t.sub = 0
+					continue
+				}
+				if b < 256 {
+					out = append(out, t)
+				}
+				return true
+			case *IKeywords:
+				if t.word < 0 {
+					// An ordered choice between the keywords.
+					killers := t.killers
+					for w := range op.words {
+						alt := t.fork()
+						alt.word = w
+						alt.killers = append([]int(nil), killers...)
+						if w < len(op.words)-1 {
+							f := d.frame(-1)
+							alt.stack = append(alt.stack, f)
+							killers = append(alt.killers[:len(alt.killers):len(alt.killers)], f.id)
+						}
+						if !visit(alt) {
+							return false
+						}
+					}
+					return true
+				}
+				word := op.words[t.word]
+				if t.sub == len(word) {
+					if t.word < len(op.words)-1 {
+						commit(t)
+					}
+					t.pc++
+					t.word, t.sub = -1, 0
+					continue
+				}
+				if b == int(word[t.sub]) {
+					out = append(out, t)
+				}
+				return true
+			default:
+				return false
+			}
+		}
+	}
+	for _, t := range items {
+		if t.marker {
+			out = append(out, t.fork())
+		} else if !visit(t.fork()) {
+			return nil, false
+		}
+	}
+	return d.prune(out, killed), true
+}
+
+// Remove killed and redundant threads.
+func (d *dfaBuilder) prune(items []*dfaThread, killed func(*dfaThread) bool) []*dfaThread {
+	// Choices that are no longer on any stack can not commit.
+	live := make(map[int]bool)
+	for _, t := range items {
+		for _, f := range t.stack {
+			live[f.id] = true
+		}
+	}
+	ret := make([]*dfaThread, 0, len(items))
+	seen := make(map[string]bool)
+	var markers []*dfaThread
+	for _, t := range items {
+		if killed(t) {
+			continue
+		}
+		killers := t.killers[:0]
+		for _, k := range t.killers {
+			if live[k] {
+				killers = append(killers, k)
+			}
+		}
+		t.killers = killers
+		// A thread that dies whenever an earlier marker dies can
+		// never be the match.
+		shadowed := false
+		for _, m := range markers {
+			if subset(m.killers, t.killers) {
+				shadowed = true
+				break
+			}
+		}
+		key := fmt.Sprint(t.marker, t.pc, t.sub, t.word, t.stack, t.killers)
+		if shadowed || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if t.marker {
+			markers = append(markers, t)
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// Is every element of a also in b?
+func subset(a, b []int) bool {
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Move a thread past the character it was waiting for.
+func (d *dfaBuilder) advance(t *dfaThread) {
+	switch op := d.code[t.pc].(type) {
+	case *IChar, *ICharset:
+		t.pc++
+	case *ISpan:
+		if op.max >= 0 {
+			t.sub++
+		}
+	case *IAny:
+		t.sub++
+	case *IKeywords:
+		t.sub++
+	}
+}
+
+// Number the frames by first use, and return a key identifying the
+// state.
+func (d *dfaBuilder) canonical(items []*dfaThread) string {
+	ids := make(map[int]int)
+	rename := func(id int) int {
+		if n, ok := ids[id]; ok {
+			return n
+		}
+		ids[id] = len(ids)
+		return ids[id]
+	}
+	ret := make([]string, len(items))
+	for i, t := range items {
+		for j := range t.stack {
+			t.stack[j].id = rename(t.stack[j].id)
+		}
+		for j := range t.killers {
+			t.killers[j] = rename(t.killers[j])
+		}
+		sort.Ints(t.killers)
+		ret[i] = fmt.Sprint(t.marker, t.saved, t.pc, t.sub, t.word, t.stack, t.killers)
+	}
+	if len(ids) > d.frames {
+		d.frames = len(ids)
+	}
+	return strings.Join(ret, ";")
+}
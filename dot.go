@@ -0,0 +1,128 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The control flow graph of a pattern in the DOT language of Graphviz.
+// Nodes are basic blocks of instructions, and edges are:
+//   - fallthrough to the next block, in black
+//   - jumps and commits, in black and labeled with the instruction
+//   - calls of rules, in blue, and the returns from them, dashed
+//   - failure targets pushed by IChoice, dashed in red
+//
+// The blocks of each rule of a grammar are grouped in a cluster named
+// after the rule.
+func Dot(p *Pattern) string {
+	code := *p
+	// Blocks start at jump targets, rules, and after any instruction
+	// that does not always continue on the next one.
+	leaders := map[int]bool{0: true}
+	for t := range jumpTargets(code) {
+		leaders[t] = true
+	}
+	rules := Rules(p)
+	for _, r := range rules {
+		leaders[r.Start] = true
+	}
+	for pc, op := range code {
+		if _, ok := jumpOffset(op); ok || !fallsThrough(op) {
+			leaders[pc+1] = true
+		}
+	}
+	var starts []int
+	for pc := range leaders {
+		if pc < len(code) {
+			starts = append(starts, pc)
+		}
+	}
+	sort.Ints(starts)
+
+	var b strings.Builder
+	b.WriteString("digraph pego {\n")
+	b.WriteString("\tnode [shape=box fontname=monospace];\n")
+	// Blocks outside of rules come first, then each rule in a cluster.
+	inRule := make(map[*Rule][]int)
+	for _, start := range starts {
+		r := ruleAt(rules, start)
+		inRule[r] = append(inRule[r], start)
+	}
+	end := func(i int) int {
+		if i+1 < len(starts) {
+			return starts[i+1]
+		}
+		return len(code)
+	}
+	index := make(map[int]int)
+	for i, start := range starts {
+		index[start] = i
+	}
+	block := func(indent string, start int) {
+		var label strings.Builder
+		for pc := start; pc < end(index[start]); pc++ {
+			fmt.Fprintf(&label, "%s\\l", dotEscape(fmt.Sprintf("%d  %v", pc, code[pc])))
+		}
+		fmt.Fprintf(&b, "%sb%d [label=\"%s\"];\n", indent, start, label.String())
+	}
+	for _, start := range inRule[nil] {
+		block("\t", start)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if len(inRule[r]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(&b, "\t\tlabel=\"%s\";\n", dotEscape(r.Name))
+		for _, start := range inRule[r] {
+			block("\t\t", start)
+		}
+		b.WriteString("\t}\n")
+	}
+
+	edge := func(from, to int, attrs string) {
+		if to < 0 || to >= len(code) {
+			return
+		}
+		fmt.Fprintf(&b, "\tb%d -> b%d", from, to)
+		if attrs != "" {
+			fmt.Fprintf(&b, " [%s]", attrs)
+		}
+		b.WriteString(";\n")
+	}
+	for i, start := range starts {
+		next := end(i)
+		last := next - 1
+		offset, _ := jumpOffset(code[last])
+		switch op := code[last].(type) {
+		case *IJump:
+			edge(start, last+offset, "")
+		case *IChoice:
+			edge(start, next, "")
+			edge(start, last+offset, "style=dashed color=red label=fail")
+		case *ICall:
+			edge(start, last+offset, fmt.Sprintf("color=blue label=\"call %s\"", dotEscape(op.name)))
+			edge(start, next, "style=dashed label=return")
+		case *ICommit, *IPartialCommit, *IBackCommit:
+			edge(start, last+offset, fmt.Sprintf("label=\"%s\"", strings.Fields(op.String())[0]))
+		case *ILoop:
+			edge(start, last+offset, "label=loop")
+			edge(start, next, "")
+		default:
+			if fallsThrough(op) {
+				edge(start, next, "")
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Escape a string for a quoted DOT string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
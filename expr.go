@@ -0,0 +1,679 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The structure of a compiled pattern, recovered from its instructions.
+// Used by the analyses, which need to know where each Or(), Rep() and
+// predicate starts and ends.
+type expr struct {
+	kind     exprKind
+	pc, end  int         // Instructions of the node
+	op       Instruction // exprOp
+	args     []*expr
+	min, max int            // exprRep
+	name     string         // exprCall
+	rule     *exprRule      // exprCall, or nil if unknown
+	handler  CaptureHandler // exprCapture
+	rules    []*exprRule    // exprGrammar, starting with the start rule
+}
+
+type exprKind int
+
+const (
+	exprOp      exprKind = iota // A single matching instruction
+	exprSeq                     // Sequence of args
+	exprOr                      // Ordered choice of args
+	exprRep                     // args[0] between min and max times
+	exprNot                     // Negative look-ahead of args[0]
+	exprAnd                     // Positive look-ahead of args[0]
+	exprCall                    // Call of a rule
+	exprCapture                 // Capture of args[0]
+	exprGrammar                 // Grammar of rules
+	exprCode                    // Instructions that are not understood
+)
+
+// A rule of a grammar.
+type exprRule struct {
+	name    string
+	pc, end int
+	body    *expr
+}
+
+func (r *exprRule) String() string {
+	if r.name != "" {
+		return r.name
+	}
+	// Only rules that are never called have no name in compiled code,
+	// so describe them by how they start.
+	body := r.body.String()
+	if len(body) > maxRuleDesc {
+		body = body[:maxRuleDesc] + "..."
+	}
+	return fmt.Sprintf("<rule %s>", body)
+}
+
+// Length of the start of the body in the description of a rule
+// without a name.
+const maxRuleDesc = 20
+
+type exprDecoder struct {
+	code  Pattern
+	names map[int]string    // Rule names, by first instruction
+	rules map[int]*exprRule // Rules decoded so far
+	calls []*expr
+}
+
+// Recover the structure of a pattern. Parts that were not made by the
+// pattern constructors, such as the output of Optimize(), are kept as
+// exprCode.
+func decodeExpr(p *Pattern) *expr {
+	d := &exprDecoder{code: *p, names: make(map[int]string), rules: make(map[int]*exprRule)}
+	for _, r := range Rules(p) {
+		d.names[r.Start] = r.Name
+	}
+	x := d.seq(0, len(d.code)-1)
+	if x == nil {
+		x = &expr{kind: exprCode, pc: 0, end: len(d.code) - 1}
+	}
+	for _, call := range d.calls {
+		if call.rule == nil {
+			call.rule = d.rules[call.pc+jumpTarget(d.code[call.pc])]
+		}
+	}
+	return x
+}
+
+func jumpTarget(op Instruction) int {
+	offset, _ := jumpOffset(op)
+	return offset
+}
+
+// Decode code[s:e] as a sequence, or return nil.
+func (d *exprDecoder) seq(s, e int) *expr {
+	args, stop := d.items(s, e)
+	if stop != e {
+		return nil
+	}
+	if len(args) == 1 {
+		return args[0]
+	}
+	return &expr{kind: exprSeq, pc: s, end: e, args: args}
+}
+
+// Decode items from code[s:e], until one is not understood. Returns the
+// items, and where decoding stopped.
+func (d *exprDecoder) items(s, e int) ([]*expr, int) {
+	var args []*expr
+	i := s
+	for i < e {
+		x := d.item(i, e)
+		if x == nil {
+			break
+		}
+		// A repetition is compiled as the required copies, followed
+		// by the optional ones.
+		if x.kind == exprRep {
+			for len(args) > 0 {
+				prev := args[len(args)-1]
+				n := 0
+				if d.same(prev, x.args[0]) {
+					n = 1
+				} else if prev.kind == exprRep && prev.min == prev.max && d.same(prev.args[0], x.args[0]) {
+					n = prev.min
+				} else {
+					break
+				}
+				x.min += n
+				if x.max >= 0 {
+					x.max += n
+				}
+				x.pc = prev.pc
+				args = args[:len(args)-1]
+			}
+		}
+		args = append(args, x)
+		i = x.end
+	}
+	return args, i
+}
+
+// Do the two nodes have the same instructions?
+func (d *exprDecoder) same(a, b *expr) bool {
+	if a.kind == exprOp && b.kind == exprOp {
+		return fmt.Sprint(a.op) == fmt.Sprint(b.op)
+	}
+	if a.kind == exprOp || b.kind == exprOp || a.end-a.pc != b.end-b.pc {
+		return false
+	}
+	for i := 0; i < a.end-a.pc; i++ {
+		if fmt.Sprint(d.code[a.pc+i]) != fmt.Sprint(d.code[b.pc+i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode the item starting at code[i], ending before e, or return nil.
+func (d *exprDecoder) item(i, e int) *expr {
+	code := d.code
+	switch op := code[i].(type) {
+	case *IChar, *ICharset, *IAny, *IKeywords, *IDFA, *IFail, *IGiveUp,
+		*IEmptyCapture, *IFullCapture:
+		return &expr{kind: exprOp, pc: i, end: i + 1, op: op}
+	case *ISpan:
+		cs := op.ICharset
+		body := &expr{kind: exprOp, pc: i, end: i + 1, op: &cs}
+		return &expr{kind: exprRep, pc: i, end: i + 1, args: []*expr{body}, max: op.max}
+	case *IChoice:
+		l := i + op.offset
+		if l <= i+1 || l > e {
+			return nil
+		}
+		switch last := code[l-1].(type) {
+		case *IFailTwice:
+			if p := d.seq(i+1, l-1); p != nil {
+				return &expr{kind: exprNot, pc: i, end: l, args: []*expr{p}}
+			}
+		case *IBackCommit:
+			if _, ok := code[l].(*IFail); ok && l < e && last.offset == 2 {
+				if p := d.seq(i+1, l-1); p != nil {
+					return &expr{kind: exprAnd, pc: i, end: l + 1, args: []*expr{p}}
+				}
+			}
+		case *ICommit:
+			t := l - 1 + last.offset
+			switch {
+			case t == i:
+				if p := d.seq(i+1, l-1); p != nil {
+					return &expr{kind: exprRep, pc: i, end: l, args: []*expr{p}, max: -1}
+				}
+			case t == l:
+				if x := d.optional(i, l); x != nil {
+					return x
+				}
+				fallthrough
+			case l < t && t <= e:
+				p1, p2 := d.seq(i+1, l-1), d.seq(l, t)
+				if p1 == nil || p2 == nil {
+					return nil
+				}
+				args := []*expr{p1}
+				if p2.kind == exprOr {
+					args = append(args, p2.args...)
+				} else {
+					args = append(args, p2)
+				}
+				return &expr{kind: exprOr, pc: i, end: t, args: args}
+			}
+		}
+	case *IPushCounter:
+		return d.counted(i, e)
+	case *IOpenCapture:
+		args, stop := d.items(i+1, e)
+		if stop < e {
+			if _, ok := code[stop].(*ICloseCapture); ok {
+				p := &expr{kind: exprSeq, pc: i + 1, end: stop, args: args}
+				if len(args) == 1 {
+					p = args[0]
+				}
+				return &expr{kind: exprCapture, pc: i, end: stop + 1, args: []*expr{p}, handler: op.handler}
+			}
+		}
+	case *ICall:
+		if x := d.grammar(i, e); x != nil {
+			return x
+		}
+		x := &expr{kind: exprCall, pc: i, end: i + 1, name: op.name}
+		if x.name == "" {
+			x.name = d.names[i+op.offset]
+		}
+		d.calls = append(d.calls, x)
+		return x
+	case *IOpenCall:
+		return &expr{kind: exprCall, pc: i, end: i + 1, name: op.name}
+	}
+	return nil
+}
+
+// Decode the optional part of a bounded repetition, starting with the
+// choice at code[i] and ending before l. Each copy of the pattern is
+// followed by a partial commit to the next one.
+func (d *exprDecoder) optional(i, l int) *expr {
+	var body *expr
+	count := 0
+	for s := i + 1; s < l-1; {
+		args, stop := d.items(s, l-1)
+		op, ok := d.code[stop].(*IPartialCommit)
+		if stop >= l-1 || !ok || op.offset != 1 {
+			return nil
+		}
+		p := &expr{kind: exprSeq, pc: s, end: stop, args: args}
+		if len(args) == 1 {
+			p = args[0]
+		}
+		if body == nil {
+			body = p
+		} else if !d.same(body, p) {
+			return nil
+		}
+		count++
+		s = stop + 1
+	}
+	if body == nil {
+		return nil
+	}
+	return &expr{kind: exprRep, pc: i, end: l, args: []*expr{body}, max: count}
+}
+
+// Decode a counted loop starting at code[i].
+func (d *exprDecoder) counted(i, e int) *expr {
+	code := d.code
+	if i+1 >= e {
+		return nil
+	}
+	if choice, ok := code[i+1].(*IChoice); ok {
+		// Up to `count` times.
+		l := i + 1 + choice.offset
+		if l >= e || l-2 <= i+2 {
+			return nil
+		}
+		_, pop := code[l].(*IPopCounter)
+		loop, ok := code[l-1].(*ILoop)
+		if !pop || !ok || l-1+loop.offset != i+1 {
+			return nil
+		}
+		if p := d.seq(i+2, l-2); p != nil {
+			return &expr{kind: exprRep, pc: i, end: l + 1, args: []*expr{p}, max: loop.count}
+		}
+		return nil
+	}
+	// Exactly `count` times.
+	args, stop := d.items(i+1, e)
+	if stop+1 >= e {
+		return nil
+	}
+	loop, ok := code[stop].(*ILoop)
+	if _, pop := code[stop+1].(*IPopCounter); !ok || !pop || stop+loop.offset != i+1 {
+		return nil
+	}
+	p := &expr{kind: exprSeq, pc: i + 1, end: stop, args: args}
+	if len(args) == 1 {
+		p = args[0]
+	}
+	return &expr{kind: exprRep, pc: i, end: stop + 2, args: []*expr{p}, min: loop.count, max: loop.count}
+}
+
+// Decode a grammar starting at code[i]: a call of the start rule, and a
+// jump past the rules.
+func (d *exprDecoder) grammar(i, e int) *expr {
+	code := d.code
+	if i+1 >= e {
+		return nil
+	}
+	jump, ok := code[i+1].(*IJump)
+	if !ok {
+		return nil
+	}
+	start := i + jumpTarget(code[i])
+	end := i + 1 + jump.offset
+	if end > e || start < i+2 || start >= end {
+		return nil
+	}
+	x := &expr{kind: exprGrammar, pc: i, end: end}
+	for pc := i + 2; pc < end; {
+		r := &exprRule{name: d.names[pc], pc: pc, end: ruleEnd(code, pc)}
+		if r.end > end {
+			return nil
+		}
+		if r.body = d.seq(pc, r.end-1); r.body == nil {
+			r.body = &expr{kind: exprCode, pc: pc, end: r.end - 1}
+		}
+		d.rules[pc] = r
+		if pc == start {
+			x.rules = append([]*exprRule{r}, x.rules...)
+		} else {
+			x.rules = append(x.rules, r)
+		}
+		pc = r.end
+	}
+	if len(x.rules) == 0 || x.rules[0].pc != start {
+		return nil
+	}
+	return x
+}
+
+// Combine separately compiled rules into a grammar. Open calls are
+// resolved by name, and are left without a rule if it does not exist.
+func exprGrammarOf(start string, grammar map[string]*Pattern) *expr {
+	names := make([]string, 0, len(grammar))
+	for name := range grammar {
+		if name != start {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{start}, names...)
+	x := &expr{kind: exprGrammar}
+	byName := make(map[string]*exprRule)
+	for _, name := range names {
+		p, ok := grammar[name]
+		if !ok {
+			continue
+		}
+		r := &exprRule{name: name, end: len(*p) - 1, body: decodeExpr(p)}
+		byName[name] = r
+		x.rules = append(x.rules, r)
+	}
+	for _, r := range x.rules {
+		r.body.walk(func(x *expr) {
+			if x.kind == exprCall && x.rule == nil {
+				x.rule = byName[x.name]
+			}
+		})
+	}
+	return x
+}
+
+// Call f for the node and all nodes below it, not following calls.
+func (x *expr) walk(f func(*expr)) {
+	f(x)
+	for _, arg := range x.args {
+		arg.walk(f)
+	}
+	for _, r := range x.rules {
+		r.body.walk(f)
+	}
+}
+
+// All rules of the grammars in x.
+func (x *expr) allRules() []*exprRule {
+	var ret []*exprRule
+	x.walk(func(x *expr) {
+		ret = append(ret, x.rules...)
+	})
+	return ret
+}
+
+// Precedence of the node in PEG notation.
+func (x *expr) prec() int {
+	switch x.kind {
+	case exprOr:
+		return 0
+	case exprSeq:
+		if len(x.args) == 0 {
+			return 3
+		}
+		if x.literal() {
+			return 3
+		}
+		return 1
+	case exprNot, exprAnd:
+		return 2
+	case exprOp:
+		if op, ok := x.op.(*IKeywords); ok && len(op.words) > 1 {
+			return 0
+		}
+		if op, ok := x.op.(*IAny); ok && op.count != 1 {
+			return 1
+		}
+		if _, ok := x.op.(*IFail); ok {
+			return 2
+		}
+	}
+	return 3
+}
+
+// Is the node a sequence of characters?
+func (x *expr) literal() bool {
+	if x.kind != exprSeq || len(x.args) == 0 {
+		return false
+	}
+	for _, arg := range x.args {
+		if arg.kind != exprOp {
+			return false
+		}
+		if _, ok := arg.op.(*IChar); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Write x in PEG notation, in parentheses if its precedence is below
+// `prec`.
+func (x *expr) format(b *strings.Builder, prec int) {
+	if x.kind == exprRep && x.min > 0 && x.max >= 0 {
+		x = x.bounded()
+	}
+	if x.prec() < prec {
+		b.WriteString("(")
+		x.format(b, 0)
+		b.WriteString(")")
+		return
+	}
+	switch x.kind {
+	case exprOp:
+		formatOp(b, x.op)
+	case exprSeq:
+		if len(x.args) == 0 {
+			b.WriteString("''")
+			return
+		}
+		if x.literal() {
+			word := make([]byte, len(x.args))
+			for i, arg := range x.args {
+				word[i] = arg.op.(*IChar).char
+			}
+			b.WriteString(quotePEG(string(word)))
+			return
+		}
+		for i := 0; i < len(x.args); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			// Runs of characters are written as one literal.
+			j := i
+			for j < len(x.args) && x.args[j].kind == exprOp {
+				if _, ok := x.args[j].op.(*IChar); !ok {
+					break
+				}
+				j++
+			}
+			if j-i > 1 {
+				(&expr{kind: exprSeq, args: x.args[i:j]}).format(b, 2)
+				i = j - 1
+				continue
+			}
+			// Sequences in sequences need no parentheses.
+			x.args[i].format(b, 1)
+		}
+	case exprOr:
+		for i, arg := range x.args {
+			if i > 0 {
+				b.WriteString(" / ")
+			}
+			arg.format(b, 1)
+		}
+	case exprRep:
+		x.args[0].format(b, 3)
+		switch {
+		case x.min == 0 && x.max < 0:
+			b.WriteString("*")
+		case x.min == 1 && x.max < 0:
+			b.WriteString("+")
+		case x.min == 0 && x.max == 1:
+			b.WriteString("?")
+		case x.max < 0:
+			fmt.Fprintf(b, "^%d", x.min)
+		default:
+			fmt.Fprintf(b, "^-%d", x.max)
+		}
+	case exprNot:
+		b.WriteString("!")
+		x.args[0].format(b, 2)
+	case exprAnd:
+		b.WriteString("&")
+		x.args[0].format(b, 2)
+	case exprCall:
+		if x.name != "" {
+			b.WriteString(x.name)
+		} else if x.rule != nil {
+			b.WriteString(x.rule.String())
+		} else {
+			b.WriteString("<call>")
+		}
+	case exprCapture:
+		switch x.handler.(type) {
+		case *SimpleCapture:
+			b.WriteString("{ ")
+			x.args[0].format(b, 0)
+			b.WriteString(" }")
+		case *ListCapture:
+			b.WriteString("{| ")
+			x.args[0].format(b, 0)
+			b.WriteString(" |}")
+		default:
+			fmt.Fprintf(b, "%v{ ", x.handler)
+			x.args[0].format(b, 0)
+			b.WriteString(" }")
+		}
+	case exprGrammar:
+		for i, r := range x.rules {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(b, "%s <- ", r)
+			r.body.format(b, 0)
+		}
+	case exprCode:
+		fmt.Fprintf(b, "<code %d-%d>", x.pc, x.end)
+	}
+}
+
+// The notation has no bounded repetitions, so p^2..4 is written as
+// p p p^-2. Returns that sequence for a repetition with a minimum and a
+// maximum.
+func (x *expr) bounded() *expr {
+	args := make([]*expr, x.min, x.min+1)
+	for i := range args {
+		args[i] = x.args[0]
+	}
+	if x.max > x.min {
+		args = append(args, &expr{kind: exprRep, args: x.args, max: x.max - x.min})
+	}
+	return &expr{kind: exprSeq, pc: x.pc, end: x.end, args: args}
+}
+
+func (x *expr) String() string {
+	var b strings.Builder
+	x.format(&b, 0)
+	return b.String()
+}
+
+func formatOp(b *strings.Builder, op Instruction) {
+	switch op := op.(type) {
+	case *IChar:
+		b.WriteString(quotePEG(string([]byte{op.char})))
+	case *ICharset:
+		b.WriteString(classPEG(op))
+	case *IAny:
+		if op.count == 0 {
+			b.WriteString("''")
+		}
+		for i := 0; i < op.count; i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(".")
+		}
+	case *IKeywords:
+		for i, w := range op.words {
+			if i > 0 {
+				b.WriteString(" / ")
+			}
+			b.WriteString(quotePEG(w))
+		}
+	case *IFail:
+		b.WriteString("!''")
+	case *IEmptyCapture:
+		if _, ok := op.handler.(*PositionCapture); ok {
+			b.WriteString("{}")
+		} else {
+			fmt.Fprintf(b, "%v{}", op.handler)
+		}
+	default:
+		fmt.Fprintf(b, "<%v>", op)
+	}
+}
+
+// Escape a character for a literal or a class.
+func escapePEG(c byte, special string) string {
+	switch {
+	case c == '\n':
+		return `\n`
+	case c == '\r':
+		return `\r`
+	case c == '\t':
+		return `\t`
+	case c == '\\' || strings.IndexByte(special, c) >= 0:
+		return `\` + string([]byte{c})
+	case c < 32 || c >= 127:
+		return fmt.Sprintf(`\x%02x`, c)
+	}
+	return string([]byte{c})
+}
+
+func quotePEG(s string) string {
+	var b strings.Builder
+	b.WriteString("'")
+	for i := 0; i < len(s); i++ {
+		b.WriteString(escapePEG(s[i], "'"))
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// A character set as a class, or '.' for all characters.
+func classPEG(op *ICharset) string {
+	count := 0
+	for c := 0; c < 256; c++ {
+		if op.Has(byte(c)) {
+			count++
+		}
+	}
+	if count == 256 {
+		return "."
+	}
+	var b strings.Builder
+	b.WriteString("[")
+	set := *op
+	if count > 128 {
+		b.WriteString("^")
+		set.negate()
+	}
+	for c := 0; c < 256; c++ {
+		if !set.Has(byte(c)) {
+			continue
+		}
+		hi := c
+		for hi+1 < 256 && set.Has(byte(hi+1)) {
+			hi++
+		}
+		b.WriteString(escapePEG(byte(c), "]^-"))
+		if hi > c+1 {
+			b.WriteString("-")
+		}
+		if hi > c {
+			b.WriteString(escapePEG(byte(hi), "]^-"))
+		}
+		c = hi
+	}
+	b.WriteString("]")
+	return b.String()
+}
@@ -0,0 +1,286 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Options for Generate. Zero fields get the defaults.
+type GenerateOptions struct {
+	// Rules nested deeper than this take the shortest way out.
+	// Default 8.
+	MaxDepth int
+	// Most repetitions of Rep() beyond the minimum. Default 4.
+	MaxRepeat int
+	// Weights of the alternatives of the choices in each rule, by rule
+	// name. Missing weights count as 1, and a weight of 0 turns an
+	// alternative off. Patterns that are not grammars use "(main)".
+	Weights map[string][]float64
+	// Number of inputs to try before giving up. Default 100.
+	Attempts int
+}
+
+// Inputs longer than this are abandoned.
+const maxGenerateLength = 1 << 20
+
+// Generate a random input that the pattern matches in full. The rules
+// are walked from the start, picking alternatives and repetition counts
+// at random. Each input is checked with Match(), and a new one is tried
+// if it does not match, as predicates and ordered choice can reject
+// what was generated.
+func Generate(p *Pattern, rng *rand.Rand, opts *GenerateOptions) (string, error) {
+	g := &generator{rng: rng}
+	if opts != nil {
+		g.opts = *opts
+	}
+	if g.opts.MaxDepth <= 0 {
+		g.opts.MaxDepth = 8
+	}
+	if g.opts.MaxRepeat <= 0 {
+		g.opts.MaxRepeat = 4
+	}
+	if g.opts.Attempts <= 0 {
+		g.opts.Attempts = 100
+	}
+	top := decodeExpr(p)
+	var unknown Instruction
+	top.walk(func(x *expr) {
+		if x.kind == exprCode && unknown == nil {
+			unknown = (*p)[x.pc]
+		}
+	})
+	if unknown != nil {
+		return "", fmt.Errorf("Can not generate input for %v", unknown)
+	}
+	g.shortest = newShortestInputs(top.allRules())
+	if _, ok := g.shortest.of(top); !ok {
+		return "", errors.New("No input can be generated for the pattern")
+	}
+	for i := 0; i < g.opts.Attempts; i++ {
+		g.buf = g.buf[:0]
+		if !g.gen(top, profileMain, 0) {
+			continue
+		}
+		input := string(g.buf)
+		if _, err, pos := Match(p, input); err == nil && pos == len(input) {
+			return input, nil
+		}
+	}
+	return "", fmt.Errorf("No matching input found in %d attempts", g.opts.Attempts)
+}
+
+type generator struct {
+	opts     GenerateOptions
+	rng      *rand.Rand
+	shortest shortestInputs
+	buf      []byte
+}
+
+// Append an input for x, in the rule named `rule`. Returns false if
+// the attempt has to be abandoned.
+func (g *generator) gen(x *expr, rule string, depth int) bool {
+	if len(g.buf) > maxGenerateLength || depth > 4*g.opts.MaxDepth {
+		return false
+	}
+	switch x.kind {
+	case exprOp:
+		return g.op(x.op)
+	case exprSeq:
+		for _, arg := range x.args {
+			if !g.gen(arg, rule, depth) {
+				return false
+			}
+		}
+		return true
+	case exprOr:
+		alt := g.pick(x.args, rule, depth)
+		return alt != nil && g.gen(alt, rule, depth)
+	case exprRep:
+		n := x.min
+		if depth <= g.opts.MaxDepth {
+			extra := g.opts.MaxRepeat
+			if x.max >= 0 && x.max-x.min < extra {
+				extra = x.max - x.min
+			}
+			n += g.rng.Intn(extra + 1)
+		}
+		for i := 0; i < n; i++ {
+			if !g.gen(x.args[0], rule, depth) {
+				return false
+			}
+		}
+		return true
+	case exprNot, exprAnd:
+		// Checked by Match() in the end.
+		return true
+	case exprCapture:
+		return g.gen(x.args[0], rule, depth)
+	case exprCall:
+		return x.rule != nil && g.gen(x.rule.body, x.rule.String(), depth+1)
+	case exprGrammar:
+		return g.gen(x.rules[0].body, x.rules[0].String(), depth+1)
+	}
+	return false
+}
+
+func (g *generator) op(op Instruction) bool {
+	if set, ok := byteset(op); ok {
+		var chars []byte
+		for c := 0; c < 256; c++ {
+			if set.Has(byte(c)) {
+				chars = append(chars, byte(c))
+			}
+		}
+		if len(chars) == 0 {
+			return false
+		}
+		g.buf = append(g.buf, chars[g.rng.Intn(len(chars))])
+		return true
+	}
+	switch op := op.(type) {
+	case *IAny:
+		for i := 0; i < op.count; i++ {
+			g.buf = append(g.buf, byte(' '+g.rng.Intn(95)))
+		}
+		return true
+	case *IKeywords:
+		g.buf = append(g.buf, op.words[g.rng.Intn(len(op.words))]...)
+		return true
+	case *IDFA:
+		return g.dfa(op)
+	case *IEmptyCapture, *IFullCapture:
+		return true
+	}
+	return false
+}
+
+// Walk the automaton at random until the match can end. Past
+// MaxRepeat steps, only transitions that get closer to an end are
+// taken.
+func (g *generator) dfa(op *IDFA) bool {
+	dist := dfaDistances(op)
+	s := 0
+	for steps := 0; dist[s] >= 0; steps++ {
+		long := steps >= g.opts.MaxRepeat
+		if dist[s] == 0 && (long || g.rng.Intn(g.opts.MaxRepeat+1) == 0) {
+			return true
+		}
+		var chars []byte
+		for c := 0; c < 256; c++ {
+			to := op.states[s][c].to
+			if to >= 0 && dist[to] >= 0 && (!long || dist[to] < dist[s]) {
+				chars = append(chars, byte(c))
+			}
+		}
+		if len(chars) == 0 {
+			return dist[s] == 0
+		}
+		c := chars[g.rng.Intn(len(chars))]
+		g.buf = append(g.buf, c)
+		s = int(op.states[s][c].to)
+	}
+	return false
+}
+
+// Can a match of the automaton end in state s? It can if some next
+// character, or the end of the input, accepts the input so far.
+func dfaCanEnd(op *IDFA, s int) bool {
+	for _, e := range op.states[s] {
+		if e.to == dfaAccept || e.save {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of characters from each state of the automaton to a state
+// where the match can end, or -1 if there is none.
+func dfaDistances(op *IDFA) []int {
+	dist := make([]int, len(op.states))
+	for s := range dist {
+		dist[s] = -1
+		if dfaCanEnd(op, s) {
+			dist[s] = 0
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for s := range op.states {
+			for _, e := range op.states[s][:256] {
+				if e.to >= 0 && dist[e.to] >= 0 && (dist[s] < 0 || dist[e.to]+1 < dist[s]) {
+					dist[s] = dist[e.to] + 1
+					changed = true
+				}
+			}
+		}
+	}
+	return dist
+}
+
+// The shortest input matched by the automaton, preferring readable
+// characters.
+func dfaShortest(op *IDFA) (string, bool) {
+	dist := dfaDistances(op)
+	var b []byte
+	for s := 0; dist[s] != 0; {
+		if dist[s] < 0 {
+			return "", false
+		}
+		var next ICharset
+		for c := 0; c < 256; c++ {
+			if to := op.states[s][c].to; to >= 0 && dist[to] == dist[s]-1 {
+				next.add(byte(c), byte(c))
+			}
+		}
+		c := pickByte(&next)
+		b = append(b, c)
+		s = int(op.states[s][c].to)
+	}
+	return string(b), true
+}
+
+// Pick one of the alternatives. Past the depth limit, the one with the
+// shortest input is taken, so that the input ends.
+func (g *generator) pick(alts []*expr, rule string, depth int) *expr {
+	if depth > g.opts.MaxDepth {
+		var best *expr
+		length := 0
+		for _, alt := range alts {
+			if s, ok := g.shortest.of(alt); ok && (best == nil || len(s) < length) {
+				best, length = alt, len(s)
+			}
+		}
+		return best
+	}
+	weights := g.opts.Weights[rule]
+	total := 0.0
+	w := make([]float64, len(alts))
+	for i, alt := range alts {
+		if _, ok := g.shortest.of(alt); !ok {
+			continue
+		}
+		w[i] = 1
+		if i < len(weights) {
+			w[i] = weights[i]
+		}
+		total += w[i]
+	}
+	if total <= 0 {
+		return nil
+	}
+	r := g.rng.Float64() * total
+	for i, alt := range alts {
+		if r -= w[i]; r < 0 && w[i] > 0 {
+			return alt
+		}
+	}
+	for i := len(alts) - 1; i >= 0; i-- {
+		if w[i] > 0 {
+			return alts[i]
+		}
+	}
+	return nil
+}
@@ -50,11 +50,16 @@ func (op *IOpenCall) String() string {
 }
 
 // Push return address to stack, and do a relative jump.
+// The name of the called rule is kept for debugging.
 type ICall struct {
 	offset int
+	name   string
 }
 
 func (op *ICall) String() string {
+	if op.name != "" {
+		return fmt.Sprintf("Call %+d (%s)", op.offset, op.name)
+	}
 	return fmt.Sprintf("Call %+d", op.offset)
 }
 
@@ -105,6 +110,121 @@ type IEnd struct{}
 
 func (op *IEnd) String() string { return "End" }
 
+// Match the first keyword in `words` that the input starts with.
+// The keywords are compiled into a trie, so the cost does not grow with
+// the number of keywords.
+type IKeywords struct {
+	words []string
+	nodes []kwNode
+}
+
+// A node of the keyword trie. Children are indexed by the byte value,
+// starting at `lo`. Index 0 (the root) is never a child, so it marks
+// missing edges.
+type kwNode struct {
+	word int // Keyword ending at this node, or -1
+	min  int // Lowest keyword index in this subtree
+	lo   byte
+	next []int
+}
+
+func newKeywords(words []string) *IKeywords {
+	op := &IKeywords{words: words, nodes: []kwNode{{word: -1, min: len(words)}}}
+	for w, word := range words {
+		n := 0
+		for k := 0; ; k++ {
+			if w < op.nodes[n].min {
+				op.nodes[n].min = w
+			}
+			if k == len(word) {
+				break
+			}
+			n = op.child(n, word[k])
+		}
+		if op.nodes[n].word == -1 {
+			op.nodes[n].word = w
+		}
+	}
+	return op
+}
+
+// Return the child of node `n` for `char`, adding it if needed.
+func (op *IKeywords) child(n int, char byte) int {
+	node := &op.nodes[n]
+	switch {
+	case len(node.next) == 0:
+		node.lo = char
+		node.next = make([]int, 1)
+	case char < node.lo:
+		next := make([]int, int(node.lo-char)+len(node.next))
+		copy(next[node.lo-char:], node.next)
+		node.lo, node.next = char, next
+	case int(char-node.lo) >= len(node.next):
+		next := make([]int, int(char-node.lo)+1)
+		copy(next, node.next)
+		node.next = next
+	}
+	if c := node.next[char-node.lo]; c != 0 {
+		return c
+	}
+	op.nodes = append(op.nodes, kwNode{word: -1, min: len(op.words)})
+	c := len(op.nodes) - 1
+	op.nodes[n].next[char-op.nodes[n].lo] = c
+	return c
+}
+
+// Length of the first keyword that `input` starts with, or -1.
+func (op *IKeywords) match(input string) int {
+	best, length := len(op.words), -1
+	n := 0
+	for k := 0; ; k++ {
+		node := &op.nodes[n]
+		if node.min >= best {
+			break
+		}
+		if node.word >= 0 && node.word < best {
+			best, length = node.word, k
+		}
+		if k == len(input) || input[k] < node.lo || int(input[k]-node.lo) >= len(node.next) {
+			break
+		}
+		if n = node.next[input[k]-node.lo]; n == 0 {
+			break
+		}
+	}
+	return length
+}
+
+func (op *IKeywords) String() string {
+	ret := make([]string, len(op.words)+1)
+	ret[0] = "Keywords"
+	for i, w := range op.words {
+		ret[i+1] = fmt.Sprintf("%q", w)
+	}
+	return strings.Join(ret, " ")
+}
+
+// Push a new loop counter to the stack.
+type IPushCounter struct{}
+
+func (op *IPushCounter) String() string { return "PushCounter" }
+
+// Increment the loop counter on top of the stack, and do a relative
+// jump while it is below `count`.
+type ILoop struct {
+	offset int
+	count  int
+}
+
+func (op *ILoop) String() string {
+	return fmt.Sprintf("Loop %+d x %d", op.offset, op.count)
+}
+
+// Pop a loop counter from the stack.
+type IPopCounter struct{}
+
+func (op *IPopCounter) String() string { return "PopCounter" }
+
 // Stop matching and return a negative result.
 type IGiveUp struct{}
 
@@ -231,14 +351,50 @@ func (op *ICharset) negate() {
 	}
 }
 
-// Match zero or more characters from a set
+// Add all characters of another set
+func (op *ICharset) union(other *ICharset) {
+	for i := range op.chars {
+		op.chars[i] |= other.chars[i]
+	}
+}
+
+// Is every character of the set also in `other`?
+func (op *ICharset) subsetOf(other *ICharset) bool {
+	for i := range op.chars {
+		if op.chars[i]&^other.chars[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Do the sets have a character in common?
+func (op *ICharset) intersects(other *ICharset) bool {
+	for i := range op.chars {
+		if op.chars[i]&other.chars[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (op *ICharset) empty() bool {
+	return *op == ICharset{}
+}
+
+// Match zero or more characters from a set, but at most `max`.
+// max == -1 means unlimited.
 type ISpan struct {
 	ICharset
+	max int
 }
 
 func (op *ISpan) String() string {
 	s := (&op.ICharset).String()
 	i := strings.Index(s, " ")
+	if op.max >= 0 {
+		return fmt.Sprintf("ISpan%s x %d", s[i:], op.max)
+	}
 	return "ISpan" + s[i:]
 }
 
@@ -250,3 +406,55 @@ type IAny struct {
 func (op *IAny) String() string {
 	return fmt.Sprintf("Any x %d", op.count)
 }
+
+// Relative jump offset of a control flow instruction.
+func jumpOffset(op Instruction) (int, bool) {
+	switch op := op.(type) {
+	case *IJump:
+		return op.offset, true
+	case *IChoice:
+		return op.offset, true
+	case *ICall:
+		return op.offset, true
+	case *ICommit:
+		return op.offset, true
+	case *IPartialCommit:
+		return op.offset, true
+	case *IBackCommit:
+		return op.offset, true
+	case *ILoop:
+		return op.offset, true
+	}
+	return 0, false
+}
+
+// Copy of a control flow instruction with a new jump offset.
+func withOffset(op Instruction, offset int) Instruction {
+	switch op := op.(type) {
+	case *IJump:
+		return &IJump{offset}
+	case *IChoice:
+		return &IChoice{offset}
+	case *ICall:
+		return &ICall{offset, op.name}
+	case *ICommit:
+		return &ICommit{offset}
+	case *IPartialCommit:
+		return &IPartialCommit{offset}
+	case *IBackCommit:
+		return &IBackCommit{offset}
+	case *ILoop:
+		return &ILoop{offset, op.count}
+	}
+	return op
+}
+
+// Can execution continue on the next instruction?
+func fallsThrough(op Instruction) bool {
+	switch op.(type) {
+	case *IJump, *ICommit, *IPartialCommit, *IBackCommit,
+		*IReturn, *IFail, *IFailTwice, *IEnd, *IGiveUp:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,432 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Problem found by Lint.
+type LintWarning struct {
+	Rule string // Rule containing the problem, if known
+	Msg  string
+}
+
+func (w *LintWarning) String() string {
+	if w.Rule == "" {
+		return w.Msg
+	}
+	return w.Rule + ": " + w.Msg
+}
+
+// Look for likely mistakes in a pattern:
+//   - alternatives of Or() that can never match, as an earlier
+//     alternative matches whenever they do
+//   - literals that are shadowed by an earlier literal that is a prefix
+//     of them, like Or("=", "==")
+//   - repetitions of patterns that can match the empty string
+//   - rules of a grammar that are never used
+//   - Not() and And() conditions that are always true or always false,
+//     and Exc() conditions that never apply or exclude everything
+//
+// Only patterns made by the constructors are understood. Rules of
+// compiled grammars are named as in Rules(), and the ones that are
+// never called, which have no name, are described by how they start.
+func Lint(p *Pattern) []*LintWarning {
+	return lintExpr(decodeExpr(p))
+}
+
+// Same as Lint(Grm(start, grammar)), but rules that are never used are
+// reported by name, and undefined rules are reported too.
+func LintGrammar(start string, grammar map[string]*Pattern) []*LintWarning {
+	return lintExpr(exprGrammarOf(start, grammar))
+}
+
+// What is known about the matches of a node.
+type exprInfo struct {
+	empty bool     // Can succeed without consuming input
+	fail  bool     // Can fail
+	first ICharset // First characters of the matches that consume input
+}
+
+// Can the node succeed at all?
+func (i *exprInfo) succeeds() bool {
+	return i.empty || !i.first.empty()
+}
+
+var unknownInfo = func() exprInfo {
+	i := exprInfo{empty: true, fail: true}
+	i.first.negate()
+	return i
+}()
+
+type linter struct {
+	rules    map[*exprRule]exprInfo
+	warnings []*LintWarning
+	rule     string // Rule being checked
+}
+
+func lintExpr(x *expr) []*LintWarning {
+	l := newLinter(x)
+	l.check(x)
+	return l.warnings
+}
+
+// Create a linter for x, with the info of all rules.
+func newLinter(x *expr) *linter {
+	l := &linter{rules: make(map[*exprRule]exprInfo)}
+	rules := x.allRules()
+	// The rules can call each other, so their info is found by
+	// iterating until nothing changes. Everything starts out as false
+	// and can only grow.
+	for changed := true; changed; {
+		changed = false
+		for _, r := range rules {
+			if i := l.info(r.body); i != l.rules[r] {
+				l.rules[r] = i
+				changed = true
+			}
+		}
+	}
+	return l
+}
+
+func (l *linter) warn(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, &LintWarning{l.rule, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) info(x *expr) exprInfo {
+	switch x.kind {
+	case exprOp:
+		return opInfo(x.op)
+	case exprSeq:
+		ret := exprInfo{empty: true}
+		for _, arg := range x.args {
+			i := l.info(arg)
+			if ret.empty {
+				ret.first.union(&i.first)
+			}
+			ret.empty = ret.empty && i.empty
+			ret.fail = ret.fail || i.fail
+		}
+		return ret
+	case exprOr:
+		ret := exprInfo{fail: true}
+		for _, arg := range x.args {
+			i := l.info(arg)
+			ret.first.union(&i.first)
+			ret.empty = ret.empty || i.empty
+			ret.fail = ret.fail && i.fail
+		}
+		return ret
+	case exprRep:
+		i := l.info(x.args[0])
+		return exprInfo{empty: x.min == 0 || i.empty, fail: x.min > 0 && i.fail, first: i.first}
+	case exprNot:
+		i := l.info(x.args[0])
+		return exprInfo{empty: i.fail, fail: i.succeeds()}
+	case exprAnd:
+		i := l.info(x.args[0])
+		return exprInfo{empty: i.succeeds(), fail: i.fail}
+	case exprCapture:
+		return l.info(x.args[0])
+	case exprCall:
+		if x.rule != nil {
+			return l.rules[x.rule]
+		}
+	case exprGrammar:
+		return l.rules[x.rules[0]]
+	}
+	return unknownInfo
+}
+
+func opInfo(op Instruction) exprInfo {
+	if set, ok := byteset(op); ok {
+		return exprInfo{fail: true, first: *set}
+	}
+	switch op := op.(type) {
+	case *IKeywords:
+		ret := exprInfo{fail: true}
+		for _, w := range op.words {
+			if w == "" {
+				ret.empty, ret.fail = true, false
+			} else {
+				ret.first.add(w[0], w[0])
+			}
+		}
+		return ret
+	case *IAny:
+		if op.count == 0 {
+			return exprInfo{empty: true}
+		}
+		ret := exprInfo{fail: true}
+		ret.first.negate()
+		return ret
+	case *IFail, *IGiveUp:
+		return exprInfo{fail: true}
+	case *IEmptyCapture, *IFullCapture:
+		return exprInfo{empty: true}
+	}
+	return unknownInfo
+}
+
+func (l *linter) check(x *expr) {
+	switch x.kind {
+	case exprOp:
+		if op, ok := x.op.(*IKeywords); ok {
+			l.checkKeywords(op.words)
+		}
+	case exprOr:
+		l.checkOr(x)
+	case exprRep:
+		if l.info(x.args[0]).empty {
+			if x.max < 0 {
+				l.warn("%s loops forever, as %s can match the empty string", x, x.args[0])
+			} else {
+				l.warn("%s can match the empty string inside a repetition", x.args[0])
+			}
+		}
+	case exprNot, exprAnd:
+		i := l.info(x.args[0])
+		switch {
+		case !i.succeeds():
+			l.warn("%s is always %t, as %s never matches", x, x.kind == exprNot, x.args[0])
+		case !i.fail:
+			l.warn("%s is always %t, as %s always matches", x, x.kind == exprAnd, x.args[0])
+		}
+	case exprSeq:
+		l.checkExc(x)
+	case exprGrammar:
+		l.checkGrammar(x)
+		return
+	case exprCall:
+		// Open calls are only errors inside a grammar.
+		if x.rule == nil && x.name != "" && l.rule != "" {
+			l.warn("rule %s is not defined", x.name)
+		}
+	}
+	for _, arg := range x.args {
+		l.check(arg)
+	}
+}
+
+// Literals that start with an earlier literal can never match.
+func (l *linter) checkKeywords(words []string) {
+	for j, w := range words {
+		for _, prev := range words[:j] {
+			if strings.HasPrefix(w, prev) {
+				l.warn("literal %s can never match, as %s comes first", quotePEG(w), quotePEG(prev))
+				break
+			}
+		}
+	}
+}
+
+func (l *linter) checkOr(x *expr) {
+	for j := 1; j < len(x.args); j++ {
+		for _, prev := range x.args[:j] {
+			if !l.info(prev).fail {
+				l.warn("%s can never match, as %s always matches", x.args[j], prev)
+				break
+			}
+			if l.shadows(prev, x.args[j], 0) {
+				l.warn("%s can never match, as %s matches first", x.args[j], prev)
+				break
+			}
+		}
+	}
+}
+
+// Look for Exc(): a Not() followed by the pattern it excludes from.
+func (l *linter) checkExc(x *expr) {
+	for k := 0; k+1 < len(x.args); k++ {
+		if x.args[k].kind != exprNot {
+			continue
+		}
+		pred := x.args[k].args[0]
+		p := x.args[k+1]
+		if k+2 < len(x.args) {
+			p = &expr{kind: exprSeq, args: x.args[k+1:]}
+		}
+		i, j := l.info(pred), l.info(p)
+		if !i.succeeds() || !i.fail || !j.succeeds() {
+			// Already reported.
+			continue
+		}
+		if !i.empty && !j.empty && !i.first.intersects(&j.first) {
+			l.warn("%s has no effect on %s, as they never start alike", x.args[k], p)
+		} else if l.shadows(pred, p, 0) {
+			l.warn("%s never matches, as %s excludes all of it", p, x.args[k])
+		}
+	}
+}
+
+func (l *linter) checkGrammar(x *expr) {
+	used := map[*exprRule]bool{x.rules[0]: true}
+	queue := []*exprRule{x.rules[0]}
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		r.body.walk(func(x *expr) {
+			if x.kind == exprCall && x.rule != nil && !used[x.rule] {
+				used[x.rule] = true
+				queue = append(queue, x.rule)
+			}
+		})
+	}
+	outer := l.rule
+	for _, r := range x.rules {
+		l.rule = r.String()
+		if !used[r] {
+			l.warn("rule %s is never used", r)
+		}
+		l.check(r.body)
+	}
+	l.rule = outer
+}
+
+// Limit for following calls in shadows() and prefix().
+const maxLintDepth = 8
+
+// Does `a` match whenever `b` does? False if it can not be proven.
+func (l *linter) shadows(a, b *expr, depth int) bool {
+	if depth > maxLintDepth {
+		return false
+	}
+	a, b = l.unwrap(a), l.unwrap(b)
+	if !l.info(a).fail {
+		return true
+	}
+	if alts, ok := alternatives(b); ok {
+		for _, alt := range alts {
+			if !l.shadows(a, alt, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	if alts, ok := alternatives(a); ok {
+		for _, alt := range alts {
+			if l.shadows(alt, b, depth+1) {
+				return true
+			}
+		}
+		return false
+	}
+	pa, _, sure := l.prefix(a, depth)
+	if !sure || len(pa) == 0 {
+		return false
+	}
+	pb, _, _ := l.prefix(b, depth)
+	if len(pb) < len(pa) {
+		return false
+	}
+	for i := range pa {
+		if !pb[i].subsetOf(&pa[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Skip captures and calls, which match the same as what they contain.
+func (l *linter) unwrap(x *expr) *expr {
+	for depth := 0; depth < maxLintDepth; depth++ {
+		switch {
+		case x.kind == exprCapture:
+			x = x.args[0]
+		case x.kind == exprCall && x.rule != nil:
+			x = x.rule.body
+		default:
+			return x
+		}
+	}
+	return x
+}
+
+// The alternatives of an Or() or keyword set.
+func alternatives(x *expr) ([]*expr, bool) {
+	switch x.kind {
+	case exprOr:
+		return x.args, true
+	case exprOp:
+		if op, ok := x.op.(*IKeywords); ok && len(op.words) > 1 {
+			ret := make([]*expr, len(op.words))
+			for i, w := range op.words {
+				ret[i] = literalExpr(w)
+			}
+			return ret, true
+		}
+	}
+	return nil, false
+}
+
+func literalExpr(word string) *expr {
+	x := &expr{kind: exprSeq}
+	for i := 0; i < len(word); i++ {
+		x.args = append(x.args, &expr{kind: exprOp, op: &IChar{word[i]}})
+	}
+	return x
+}
+
+// Sets of characters that every match of the node starts with. If
+// `exact` is set, the node matches exactly those characters. If `sure`
+// is set, the node matches whenever the input starts with them.
+func (l *linter) prefix(x *expr, depth int) (ret []ICharset, exact, sure bool) {
+	if depth > maxLintDepth {
+		return nil, false, false
+	}
+	switch x.kind {
+	case exprOp:
+		if set, ok := byteset(x.op); ok {
+			return []ICharset{*set}, true, true
+		}
+		switch op := x.op.(type) {
+		case *IAny:
+			ret = make([]ICharset, op.count)
+			for i := range ret {
+				ret[i].negate()
+			}
+			return ret, true, true
+		case *IKeywords:
+			if len(op.words) == 1 {
+				return l.prefix(literalExpr(op.words[0]), depth)
+			}
+		case *IEmptyCapture:
+			return nil, true, true
+		}
+	case exprSeq:
+		for k, arg := range x.args {
+			p, exact, sure := l.prefix(arg, depth)
+			ret = append(ret, p...)
+			if !exact {
+				// The rest starts at an unknown position.
+				for _, rest := range x.args[k+1:] {
+					sure = sure && !l.info(rest).fail
+				}
+				return ret, false, sure
+			}
+		}
+		return ret, true, true
+	case exprRep:
+		if x.min == 0 {
+			return nil, false, true
+		}
+		p, exact, sure := l.prefix(x.args[0], depth)
+		if !exact {
+			return p, false, sure && x.min == 1
+		}
+		for i := 0; i < x.min; i++ {
+			ret = append(ret, p...)
+		}
+		return ret, x.max == x.min, true
+	case exprCapture:
+		return l.prefix(x.args[0], depth)
+	case exprCall:
+		if x.rule != nil {
+			return l.prefix(x.rule.body, depth+1)
+		}
+	}
+	return nil, false, false
+}
@@ -8,12 +8,19 @@ import (
 	"strings"
 )
 
+// Error of a match that failed.
+var errNoMatch = errors.New("Stack is empty")
+
 // Call/fallback stack
 
 type StackEntry struct {
 	p, i, c int
 }
 
+type CounterEntry struct {
+	n int
+}
+
 type Stack struct {
 	slice []interface{}
 }
@@ -45,6 +52,8 @@ func (s *Stack) String() string {
 		case *StackEntry:
 			//ret.Push(fmt.Sprintf("%v", *v))
 			ret = append(ret, fmt.Sprintf("%v", *v))
+		case *CounterEntry:
+			ret = append(ret, fmt.Sprintf("#%d", v.n))
 		default:
 			//ret.Push(fmt.Sprintf("%v", v))
 			ret = append(ret, fmt.Sprintf("%v", v))
@@ -66,6 +75,14 @@ type CaptureEntry struct {
 	p, start, end int
 	handler       CaptureHandler
 	value         interface{}
+	node          *CaptureNode // With MatchOptions.Spans
+}
+
+func (e *CaptureEntry) String() string {
+	if e.end == -1 {
+		return fmt.Sprintf("{%d-? %v}", e.start, e.handler)
+	}
+	return fmt.Sprintf("{%d-%d %v %#v}", e.start, e.end, e.handler, e.value)
 }
 
 func NewCapStack() *CapStack {
@@ -122,14 +139,29 @@ func (s *CapStack) Close(end int) (*CaptureEntry, int) {
 type CaptureResult struct {
 	start, end int
 	value      interface{}
+	name       string // Name of a group capture
 }
 
+// Span of the input matched by the capture.
+func (r *CaptureResult) Start() int { return r.start }
+func (r *CaptureResult) End() int   { return r.end }
+
+// Value of the capture.
+func (r *CaptureResult) Value() interface{} { return r.value }
+
+// Name of a group capture, or "".
+func (r *CaptureResult) Name() string { return r.name }
+
 // Pop and return the top `count` captures
 func (s *CapStack) Pop(count int) []*CaptureResult {
 	subcaps := make([]*CaptureResult, count)
 	i := s.top - count
 	for j := 0; j < count; j++ {
-		subcaps[j] = &CaptureResult{s.data[i+j].start, s.data[i+j].end, s.data[i+j].value}
+		e := s.data[i+j]
+		subcaps[j] = &CaptureResult{start: e.start, end: e.end, value: e.value}
+		if h, ok := e.handler.(*GroupCapture); ok {
+			subcaps[j].name = h.name
+		}
 	}
 	s.top -= count
 	return subcaps
@@ -145,27 +177,78 @@ func (s *CapStack) Rollback(mark int) {
 	s.top = mark
 }
 
+// Options for MatchWithOptions.
+type MatchOptions struct {
+	// Receives an event for each step of the match, if set.
+	Tracer Tracer
+	// Set if Verify accepted the pattern. The VM then skips the checks
+	// of the stack and captures that Verify has done. Matching an
+	// invalid pattern with it set may panic.
+	Verified bool
+	// Return the first capture as a *CaptureNode, with the spans of
+	// the captures, instead of its value.
+	Spans bool
+}
+
+// A capture, with the span of the input it matched and the captures
+// its handler used.
+type CaptureNode struct {
+	Start, End int
+	Name       string // Name of a group capture
+	Value      interface{}
+	Subs       []*CaptureNode
+}
+
+// Record the node of a capture whose handler has run. `top` is the top
+// of the capture stack before the handler popped its sub-captures.
+func (s *CapStack) setNode(e *CaptureEntry, top int) {
+	e.node = &CaptureNode{Start: e.start, End: e.end, Value: e.value}
+	if h, ok := e.handler.(*GroupCapture); ok {
+		e.node.Name = h.name
+	}
+	for _, sub := range s.data[s.top:top] {
+		e.node.Subs = append(e.node.Subs, sub.node)
+	}
+}
+
 // Main match function
 func Match(program *Pattern, input string) (interface{}, error, int) {
+	return MatchWithOptions(program, input, nil)
+}
+
+// Match function with options. opts == nil is the same as Match().
+func MatchWithOptions(program *Pattern, input string, opts *MatchOptions) (interface{}, error, int) {
 	const FAIL = -1
 	var p, i, c int
+	var tracer Tracer
+	var verified, spans bool
+	if opts != nil {
+		tracer, verified, spans = opts.Tracer, opts.Verified, opts.Spans
+	}
 	stack := &Stack{make([]interface{}, 0)}
 	captures := NewCapStack()
 	for p = 0; p < len(*program); {
 		if p == FAIL {
 			// Unroll stack until a fallback point is reached
 			if stack.Len() == 0 {
-				return nil, errors.New("Stack is empty"), i
+				return nil, errNoMatch, i
 			}
 			switch e := stack.Pop().(type) {
 			case *StackEntry:
+				if tracer != nil {
+					tracer.Trace(&TraceEvent{Kind: TraceBacktrack, PC: e.p, Pos: e.i, Failed: i,
+						Stack: stack, Captures: captures})
+				}
 				p, i, c = e.p, e.i, e.c
 				captures.Rollback(c)
 			case int:
 			}
 			continue
 		}
-		// fmt.Printf("%6d  %s\n", p, (*program)[p])
+		if tracer != nil {
+			tracer.Trace(&TraceEvent{Kind: TraceStep, PC: p, Pos: i, Op: (*program)[p],
+				Stack: stack, Captures: captures})
+		}
 		switch op := (*program)[p].(type) {
 		default:
 			return nil, errors.New(fmt.Sprintf("Unimplemented: %#v", (*program)[p])), i
@@ -187,64 +270,128 @@ func Match(program *Pattern, input string) (interface{}, error, int) {
 				p = FAIL
 			}
 		case *ISpan:
-			for i < len(input) && op.Has(input[i]) {
+			for n := 0; i < len(input) && op.Has(input[i]) && n != op.max; n++ {
 				i++
 			}
 			p++
 		case *IAny:
-			if i+op.count > len(input) {
+			if op.count > len(input)-i {
 				p = FAIL
 			} else {
 				p++
 				i += op.count
 			}
+		case *IKeywords:
+			if n := op.match(input[i:]); n >= 0 {
+				p++
+				i += n
+			} else {
+				p = FAIL
+			}
+		case *IDFA:
+			if n := op.match(input, i); n >= 0 {
+				p++
+				i = n
+			} else {
+				p = FAIL
+			}
 		case *IJump:
 			p += op.offset
 		case *IChoice:
 			stack.Push(&StackEntry{p + op.offset, i, captures.Mark()})
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceChoice, PC: p, Pos: i, Target: p + op.offset,
+					Stack: stack, Captures: captures})
+			}
 			p++
 		case *IOpenCall:
 			return nil, errors.New(fmt.Sprintf("Unresolved name: %q", op.name)), i
 		case *ICall:
 			stack.Push(p + 1)
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCall, PC: p, Pos: i, Target: p + op.offset, Rule: op.name,
+					Stack: stack, Captures: captures})
+			}
 			p += op.offset
 		case *IReturn:
-			if stack.Len() == 0 {
-				return nil, errors.New("Return with empty stack"), i
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("Return with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(int); !ok {
+					return nil, errors.New("Expecting return address on stack; Found failure address"), i
+				}
 			}
-			e, ok := stack.Pop().(int)
-			if !ok {
-				return nil, errors.New("Expecting return address on stack; Found failure address"), i
+			e := stack.Pop().(int)
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceReturn, PC: p, Pos: i, Target: e, Rule: callName(program, e-1),
+					Stack: stack, Captures: captures})
 			}
 			p = e
 		case *ICommit:
-			if stack.Len() == 0 {
-				return nil, errors.New("Commit with empty stack"), i
-			}
-			_, ok := stack.Pop().(*StackEntry)
-			if !ok {
-				return nil, errors.New("Expecting failure address on stack; Found return address"), i
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("Commit with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*StackEntry); !ok {
+					return nil, errors.New("Expecting failure address on stack; Found return address"), i
+				}
 			}
+			stack.Pop()
 			p += op.offset
-		case *IPartialCommit:
-			if stack.Len() == 0 {
-				return nil, errors.New("PartialCommit with empty stack"), i
+		case *IPushCounter:
+			stack.Push(&CounterEntry{})
+			p++
+		case *ILoop:
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("Loop with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*CounterEntry); !ok {
+					return nil, errors.New("Expecting loop counter on stack"), i
+				}
 			}
-			e, ok := stack.At(stack.Len() - 1).(*StackEntry)
-			if !ok {
-				return nil, errors.New("Expecting failure address on stack; Found return address"), i
+			e := stack.At(stack.Len() - 1).(*CounterEntry)
+			e.n++
+			if e.n < op.count {
+				p += op.offset
+			} else {
+				p++
 			}
+		case *IPopCounter:
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("PopCounter with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*CounterEntry); !ok {
+					return nil, errors.New("Expecting loop counter on stack"), i
+				}
+			}
+			stack.Pop()
+			p++
+		case *IPartialCommit:
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("PartialCommit with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*StackEntry); !ok {
+					return nil, errors.New("Expecting failure address on stack; Found return address"), i
+				}
+			}
+			e := stack.At(stack.Len() - 1).(*StackEntry)
 			e.i = i
 			e.c = captures.Mark()
 			p += op.offset
 		case *IBackCommit:
-			if stack.Len() == 0 {
-				return nil, errors.New("BackCommit with empty stack"), i
-			}
-			e, ok := stack.Pop().(*StackEntry)
-			if !ok {
-				return nil, errors.New("Expecting failure address on stack; Found return address"), i
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("BackCommit with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*StackEntry); !ok {
+					return nil, errors.New("Expecting failure address on stack; Found return address"), i
+				}
 			}
+			e := stack.Pop().(*StackEntry)
 			i = e.i
 			captures.Rollback(e.c)
 			p += op.offset
@@ -255,28 +402,57 @@ func Match(program *Pattern, input string) (interface{}, error, int) {
 			} else {
 				e.handler = op.handler
 			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureOpen, PC: p, Pos: e.start, Handler: e.handler,
+					Stack: stack, Captures: captures})
+			}
 			p++
 		case *ICloseCapture:
 			e, count := captures.Close(i - op.capOffset)
+			if !verified && e == nil {
+				return nil, errors.New("Close capture without an open capture"), i
+			}
+			top := captures.top
 			v, err := e.handler.Process(input, e.start, e.end, captures, count)
 			if err != nil {
 				return nil, err, i
 			}
 			e.value = v
+			if spans {
+				captures.setNode(e, top)
+			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureClose, PC: p, Pos: e.end, Handler: e.handler, Value: v,
+					Stack: stack, Captures: captures})
+			}
 			p++
 		case *IFullCapture:
+			if i < op.capOffset {
+				return nil, errors.New("Capture starts before the input"), i
+			}
 			e := captures.Open(p, i-op.capOffset)
 			if op.handler == nil {
 				e.handler = &SimpleCapture{}
 			} else {
 				e.handler = op.handler
 			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureOpen, PC: p, Pos: e.start, Handler: e.handler,
+					Stack: stack, Captures: captures})
+			}
 			captures.Close(i)
 			v, err := e.handler.Process(input, e.start, e.end, captures, 0)
 			if err != nil {
 				return nil, err, i
 			}
 			e.value = v
+			if spans {
+				captures.setNode(e, captures.top)
+			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureClose, PC: p, Pos: e.end, Handler: e.handler, Value: v,
+					Stack: stack, Captures: captures})
+			}
 			p++
 		case *IEmptyCapture:
 			e := captures.Open(p, i-op.capOffset)
@@ -285,29 +461,45 @@ func Match(program *Pattern, input string) (interface{}, error, int) {
 			} else {
 				e.handler = op.handler
 			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureOpen, PC: p, Pos: e.start, Handler: e.handler,
+					Stack: stack, Captures: captures})
+			}
 			captures.Close(i - op.capOffset)
 			v, err := e.handler.Process(input, e.start, e.end, captures, 0)
 			if err != nil {
 				return nil, err, i
 			}
 			e.value = v
+			if spans {
+				captures.setNode(e, captures.top)
+			}
+			if tracer != nil {
+				tracer.Trace(&TraceEvent{Kind: TraceCaptureClose, PC: p, Pos: e.end, Handler: e.handler, Value: v,
+					Stack: stack, Captures: captures})
+			}
 			p++
 		case *IFail:
 			p = FAIL
 		case *IFailTwice:
-			if stack.Len() == 0 {
-				return nil, errors.New("IFailTwice with empty stack"), i
-			}
-			e, ok := stack.Pop().(*StackEntry)
-			if !ok {
-				return nil, errors.New("Expecting failure address on stack; Found return address"), i
+			if !verified {
+				if stack.Len() == 0 {
+					return nil, errors.New("IFailTwice with empty stack"), i
+				}
+				if _, ok := stack.At(stack.Len() - 1).(*StackEntry); !ok {
+					return nil, errors.New("Expecting failure address on stack; Found return address"), i
+				}
 			}
+			e := stack.Pop().(*StackEntry)
 			i = e.i
 			captures.Rollback(e.c)
 			p = FAIL
 		case *IGiveUp:
 			return nil, nil, i
 		case *IEnd:
+			if spans && captures.top > 0 && captures.data[0].node != nil {
+				return captures.data[0].node, nil, i
+			}
 			caps := captures.Pop(captures.top)
 			var ret interface{}
 			if len(caps) > 0 && caps[0] != nil {
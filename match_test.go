@@ -1,8 +1,20 @@
 package pego
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSimpleMatch(t *testing.T) {
@@ -27,7 +39,7 @@ func TestSimpleMatch(t *testing.T) {
 	for _, s := range tests {
 		fmt.Printf("\n\n=== MATCHING %q ===\n", s)
 		fmt.Println("Trace:")
-		r, err, pos := Match(pat, s)
+		r, err, pos := MatchWithOptions(pat, s, &MatchOptions{Tracer: NewPrettyTracer(os.Stdout, s)})
 
 		if r != nil {
 			fmt.Printf("Return value: %v\n", r)
@@ -42,3 +54,2111 @@ func TestSimpleMatch(t *testing.T) {
 		}
 	}
 }
+
+// Expected end position of a match. pos == -1 means the match fails.
+type matchTest struct {
+	pat   *Pattern
+	input string
+	pos   int
+}
+
+func runMatchTests(t *testing.T, tests []matchTest) {
+	for _, test := range tests {
+		_, err, pos := Match(test.pat, test.input)
+		if test.pos < 0 {
+			if err == nil {
+				t.Errorf("%q: expected failure, matched up to %d\n%v", test.input, pos, test.pat)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v\n%v", test.input, err, test.pat)
+		} else if pos != test.pos {
+			t.Errorf("%q: expected end position %d, got %d\n%v", test.input, test.pos, pos, test.pat)
+		}
+	}
+}
+
+func TestBoundedRep(t *testing.T) {
+	digits := Rep(Range("09"), 1, 64)
+	if len(*digits) > 4 {
+		t.Errorf("Charset repetition not folded:\n%v", digits)
+	}
+	word := Rep(Lit("ab"), 2, 100)
+	if len(*word) > 16 {
+		t.Errorf("Bounded repetition not compiled to a loop:\n%v", word)
+	}
+
+	tests := []matchTest{
+		{digits, "", -1},
+		{digits, "123x", 3},
+		{digits, strings.Repeat("9", 70), 64},
+		{word, "ab", -1},
+		{word, "ababx", 4},
+		{word, strings.Repeat("ab", 120), 200},
+		{Rep(Lit("ab"), 1, 3), "abababab", 6},
+		{Rep(Lit("ab"), 1, 3), "ab", 2},
+		{Rep(Lit("ab"), 1, 3), "ababx", 4},
+		{Seq(Rep(Lit("ab"), 5, 5), "a"), "ababababab", -1},
+		{Seq(Rep(Lit("ab"), 5, 5), "a"), "ababababababa", 11},
+	}
+	runMatchTests(t, tests)
+}
+
+func TestKeywords(t *testing.T) {
+	lua := Keywords("and", "break", "do", "else", "elseif", "end",
+		"false", "for", "function", "if", "in", "local", "nil", "not", "or")
+	tests := []matchTest{
+		{lua, "elseif", 4},
+		{lua, "function()", 8},
+		{lua, "fun", -1},
+		{lua, "", -1},
+		{Keywords("a", "ab"), "ab", 1},
+		{Keywords("ab", "a"), "ab", 2},
+		{Keywords("ab", "a"), "ac", 1},
+		{Keywords("x", "", "y"), "y", 0},
+		{Pat("=").Or("==", "!="), "==", 1},
+		{Pat("==").Or("=", "!="), "==", 2},
+		{Pat("==").Or("=", "!="), "!=", 2},
+	}
+	runMatchTests(t, tests)
+	if pat := Pat("and").Or("or", "not"); len(*pat) != 2 {
+		t.Errorf("Choice of literals not compiled to keywords:\n%v", pat)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	pats := []*Pattern{
+		Grm("S", map[string]*Pattern{
+			"S": Ref("A").Clist(),
+			"A": Seq(
+				NegSet("()").Rep(0, -1),
+				Seq(
+					Ref("B"),
+					NegSet("()").Rep(0, -1),
+				).Rep(0, -1)).Csimple(),
+			"B": Seq(
+				"(", Ref("A"), ")"),
+		}),
+		Grm("S", map[string]*Pattern{
+			"S":     Seq(Ref("Item"), Seq(",", Ref("Item")).Rep(0, -1), Not(Any(1))).Clist(),
+			"Item":  Or(Ref("Num"), Ref("Word")).Csimple(),
+			"Num":   Seq(Ref("Digit"), Ref("Digit").Rep(0, 5)),
+			"Digit": Pat("0").Or("1", "2", "3", "4", "5", "6", "7", "8", "9"),
+			"Word":  Set("abc").Or(Char('x'), Range("yz")).Rep(1, -1),
+		}),
+		Seq(Or(Csimple(NegSet("x").Rep(0, -1)), Lit("y")), "x"),
+		Seq(Rep(Or(Lit("ab"), Lit("cd")), 0, 10), Not(Lit("e"))).Csubst(),
+	}
+	inputs := []string{
+		"", "x", "(x)", "a(b(c)d(e)f)g", ")", "1,ab,22", "1234567,a", "xyz,9,",
+		"abcdab", "abcde", "abx",
+	}
+	for _, pat := range pats {
+		opt := Optimize(pat)
+		if len(*opt) > len(*pat) {
+			t.Errorf("Optimized pattern is larger:\n%v\n\n%v", pat, opt)
+		}
+		for _, s := range inputs {
+			r1, err1, pos1 := Match(pat, s)
+			r2, err2, pos2 := Match(opt, s)
+			if fmt.Sprint(r1, err1, pos1) != fmt.Sprint(r2, err2, pos2) {
+				t.Errorf("%q: expected (%v, %v, %d), got (%v, %v, %d)\n%v\n\n%v",
+					s, r1, err1, pos1, r2, err2, pos2, pat, opt)
+			}
+		}
+	}
+}
+
+// All strings over `alphabet` up to length `n`.
+func allStrings(alphabet string, n int) []string {
+	ret := []string{""}
+	for prev := ret; n > 0; n-- {
+		var next []string
+		for _, s := range prev {
+			for i := range alphabet {
+				next = append(next, s+alphabet[i:i+1])
+			}
+		}
+		ret = append(ret, next...)
+		prev = next
+	}
+	return ret
+}
+
+func TestCompileDFA(t *testing.T) {
+	ab := Set("ab")
+	pats := []*Pattern{
+		Seq(Pat("ab").Or("a"), "c"),
+		Seq(Pat("a").Or("ab"), "c"),
+		Rep(Or(Seq("a", Set("bc")), Lit("a")), 0, -1),
+		Seq(Rep(ab, 1, -1), Rep(Seq(".", Rep(ab, 1, -1)), 0, 1)),
+		Seq(Rep(Lit("ab"), 0, 2), "a"),
+		Seq(Or(Rep(Char('a'), 0, -1), Lit("b")), Lit("b")),
+		Or(Seq("a", Fail(), "b"), Seq(Any(2), "c")),
+		Rep(Or(Lit("abc"), Seq(Lit("a"), Any(1))), 1, 3),
+		Seq(Or(Seq("a", Rep(ab, 0, 1)), Seq(ab, "c")), Rep(Set("c."), 0, 2)),
+		Grm("S", map[string]*Pattern{
+			"S":  Seq(Ref("Id"), Seq(".", Ref("Id")).Rep(0, -1)).Clist(),
+			"Id": Or(Seq("a", Rep(Set("abc"), 0, -1)), Lit("b")).Csimple(),
+		}),
+	}
+	inputs := allStrings("abc.", 5)
+	for _, pat := range pats {
+		dfa := CompileDFA(Optimize(pat))
+		found := false
+		for _, op := range *dfa {
+			if _, ok := op.(*IDFA); ok {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No automaton in compiled pattern:\n%v", dfa)
+		}
+		for _, s := range inputs {
+			r1, err1, pos1 := Match(pat, s)
+			r2, err2, pos2 := Match(dfa, s)
+			// The position where a failed match stopped may differ.
+			if err1 != nil && err2 != nil {
+				pos1, pos2 = 0, 0
+			}
+			if fmt.Sprint(r1, err1, pos1) != fmt.Sprint(r2, err2, pos2) {
+				t.Errorf("%q: expected (%v, %v, %d), got (%v, %v, %d)\n%v\n\n%v",
+					s, r1, err1, pos1, r2, err2, pos2, pat, dfa)
+				break
+			}
+		}
+	}
+}
+
+// Records the events of a match.
+type recordingTracer struct {
+	events []TraceEvent
+}
+
+func (t *recordingTracer) Trace(e *TraceEvent) {
+	t.events = append(t.events, *e)
+}
+
+func TestTracer(t *testing.T) {
+	pat := Grm("S", map[string]*Pattern{
+		"S": Seq(Ref("A").Csimple(), Or(Seq(Set("bc"), "x"), Lit("cd"))),
+		"A": Lit("a"),
+	})
+	rec := &recordingTracer{}
+	_, err, pos := MatchWithOptions(pat, "acd", &MatchOptions{Tracer: rec})
+	if err != nil || pos != 3 {
+		t.Fatalf("Expected match up to 3, got %d (%v)", pos, err)
+	}
+	var calls, kinds []string
+	for _, e := range rec.events {
+		if e.Kind == TraceCall || e.Kind == TraceReturn {
+			calls = append(calls, e.Kind.String()+" "+e.Rule)
+		}
+		if e.Kind != TraceStep {
+			kinds = append(kinds, e.Kind.String())
+		}
+	}
+	if s := strings.Join(calls, ", "); s != "call S, call A, return A, return S" {
+		t.Errorf("Unexpected calls: %s", s)
+	}
+	if s := strings.Join(kinds, " "); s != "call open call return close choice backtrack return" {
+		t.Errorf("Unexpected events: %s", s)
+	}
+
+	var buf bytes.Buffer
+	tracer := NewJSONTracer(&buf)
+	MatchWithOptions(pat, "abx", &MatchOptions{Tracer: tracer})
+	if tracer.Err() != nil {
+		t.Fatal(tracer.Err())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
+
+func TestParseGrammar(t *testing.T) {
+	parens, err := ParseGrammar(`
+		S <- {| A |}
+		A <- { [^()]* (B [^()]*)* }  -- balanced parentheses
+		B <- '(' A ')'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err, pos := Match(parens, "a(b(c)d)e")
+	if err != nil || pos != 9 || fmt.Sprint(r) != "[a(b(c)d)e b(c)d c]" {
+		t.Errorf("Unexpected result (%v, %v, %d)", r, err, pos)
+	}
+
+	var tests []matchTest
+	for _, test := range []struct {
+		src   string
+		input string
+		pos   int
+	}{
+		{`'a' / "b"`, "b", 1},
+		{`[a-c\]]+ !.`, "ab]c", 4},
+		{`[^\x41-Z]`, "B", -1},
+		{`&'a' . .`, "ab", 2},
+		{`'a'^2`, "a", -1},
+		{`'a'^-2 'a'`, "aaaa", 3},
+		{`'x'? 'y'`, "y", 1},
+		{`num <- [0-9]+ ('.' [0-9]+)?`, "3.14", 4},
+	} {
+		pat, err := ParseGrammar(test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		tests = append(tests, matchTest{pat, test.input, test.pos})
+	}
+	runMatchTests(t, tests)
+
+	for _, src := range []string{`'a`, `[a-`, `A <- B`, `(`, `A <- 'a' A <- 'b'`, `'a' )`} {
+		if _, err := ParseGrammar(src); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	pat, err := ParseGrammar(`
+		S <- {| A |} !.
+		A <- { [^()]* (B [^()]*)* }
+		B <- '(' A ')'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := NewProfiler()
+	for i := 0; i < 3; i++ {
+		if _, err, _ := prof.Match(pat, "a(b(c)d)e"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := make(map[string]int)
+	for _, r := range prof.Rules() {
+		calls[r.Name] = r.Calls
+	}
+	if calls["S"] != 3 || calls["A"] != 9 || calls["B"] != 15 {
+		t.Errorf("Unexpected calls: %v", calls)
+	}
+	var report, pprof bytes.Buffer
+	if err := prof.WriteReport(&report); err != nil || !strings.Contains(report.String(), " B\n") {
+		t.Errorf("Unexpected report (%v):\n%s", err, report.String())
+	}
+	if err := prof.WritePprof(&pprof); err != nil || pprof.Len() == 0 {
+		t.Errorf("Could not write pprof profile: %v", err)
+	}
+
+	// The profiler also works as a plain Tracer.
+	prof = NewProfiler()
+	if _, err, _ := MatchWithOptions(pat, "a(b(c)d)e", &MatchOptions{Tracer: prof}); err != nil {
+		t.Fatal(err)
+	}
+	var steps int
+	var spent time.Duration
+	for _, r := range prof.Rules() {
+		steps += r.Steps
+		spent += r.Time
+	}
+	if prof.total <= 0 || prof.total != spent || steps == 0 {
+		t.Errorf("Expected a total of %v for %d steps, got %v", spent, steps, prof.total)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	pat, err := ParseGrammar(`
+		Stmt  <- Kw / Num / Str
+		Kw    <- 'if' / 'else' / 'while'
+		Num   <- [0-9]+
+		Str   <- '"' [^"]* '"'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov := NewCoverage(pat)
+	for _, s := range []string{"if", "12", "while"} {
+		cov.Match(s)
+	}
+	var buf bytes.Buffer
+	if err := cov.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	for _, s := range []string{
+		`Kw: keyword "else"`,
+		"Stmt: alternative 3 of 3",
+		"Str ",
+	} {
+		if !strings.Contains(report, s) {
+			t.Errorf("Expected %q in report:\n%s", s, report)
+		}
+	}
+	if strings.Contains(report, "alternative 2 of 3") || strings.Contains(report, `"while"`) {
+		t.Errorf("Exercised code reported as missed:\n%s", report)
+	}
+	buf.Reset()
+	if err := cov.WriteHTML(&buf); err != nil || !strings.Contains(buf.String(), `<h2 id="Str">`) {
+		t.Errorf("Unexpected HTML report (%v)", err)
+	}
+
+	// Rules that are never called are named too.
+	start, rules, err := ParseRules("S <- 'a' A / 'b'\nA <- 'a'\nOld <- 'o'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov = NewCoverageGrammar(start, rules)
+	cov.Match("b")
+	buf.Reset()
+	cov.WriteText(&buf)
+	report = buf.String()
+	for _, s := range []string{"Old: rule never called", "A: rule never called", "\nOld  "} {
+		if !strings.Contains(report, s) {
+			t.Errorf("Expected %q in report:\n%s", s, report)
+		}
+	}
+	if strings.Contains(report, "S: rule never called") {
+		t.Errorf("Called rule reported as missed:\n%s", report)
+	}
+
+	// An empty keyword matches the empty input.
+	cov = NewCoverage(Keywords("if", ""))
+	cov.Match("")
+	buf.Reset()
+	cov.WriteText(&buf)
+	if report := buf.String(); !strings.Contains(report, `keyword "if"`) || strings.Contains(report, `keyword ""`) {
+		t.Errorf("Unexpected report for the empty input:\n%s", report)
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		pat  *Pattern
+		warn string
+	}{
+		{Or(Lit("="), Lit("==")), `literal '==' can never match, as '=' comes first`},
+		{Or(Range("az"), Lit("if")), `'if' can never match, as [a-z] matches first`},
+		{Or(Rep(Lit("a"), 0, -1), Lit("b")), `'b' can never match, as 'a'* always matches`},
+		{Rep(Rep(Lit("a"), 0, 1), 0, -1), `'a'?* loops forever, as 'a'? can match the empty string`},
+		{Not(Fail()), `!!'' is always true, as !'' never matches`},
+		{And(Rep(Set("ab"), 0, -1)), `&[ab]* is always true, as [ab]* always matches`},
+		{Range("az").Exc(Lit("1")), `!'1' has no effect on [a-z], as they never start alike`},
+		{Lit("if").Exc(Range("az")), `'if' never matches, as ![a-z] excludes all of it`},
+		{Grm("S", map[string]*Pattern{"S": Lit("a"), "T": Lit("b")}), `rule <rule 'b'> is never used`},
+		{Grm("S", map[string]*Pattern{"S": Ref("T"), "T": Lit("a").Or(Lit("ab"))}), `T: literal 'ab' can never match`},
+		{Rep(Lit("ab"), 2, -1), `''`},
+		{Seq(Rep(Set("ab"), 2, 5), Csimple(Rep(Lit("ab"), 1, 9))), `''`},
+		{Or(Seq(Lit("ab"), Ref("X")), Lit("abc")), `''`},
+	}
+	for _, test := range tests {
+		warnings := Lint(test.pat)
+		if test.warn == "''" {
+			if len(warnings) > 0 {
+				t.Errorf("Unexpected warning for %v: %v", decodeExpr(test.pat), warnings[0])
+			}
+			continue
+		}
+		found := false
+		for _, w := range warnings {
+			found = found || strings.Contains(w.String(), test.warn)
+		}
+		if !found {
+			t.Errorf("Expected %q for %v, got %v", test.warn, decodeExpr(test.pat), warnings)
+		}
+	}
+	start, rules, err := ParseRules(`
+		S <- A / 'x'
+		A <- 'a' / 'ab'
+		B <- 'b'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range LintGrammar(start, rules) {
+		got = append(got, w.String())
+	}
+	expected := []string{
+		`A: literal 'ab' can never match, as 'a' comes first`,
+		`B: rule B is never used`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestDecodeExpr(t *testing.T) {
+	src := `S <- {| (A / B)* |} !.
+		A <- [a-z_]+ ('.' [0-9]^2)^-3
+		B <- &'(' { '(' S ')' } .^4 ('x' / 'y' 'z')?`
+	pat, err := ParseGrammar(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`S <- {| (A / B)* |} !.`,
+		`A <- [_a-z]+ ('.' [0-9]^2)^-3`,
+		`B <- &'(' { '(' S ')' } .^4 ('x' / 'yz')?`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(decodeExpr(pat).String(), line) {
+			t.Errorf("Expected %q in:\n%v", line, decodeExpr(pat))
+		}
+	}
+
+	// Bounded repetitions are written so that they can be read back.
+	for pat, want := range map[*Pattern]string{
+		Rep(Lit("ab"), 2, 4):        `'abab' 'ab'^-2`,
+		Rep(Set("xy"), 1, 1):        `[xy]`,
+		Not(Rep(Range("az"), 2, 2)): `!([a-z] [a-z])`,
+	} {
+		src := decodeExpr(pat).String()
+		if src != want {
+			t.Errorf("Expected %s, got %s", want, src)
+		}
+		if _, err := ParseGrammar("S <- " + src); err != nil {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+}
+
+func TestAnalyzeBacktracking(t *testing.T) {
+	tests := []struct {
+		src    string
+		class  Complexity
+		degree int
+	}{
+		{"E <- T '+' E / T\nT <- '(' E ')' / 'n'", Exponential, 0},
+		{"S <- ('a'* 'b' / 'a')*", Polynomial, 2},
+		{"S <- ('a'?)*", Nonterminating, 0},
+		{"S <- S 'a' / 'b'", Nonterminating, 0},
+		{"V <- '[' V (',' V)* ']' / [0-9]+", Linear, 0},
+		{"S <- 'a' S 'b' / 'a' S 'c' / 'x'", Exponential, 0},
+		{"S <- (('a'* 'b' / 'a')* 'c' / 'a')*", Polynomial, 3},
+	}
+	for _, test := range tests {
+		pat, err := ParseGrammar(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := AnalyzeBacktracking(pat)[0]
+		if r.Class != test.class || r.Degree != test.degree {
+			t.Errorf("Expected %v (%d) for %q, got %v", test.class, test.degree, test.src, r)
+		}
+		if r.Class == Exponential || r.Class == Polynomial {
+			// The witness must really be slow.
+			c := &stepCounter{}
+			func() {
+				defer func() { recover() }()
+				MatchWithOptions(pat, r.Witness, &MatchOptions{Tracer: c})
+			}()
+			if c.steps < 20*len(r.Witness) {
+				t.Errorf("Witness %q for %q only took %d steps", r.Witness, test.src, c.steps)
+			}
+		}
+	}
+
+	// Code that can not be decoded is not assumed to be linear.
+	code := Pattern{&IChoice{3}, &IChar{'a'}, &IJump{-2}, &IEnd{}}
+	if r := AnalyzeBacktracking(&code); len(r) != 1 || r[0].Class != Unknown {
+		t.Errorf("Expected unknown for undecoded code, got %v", r)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	pat, err := ParseGrammar(`
+		Value  <- Object / Array / Number / 'true' / 'false'
+		Object <- '{' (Pair (',' Pair)*)? '}'
+		Pair   <- '"' [a-z]+ '"' ':' Value
+		Array  <- '[' (Value (',' Value)*)? ']'
+		Number <- '-'? [0-9]+ !'.' / [0-9]+ '.' [0-9]+
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		s, err := Generate(pat, rng, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err, pos := Match(pat, s); err != nil || pos != len(s) {
+			t.Errorf("Generated %q does not match", s)
+		}
+	}
+	opts := &GenerateOptions{Weights: map[string][]float64{"Value": {0, 1}}}
+	s, err := Generate(pat, rng, opts)
+	if err != nil || s[0] != '[' {
+		t.Errorf("Expected an array, got %q (%v)", s, err)
+	}
+	if _, err := Generate(Seq(Lit("a"), Not(Any(0))), rng, nil); err == nil {
+		t.Errorf("Expected an error for a pattern that never matches")
+	}
+
+	// Automata from CompileDFA.
+	for _, p := range []*Pattern{
+		Seq(Rep(Or(Seq("a", Set("bc")), Lit("a")), 0, -1), "x"),
+		Seq(Rep(Set("ab"), 1, -1), Rep(Seq(".", Rep(Set("ab"), 1, -1)), 0, 1), ";"),
+	} {
+		dfa := CompileDFA(p)
+		if _, ok := (*dfa)[0].(*IDFA); !ok {
+			t.Fatalf("No automaton in %v", dfa)
+		}
+		for i := 0; i < 20; i++ {
+			s, err := Generate(dfa, rng, nil)
+			if err != nil {
+				t.Fatalf("%v: %v", dfa, err)
+			}
+			if _, err, pos := Match(p, s); err != nil || pos != len(s) {
+				t.Errorf("Generated %q does not match %v", s, dfa)
+			}
+		}
+	}
+	code := Pattern{&IChoice{3}, &IChar{'a'}, &IJump{-2}, &IEnd{}}
+	if _, err := Generate(&code, rng, nil); err == nil || err.Error() != "Can not generate input for Choice +3" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// Builds patterns for the fuzz targets, reading choices from the data.
+type patternFuzzer struct {
+	data []byte
+}
+
+func (f *patternFuzzer) next() int {
+	if len(f.data) == 0 {
+		return 0
+	}
+	b := f.data[0]
+	f.data = f.data[1:]
+	return int(b)
+}
+
+func (f *patternFuzzer) literal(max int) string {
+	b := make([]byte, f.next()%(max+1))
+	for i := range b {
+		b[i] = byte('a' + f.next()%3)
+	}
+	return string(b)
+}
+
+// A regular pattern, with an equivalent regexp. Only patterns that can
+// not backtrack in ways a regexp would not are built: the alternatives
+// of a choice start differently, and repetitions can not continue with
+// what follows them (`follow`).
+func (f *patternFuzzer) regular(follow ICharset, depth int) (pat *Pattern, re string, first ICharset, empty bool) {
+	op := f.next() % 5
+	if depth > 4 {
+		op %= 2
+	}
+	switch op {
+	case 0:
+		s := f.literal(3)
+		if s == "" {
+			return Lit(s), "", first, true
+		}
+		first.add(s[0], s[0])
+		return Lit(s), regexp.QuoteMeta(s), first, false
+	case 1:
+		bits := f.next()%15 + 1
+		chars := ""
+		for c := 0; c < 4; c++ {
+			if bits&(1<<uint(c)) != 0 {
+				chars += string(rune('a' + c))
+				first.add(byte('a'+c), byte('a'+c))
+			}
+		}
+		return Set(chars), "[" + chars + "]", first, false
+	case 2:
+		p2, re2, first2, empty2 := f.regular(follow, depth+1)
+		follow1 := first2
+		if empty2 {
+			follow1.union(&follow)
+		}
+		p1, re1, first1, empty1 := f.regular(follow1, depth+1)
+		if empty1 {
+			first1.union(&first2)
+		}
+		return Seq(p1, p2), re1 + re2, first1, empty1 && empty2
+	case 3:
+		p1, re1, first1, empty1 := f.regular(follow, depth+1)
+		p2, re2, first2, empty2 := f.regular(follow, depth+1)
+		if empty1 || empty2 || first1.intersects(&first2) {
+			return p1, re1, first1, empty1
+		}
+		first1.union(&first2)
+		return Or(p1, p2), "(?:" + re1 + "|" + re2 + ")", first1, false
+	}
+	p, re, first, empty := f.regular(follow, 5)
+	if empty || first.intersects(&follow) {
+		return p, re, first, empty
+	}
+	min := f.next() % 3
+	max := -1
+	if n := f.next() % 8; n < 7 {
+		max = min + n
+	}
+	if max < 0 {
+		re = fmt.Sprintf("(?:%s){%d,}", re, min)
+	} else {
+		re = fmt.Sprintf("(?:%s){%d,%d}", re, min, max)
+	}
+	return Rep(p, min, max), re, first, min == 0
+}
+
+// Any pattern made by the constructors, and some raw instructions.
+// Repetitions of patterns that can match the empty string are bounded,
+// so that matches always end.
+func (f *patternFuzzer) pattern(depth int) (pat *Pattern, empty bool) {
+	op := f.next() % 16
+	if depth > 4 {
+		op %= 4
+	}
+	switch op {
+	case 0:
+		s := f.literal(3)
+		return Lit(s), s == ""
+	case 1:
+		if f.next()%2 == 0 {
+			return Set(f.literal(4)), false
+		}
+		return NegSet(f.literal(2)), false
+	case 2:
+		lo := byte('a' + f.next()%3)
+		return Range(string([]byte{lo, lo + byte(f.next()%3)})), false
+	case 3:
+		n := f.next() % 3
+		return Any(n), n == 0
+	case 4:
+		p1, e1 := f.pattern(depth + 1)
+		p2, e2 := f.pattern(depth + 1)
+		return Seq(p1, p2), e1 && e2
+	case 5:
+		p1, e1 := f.pattern(depth + 1)
+		p2, e2 := f.pattern(depth + 1)
+		return Or(p1, p2), e1 || e2
+	case 6:
+		p, e := f.pattern(depth + 1)
+		min := f.next() % 5
+		max := -1
+		if n := f.next() % 8; n < 7 || e {
+			max = min + n%7
+		}
+		return Rep(p, min, max), e || min == 0
+	case 7:
+		p, _ := f.pattern(depth + 1)
+		return Not(p), true
+	case 8:
+		p, _ := f.pattern(depth + 1)
+		return And(p), true
+	case 9:
+		p, e := f.pattern(depth + 1)
+		switch f.next() % 4 {
+		case 0:
+			return Csimple(p), e
+		case 1:
+			return Clist(p), e
+		case 2:
+			return Seq(p, Cposition()), e
+		}
+		return Seq(Cconst(f.next()), p), e
+	case 10:
+		words := make([]string, f.next()%3+1)
+		for i := range words {
+			words[i] = f.literal(3)
+		}
+		return Keywords(words...), false
+	case 11:
+		// Each call consumes a character first, so there is no left
+		// recursion.
+		x, _ := f.pattern(depth + 1)
+		y, _ := f.pattern(depth + 1)
+		return Grm("A", map[string]*Pattern{
+			"A": Or(Seq(Char(byte('a'+f.next()%3)), Ref("B")), x),
+			"B": Or(Seq(Char(byte('a'+f.next()%3)), Ref("A")), y),
+		}), false
+	case 12:
+		s := f.literal(3)
+		return Seq(Lit(s), &IFullCapture{len(s), &SimpleCapture{}}), s == ""
+	case 13:
+		return Seq(&IGiveUp{}), true
+	case 14:
+		return Ref("missing"), false
+	}
+	if f.next()%2 == 0 {
+		return Fail(), false
+	}
+	return Succ(), true
+}
+
+// Checks the invariants of the VM during a match.
+type invariantTracer struct {
+	stepCounter
+	input string
+	err   error
+}
+
+func (c *invariantTracer) Trace(e *TraceEvent) {
+	c.stepCounter.Trace(e)
+	switch {
+	case c.err != nil:
+	case e.Pos < 0 || e.Pos > len(c.input):
+		c.err = fmt.Errorf("Position %d outside of the input at %d", e.Pos, e.PC)
+	case e.Kind == TraceStep && e.Stack.Len() > 0:
+		if _, ok := e.Op.(*IEnd); ok {
+			c.err = fmt.Errorf("Stack not empty at the end: %v", e.Stack)
+		}
+	}
+}
+
+// Match with the invariants checked. Returns false if the match took
+// too long to be checked.
+func checkedMatch(t *testing.T, pat *Pattern, input string) (r interface{}, err error, pos int, ok bool) {
+	c := &invariantTracer{input: input}
+	defer func() {
+		if e := recover(); e != nil {
+			if _, limit := e.(stepLimit); !limit {
+				panic(e)
+			}
+			ok = false
+		}
+	}()
+	r, err, pos = MatchWithOptions(pat, input, &MatchOptions{Tracer: c})
+	if c.err != nil {
+		t.Fatalf("%v\nin\n%v\nfor %q", c.err, pat, input)
+	}
+	if pos < 0 || pos > len(input) {
+		t.Fatalf("Position %d outside of the input for %q", pos, input)
+	}
+	return r, err, pos, true
+}
+
+// Seeds for the fuzz targets. Together they cover every instruction.
+var fuzzSeeds = []struct {
+	code  []byte
+	input string
+}{
+	{[]byte{0, 2, 0, 1}, "ab"},                    // Char
+	{[]byte{1, 0, 3, 'a', 'b', 'c'}, "b"},         // Charset
+	{[]byte{1, 1, 1, 'a'}, "b"},                   // NegSet
+	{[]byte{3, 2}, "xy"},                          // Any
+	{[]byte{5, 0, 1, 0, 0, 1, 1}, "b"},            // Keywords
+	{[]byte{5, 4, 0, 1, 0, 0, 1, 1}, "ba"},        // Choice, Commit
+	{[]byte{6, 1, 0, 2, 'a', 'b', 1, 1}, "abab"},  // Span
+	{[]byte{6, 0, 1, 0, 0, 7}, "aaaa"},            // Choice loop
+	{[]byte{6, 0, 2, 0, 1, 1, 2}, "aaab"},         // PartialCommit
+	{[]byte{6, 0, 1, 0, 4, 6}, "aaaaaaaaaaaaa"},   // PushCounter, Loop, PopCounter
+	{[]byte{7, 0, 1, 0}, "b"},                     // FailTwice
+	{[]byte{8, 0, 1, 0}, "a"},                     // BackCommit
+	{[]byte{9, 0, 0, 1, 0}, "a"},                  // OpenCapture, CloseCapture
+	{[]byte{9, 3, 1, 2}, "x"},                     // EmptyCapture
+	{[]byte{11, 0, 0, 0, 0, 0, 0, 1, 0}, "abab"},  // Call, Return, Jump
+	{[]byte{12, 2, 0, 1}, "ab"},                   // FullCapture
+	{[]byte{13}, ""},                              // GiveUp
+	{[]byte{14}, ""},                              // OpenCall
+	{[]byte{15, 0}, ""},                           // Fail
+	{[]byte{4, 6, 1, 0, 2, 'a', 'b', 4, 6}, "ab"}, // Counted span
+	{[]byte{5, 5, 0, 1, 0, 3, 1, 2, 5, 0, 1, 2, 0, 1, 0}, "ac"},
+	{[]byte("98\xff"), ""}, // Capture of an automaton that never accepts
+}
+
+func fuzzAddSeeds(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed.code, seed.input)
+	}
+}
+
+func sameResult(r1 interface{}, err1 error, pos1 int, r2 interface{}, err2 error, pos2 int) bool {
+	if (err1 == nil) != (err2 == nil) {
+		return false
+	}
+	return err1 != nil || pos1 == pos2 && fmt.Sprint(r1) == fmt.Sprint(r2)
+}
+
+// Any pattern: the VM must keep its invariants, and the optimized and
+// automaton forms must give the same results.
+func FuzzMatch(f *testing.F) {
+	fuzzAddSeeds(f)
+	f.Fuzz(func(t *testing.T, code []byte, input string) {
+		pat, _ := (&patternFuzzer{code}).pattern(0)
+		r, err, pos, ok := checkedMatch(t, pat, input)
+		if !ok {
+			return
+		}
+		opt := Optimize(pat)
+		if Verify(pat) == nil {
+			for _, p := range []*Pattern{opt, CompileDFA(opt)} {
+				if err := Verify(p); err != nil {
+					t.Fatalf("%v\nin\n%v\noptimized from\n%v", err, p, pat)
+				}
+			}
+		}
+		for _, p := range []*Pattern{opt, CompileDFA(pat), CompileDFA(opt)} {
+			r2, err2, pos2, ok := checkedMatch(t, p, input)
+			if ok && !sameResult(r, err, pos, r2, err2, pos2) {
+				t.Fatalf("%v\nand\n%v\ndiffer for %q: %v %v %d, %v %v %d",
+					pat, p, input, r, err, pos, r2, err2, pos2)
+			}
+		}
+	})
+}
+
+// Regular patterns must match the same as the equivalent regexp.
+func FuzzRegexp(f *testing.F) {
+	fuzzAddSeeds(f)
+	f.Fuzz(func(t *testing.T, code []byte, input string) {
+		pat, re, _, _ := (&patternFuzzer{code}).regular(ICharset{}, 0)
+		loc := regexp.MustCompile("^(?:" + re + ")").FindStringIndex(input)
+		for _, p := range []*Pattern{pat, Optimize(pat), CompileDFA(Optimize(pat))} {
+			_, err, pos, _ := checkedMatch(t, p, input)
+			if (err == nil) != (loc != nil) || loc != nil && pos != loc[1] {
+				t.Fatalf("%v\ndiffers from /%s/ for %q: %v %d, %v", p, re, input, err, pos, loc)
+			}
+		}
+	})
+}
+
+func TestFuzzSeeds(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, seed := range fuzzSeeds {
+		pat, _ := (&patternFuzzer{seed.code}).pattern(0)
+		for _, p := range []*Pattern{pat, CompileDFA(Optimize(pat))} {
+			for _, op := range *p {
+				seen[fmt.Sprintf("%T", op)] = true
+			}
+		}
+	}
+	all := []Instruction{
+		&IChar{}, &IJump{}, &IChoice{}, &IOpenCall{}, &ICall{}, &ICommit{},
+		&IPartialCommit{}, &IBackCommit{}, &IReturn{}, &IFail{}, &IFailTwice{},
+		&IEnd{}, &IKeywords{}, &IPushCounter{}, &ILoop{}, &IPopCounter{},
+		&IGiveUp{}, &IOpenCapture{}, &ICloseCapture{}, &IFullCapture{},
+		&IEmptyCapture{}, &ICharset{}, &ISpan{}, &IAny{}, &IDFA{},
+	}
+	for _, op := range all {
+		if name := fmt.Sprintf("%T", op); !seen[name] {
+			t.Errorf("No fuzz seed uses %s", name)
+		}
+	}
+}
+
+// Stops a match after a number of steps.
+type stepLimiter struct {
+	steps int
+}
+
+func (l *stepLimiter) Trace(e *TraceEvent) {
+	if l.steps--; l.steps < 0 {
+		panic(stepLimit{})
+	}
+}
+
+// Match, giving up after 10000 steps. Returns false if it gave up.
+func limitedMatch(pat *Pattern, input string) (r interface{}, err error, pos int, ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, limit := e.(stepLimit); !limit {
+				panic(fmt.Sprintf("%v\nin\n%v\nfor %q", e, pat, input))
+			}
+			ok = false
+		}
+	}()
+	r, err, pos = MatchWithOptions(pat, input, &MatchOptions{Tracer: &stepLimiter{10000}})
+	return r, err, pos, true
+}
+
+// Patterns for the binary format tests, using every instruction and
+// capture handler that can be stored.
+func binaryTestPatterns() []*Pattern {
+	RegisterFunc("test.count", func(caps []*CaptureResult) (interface{}, error) {
+		return len(caps), nil
+	})
+	json, _ := ParseGrammar(benchJSON)
+	return []*Pattern{
+		Grm("S", map[string]*Pattern{
+			"S": Ref("A").Clist(),
+			"A": Seq(NegSet("()").Rep(0, -1), Seq(Ref("B"), NegSet("()").Rep(0, -1)).Rep(0, -1)).Csimple(),
+			"B": Seq("(", Ref("A"), ")"),
+		}),
+		Seq(Cposition(), Cconst(1), Cconst(2.5), Cconst("s"), Cconst(true), Cconst(nil),
+			Cstring(Csimple(Any(1)), "<{0}>"), Csubst(Rep(Or(Cstring(Lit("a"), "b"), Any(1)), 0, -1))),
+		Rep(Keywords("if", "in", "x"), 2, 40),
+		Cnamed(Rep(Csimple(Any(1)), 0, -1), "test.count"),
+		Seq(Not(Lit("x")), And(Set("ab")), Rep(Set("ab"), 0, 3), Or(Lit("c"), Seq(&IGiveUp{}))),
+		Seq(Lit("ab"), &IFullCapture{2, &SimpleCapture{}}, Rep(Any(1), 0, -1)),
+		Ctable(Seq(Cg(Any(1), "first"), Rep(Csimple(Any(1)), 0, -1))),
+		json,
+		CompileDFA(Optimize(json)),
+	}
+}
+
+var binaryTestInputs = []string{
+	"", "x", "a(b)c", "(()", "ab", "abc", "ifinx", "ifififif", "aab",
+	`{"a": [1, 2.5e3, "x\"y"], "b": {}}`, "[true, false, null]", "[1,",
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, p := range binaryTestPatterns() {
+		data, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%v\n%v", err, p)
+		}
+		q := &Pattern{}
+		if err := q.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%v\n%v", err, p)
+		}
+		if q.String() != p.String() {
+			t.Errorf("Expected\n%v\ngot\n%v", p, q)
+		}
+		for _, input := range binaryTestInputs {
+			r, err, pos := Match(p, input)
+			r2, err2, pos2 := Match(q, input)
+			if !sameResult(r, err, pos, r2, err2, pos2) {
+				t.Errorf("%q: expected %v %v %d, got %v %v %d\n%v", input, r, err, pos, r2, err2, pos2, p)
+			}
+		}
+
+		// Corrupt data must give an error, or a pattern that does not
+		// crash the VM.
+		for i := 0; i < len(data); i += 1 + len(data)/500 {
+			if err := q.UnmarshalBinary(data[:i]); err == nil {
+				t.Errorf("Truncated data loaded:\n%v", p)
+			}
+			corrupt := append([]byte(nil), data...)
+			for _, x := range []byte{0x01, 0x80, 0xff} {
+				corrupt[i] = data[i] ^ x
+				if q.UnmarshalBinary(corrupt) == nil {
+					for _, input := range binaryTestInputs {
+						limitedMatch(q, input)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := Cfunc(Any(1), nil).MarshalBinary(); err == nil {
+		t.Error("Unregistered function capture stored")
+	}
+	if _, err := Cconst([]int{1}).MarshalBinary(); err == nil {
+		t.Error("Constant capture of a slice stored")
+	}
+	q := &Pattern{}
+	for _, data := range []string{"", "xyz", "pego\x02\x01\x0c", "pego\x01\x01\x02\x02\x0c"} {
+		if err := q.UnmarshalBinary([]byte(data)); err == nil {
+			t.Errorf("%q: loaded %v", data, q)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	for _, p := range binaryTestPatterns() {
+		text := Disassemble(p)
+		q, err := Assemble(text)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, text)
+		}
+		if q.String() != p.String() || Disassemble(q) != text {
+			t.Errorf("Expected\n%v\ngot\n%v", p, q)
+		}
+		for _, input := range binaryTestInputs {
+			r, err, pos := Match(p, input)
+			r2, err2, pos2 := Match(q, input)
+			if !sameResult(r, err, pos, r2, err2, pos2) {
+				t.Errorf("%q: expected %v %v %d, got %v %v %d\n%s", input, r, err, pos, r2, err2, pos2, text)
+			}
+		}
+	}
+
+	text := Disassemble(Grm("S", map[string]*Pattern{"S": Seq(Csimple(Rep(Set("ab"), 1, -1)), Ref("S").Or(""))}))
+	want := `	call S
+	jump L2
+S:
+	opencapture simple
+	charset [ab]
+	span [ab]
+	closecapture
+	choice L1
+	call S
+	commit L1
+L1:
+	return
+L2:
+	end
+`
+	if text != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, text)
+	}
+
+	// Names that are not labels are kept too.
+	p := Grm("my rule", map[string]*Pattern{"my rule": Seq("a", Ref("L1").Or("")), "L1": Lit("b")})
+	text = Disassemble(p)
+	if !strings.Contains(text, " 'my rule'\n") || !strings.Contains(text, " 'L1'\n") {
+		t.Errorf("Expected a quoted name in\n%s", text)
+	}
+	if q, err := Assemble(text); err != nil || q.String() != p.String() || Disassemble(q) != text {
+		t.Errorf("Expected\n%v\ngot\n%v %v", p, q, err)
+	}
+
+	tests := []struct{ src, err string }{
+		{"jump L1\nend", `1:6: Undefined label "L1"`},
+		{"a:\na:", `2:1: Label "a" defined twice`},
+		{"char 'ab'", `1:10: Expected a single character`},
+		{"push", `1:1: Unknown instruction "push"`},
+		{"opencapture foo", `1:13: Unknown capture handler`},
+		{"emptycapture const x", `1:20: Expected a constant`},
+		{"dfa { 0: . -> 1 }", `1:18: Invalid automaton`},
+	}
+	for _, test := range tests {
+		if _, err := Assemble(test.src); err == nil || err.Error() != test.err {
+			t.Errorf("%q: expected %q, got %v", test.src, test.err, err)
+		}
+	}
+}
+
+// Loading any data must give an error, or a pattern that does not crash
+// the VM.
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, p := range binaryTestPatterns() {
+		data, _ := p.MarshalBinary()
+		f.Add(data, "ab")
+	}
+	f.Fuzz(func(t *testing.T, data []byte, input string) {
+		p := &Pattern{}
+		if p.UnmarshalBinary(data) == nil {
+			limitedMatch(p, input)
+		}
+	})
+}
+
+// Case of the LPeg conformance suite, translated from LPeg's test.lua.
+// `want` is the result LPeg gives: a 1-based end position, 0 for no
+// match, or the capture values. Cases for missing features have a
+// `skip` reason instead of a pattern.
+type lpegCase struct {
+	lua   string // Original LPeg expression and subject
+	pat   *Pattern
+	input string
+	want  interface{}
+	skip  string
+}
+
+func lpegCases() []lpegCase {
+	var (
+		eos    = Not(Any(1)) // -1
+		digit  = Range("09")
+		upper  = Range("AZ")
+		lower  = Range("az")
+		letter = Or(upper, lower)
+		alpha  = Or(letter, digit)
+		word   = Seq(Rep(alpha, 1, -1), Rep(Seq(Not(alpha), Any(1)), 0, -1))
+	)
+	// b = {"(" * (((1 - S"()") + #P"(" * V(1))^0) * ")"}
+	b := Grm("B", map[string]*Pattern{
+		"B": Seq("(", Rep(Or(NegSet("()"), Seq(And(Lit("(")), Ref("B"))), 0, -1), ")"),
+	})
+	// basiclookfor(p) = {p + (1 * V(1))}
+	lookfor := func(p *Pattern) *Pattern {
+		return Grm("S", map[string]*Pattern{"S": Or(p, Seq(Any(1), Ref("S")))})
+	}
+	return []lpegCase{
+		// Basic patterns
+		{lua: `P(true), ""`, pat: Pat(true), input: "", want: 1},
+		{lua: `P(false), ""`, pat: Pat(false), input: "", want: 0},
+		{lua: `P(false) + P(true), ""`, pat: Or(Fail(), Succ()), input: "", want: 1},
+		{lua: `P(true) + P(false), ""`, pat: Or(Succ(), Fail()), input: "", want: 1},
+		{lua: `P(true) * P(false), ""`, pat: Seq(true, false), input: "", want: 0},
+		{lua: `"a", "alo"`, pat: Pat("a"), input: "alo", want: 2},
+		{lua: `"al", "alo"`, pat: Pat("al"), input: "alo", want: 3},
+		{lua: `"alu", "alo"`, pat: Pat("alu"), input: "alo", want: 0},
+		{lua: `true, ""`, pat: Pat(true), input: "", want: 1},
+		{lua: `3, "aaaa"`, pat: Pat(3), input: "aaaa", want: 4},
+		{lua: `4, "aaaa"`, pat: Pat(4), input: "aaaa", want: 5},
+		{lua: `5, "aaaa"`, pat: Pat(5), input: "aaaa", want: 0},
+		{lua: `-3, "aa"`, pat: Not(Any(3)), input: "aa", want: 1},
+		{lua: `-3, "aaa"`, pat: Not(Any(3)), input: "aaa", want: 0},
+		{lua: `-5, "aaaa"`, pat: Not(Any(5)), input: "aaaa", want: 1},
+		{lua: `P(-3), "aa"`, input: "aa", want: 1,
+			skip: "Pat(-n) asserts at least n characters, LPeg's P(-n) asserts fewer than n; use Not(Any(n))"},
+		{lua: `"alo" * (P"\n" + -1), "alo"`, pat: Seq("alo", Or(Lit("\n"), eos)), input: "alo", want: 4},
+
+		// Sets and ranges
+		{lua: `S"", "a"`, pat: Set(""), input: "a", want: 0},
+		{lua: `R"az", "x"`, pat: lower, input: "x", want: 2},
+		{lua: `R"AZ", "x"`, pat: upper, input: "x", want: 0},
+		{lua: `R("az", "AZ")^0, "aBc1"`, pat: Rep(Range("az", "AZ"), 0, -1), input: "aBc1", want: 4},
+		{lua: `S"+-*/"^1, "+-x"`, pat: Rep(Set("+-*/"), 1, -1), input: "+-x", want: 3},
+		{lua: `1 - S"ab", "c"`, pat: Seq(Not(Set("ab")), Any(1)), input: "c", want: 2},
+		{lua: `1 - S"ab", "b"`, pat: Seq(Not(Set("ab")), Any(1)), input: "b", want: 0},
+		{lua: `utfR(0x80, 0x7ff), "é"`, input: "é", want: 3, skip: "utfR is not supported"},
+		{lua: `locale().alpha, "a"`, input: "a", want: 2, skip: "locale is not supported"},
+
+		// Repetitions
+		{lua: `word^0 * -1, "alo alo"`, pat: Seq(Rep(word, 0, -1), eos), input: "alo alo", want: 8},
+		{lua: `word^1 * -1, "alo alo"`, pat: Seq(Rep(word, 1, -1), eos), input: "alo alo", want: 8},
+		{lua: `word^2 * -1, "alo alo"`, pat: Seq(Rep(word, 2, -1), eos), input: "alo alo", want: 8},
+		{lua: `word^3 * -1, "alo alo"`, pat: Seq(Rep(word, 3, -1), eos), input: "alo alo", want: 0},
+		{lua: `word^-1 * -1, "alo alo"`, pat: Seq(Rep(word, 0, 1), eos), input: "alo alo", want: 0},
+		{lua: `word^-2 * -1, "alo alo"`, pat: Seq(Rep(word, 0, 2), eos), input: "alo alo", want: 8},
+		{lua: `word^-3 * -1, "alo alo"`, pat: Seq(Rep(word, 0, 3), eos), input: "alo alo", want: 8},
+		{lua: `digit^0 * letter * digit * -1, "1298a1"`,
+			pat: Seq(Rep(digit, 0, -1), letter, digit, eos), input: "1298a1", want: 7},
+		{lua: `digit^0 * letter * -1, "1257a1"`,
+			pat: Seq(Rep(digit, 0, -1), letter, eos), input: "1257a1", want: 0},
+		{lua: `P"a"^-1, "aa"`, pat: Rep(Lit("a"), 0, 1), input: "aa", want: 2},
+		{lua: `P"ab"^-2, "ababab"`, pat: Rep(Lit("ab"), 0, 2), input: "ababab", want: 5},
+		{lua: `P"a"^1, "b"`, pat: Rep(Lit("a"), 1, -1), input: "b", want: 0},
+		{lua: `P"a"^0, "b"`, pat: Rep(Lit("a"), 0, -1), input: "b", want: 1},
+		{lua: `(P"a"^0)^0, ""`, input: "", want: 1, skip: "LPeg rejects loops on empty patterns when they are built"},
+
+		// Ordered choice
+		{lua: `P"a"^1 + "ab" + P"x"^0, "ab"`,
+			pat: Or(Or(Rep(Lit("a"), 1, -1), Lit("ab")), Rep(Lit("x"), 0, -1)), input: "ab", want: 2},
+		{lua: `(P"a"^1 + "ab" + P"x"^0 * 1)^0, "ab"`,
+			pat: Rep(Or(Or(Rep(Lit("a"), 1, -1), Lit("ab")), Seq(Rep(Lit("x"), 0, -1), 1)), 0, -1), input: "ab", want: 3},
+		{lua: `P"ab" + "cd" + "" + "cy" + "ak", "98"`,
+			pat: Lit("ab").Or("cd", "", "cy", "ak"), input: "98", want: 1},
+		{lua: `P"ab" + "cd" + "ax" + "cy", "ax"`,
+			pat: Lit("ab").Or("cd", "ax", "cy"), input: "ax", want: 3},
+		{lua: `"a" * P"b"^0 * "c" + "cd" + "ax" + "cy", "ax"`,
+			pat: Seq("a", Rep(Lit("b"), 0, -1), "c").Or("cd", "ax", "cy"), input: "ax", want: 3},
+		{lua: `(P"ab" + "cd" + "ax" + "cy")^0, "ax"`,
+			pat: Rep(Lit("ab").Or("cd", "ax", "cy"), 0, -1), input: "ax", want: 3},
+		{lua: `P(1) * "x" + S"" * "xu" + "ay", "ay"`,
+			pat: Seq(1, "x").Or(Seq(Set(""), "xu"), "ay"), input: "ay", want: 3},
+		{lua: `P"abc" + "cde" + "aka", "aka"`,
+			pat: Lit("abc").Or("cde", "aka"), input: "aka", want: 4},
+		{lua: `S"abc" * "x" + "cde" + "aka", "ax"`,
+			pat: Seq(Set("abc"), "x").Or("cde", "aka"), input: "ax", want: 3},
+		{lua: `S"abc" * "x" + "cde" + "aka", "aka"`,
+			pat: Seq(Set("abc"), "x").Or("cde", "aka"), input: "aka", want: 4},
+		{lua: `S"abc" * "x" + "cde" + "aka", "cde"`,
+			pat: Seq(Set("abc"), "x").Or("cde", "aka"), input: "cde", want: 4},
+		{lua: `"ab" + S"abc" * P"y"^0 * "x" + "cde" + "aka", "aka"`,
+			pat: Lit("ab").Or(Seq(Set("abc"), Rep(Lit("y"), 0, -1), "x"), "cde", "aka"), input: "aka", want: 4},
+		{lua: `P(1) * "x" + "cde" + P(1) * "ka", "aka"`,
+			pat: Seq(1, "x").Or("cde", Seq(1, "ka")), input: "aka", want: 4},
+		{lua: `P"eb" + "cd" + P"e"^0 + "x", "ee"`,
+			pat: Lit("eb").Or("cd", Rep(Lit("e"), 0, -1), "x"), input: "ee", want: 3},
+		{lua: `P"ab" + "cd" + P"e"^0 + "x", "abcd"`,
+			pat: Lit("ab").Or("cd", Rep(Lit("e"), 0, -1), "x"), input: "abcd", want: 3},
+		{lua: `P"ab" + "cd" + P"e"^0 + "x", "eeex"`,
+			pat: Lit("ab").Or("cd", Rep(Lit("e"), 0, -1), "x"), input: "eeex", want: 4},
+		{lua: `P"ab" + "cd" + P"e"^0 + "x", "x"`,
+			pat: Lit("ab").Or("cd", Rep(Lit("e"), 0, -1), "x"), input: "x", want: 1},
+		{lua: `P"ab" + "cd" + P"e"^1 + "x", "x"`,
+			pat: Lit("ab").Or("cd", Rep(Lit("e"), 1, -1), "x"), input: "x", want: 2},
+		{lua: `P"ab" + "cd" + P"e"^1 + "x" + "", "zee"`,
+			pat: Lit("ab").Or("cd", Rep(Lit("e"), 1, -1), "x", ""), input: "zee", want: 1},
+		{lua: `("aa" * P"bc"^-1 + "aab") * "e", "aabe"`,
+			pat: Seq(Seq("aa", Rep(Lit("bc"), 0, 1)).Or("aab"), "e"), input: "aabe", want: 0},
+
+		// Predicates
+		{lua: `-P"a" * 2, "alo"`, pat: Seq(Not(Lit("a")), 2), input: "alo", want: 0},
+		{lua: `- -P"a" * 2, "alo"`, pat: Seq(Not(Not(Lit("a"))), 2), input: "alo", want: 3},
+		{lua: `#P"a" * 2, "alo"`, pat: Seq(And(Lit("a")), 2), input: "alo", want: 3},
+		{lua: `##P"a" * 2, "alo"`, pat: Seq(And(And(Lit("a"))), 2), input: "alo", want: 3},
+		{lua: `##P"c" * 2, "alo"`, pat: Seq(And(And(Lit("c"))), 2), input: "alo", want: 0},
+		{lua: `letter^1 - "for", "foreach"`, pat: Rep(letter, 1, -1).Exc(Lit("for")), input: "foreach", want: 0},
+		{lua: `letter^1 - ("for" * -1), "foreach"`,
+			pat: Rep(letter, 1, -1).Exc(Seq("for", eos)), input: "foreach", want: 8},
+		{lua: `letter^1 - ("for" * -1), "for"`,
+			pat: Rep(letter, 1, -1).Exc(Seq("for", eos)), input: "for", want: 0},
+		{lua: `B"a", "a"`, input: "a", want: 0, skip: "lookbehind (B) is not supported"},
+
+		// Grammars
+		{lua: `b, "(al())()"`, pat: b, input: "(al())()", want: 7},
+		{lua: `b * -1, "(al())()"`, pat: Seq(b, eos), input: "(al())()", want: 0},
+		{lua: `b * -1, "((al())()(é))"`, pat: Seq(b, eos), input: "((al())()(é))", want: 15},
+		{lua: `b, "(al()()"`, pat: b, input: "(al()()", want: 0},
+		{lua: `basiclookfor((#P(b) * 1) * Cp()), "  (  (a)"`,
+			pat: lookfor(Seq(And(b), 1, Cposition())), input: "  (  (a)", want: 6}, // Positions are 0-based
+		{lua: `{V"S" * -1, S = "a" * V"S" * "b" + ""}, "aabb"`,
+			pat: Grm("M", map[string]*Pattern{
+				"M": Seq(Ref("S"), eos),
+				"S": Seq("a", Ref("S"), "b").Or(""),
+			}), input: "aabb", want: 5},
+		{lua: `{"S", S = "a" * V"S" * "b" + ""} * -1, "aabb"`,
+			pat:   Seq(Grm("S", map[string]*Pattern{"S": Seq("a", Ref("S"), "b").Or("")}), eos),
+			input: "aabb", want: 5},
+		{lua: `{"S", S = V"S" * "a"}`, skip: "LPeg rejects left-recursive rules when they are built"},
+
+		// Captures
+		{lua: `C(letter^1), "alo3"`, pat: Csimple(Rep(letter, 1, -1)), input: "alo3", want: "alo"},
+		{lua: `basiclookfor(C(letter^1)), "   4achou123..."`,
+			pat: lookfor(Csimple(Rep(letter, 1, -1))), input: "   4achou123...", want: "achou"},
+		{lua: `{basiclookfor(C(letter^1))^0}, " two words, one more  "`,
+			pat:   Clist(Rep(lookfor(Csimple(Rep(letter, 1, -1))), 0, -1)),
+			input: " two words, one more  ", want: []interface{}{"two", "words", "one", "more"}},
+		{lua: `{C(digit^1 * Cc"d") + C(letter^1 * Cc"l")}, "123"`,
+			pat:   Clist(Csimple(Seq(Rep(digit, 1, -1), Cconst("d"))).Or(Csimple(Seq(Rep(letter, 1, -1), Cconst("l"))))),
+			input: "123", want: []interface{}{"123", "d"}},
+		{lua: `{C(C(2) * C(1))}, "abc"`, pat: Clist(Csimple(Seq(Csimple(Any(2)), Csimple(Any(1))))),
+			input: "abc", want: []interface{}{"abc", "ab", "c"}},
+		{lua: `Cp(), ""`, pat: Cposition(), input: "", want: 0},
+		{lua: `{Cp() * letter^1 * Cp()}, "abc1"`, pat: Clist(Seq(Cposition(), Rep(letter, 1, -1), Cposition())),
+			input: "abc1", want: []interface{}{0, 3}},
+		{lua: `Cc(10), "x"`, pat: Cconst(10), input: "x", want: 10},
+		{lua: `Ct(C(1)^0), "alo"`, pat: Clist(Rep(Csimple(Any(1)), 0, -1)), input: "alo",
+			want: []interface{}{"a", "l", "o"}},
+		{lua: `Cs((##P"a" * 1 + P(1) / ".")^0), "aloal"`,
+			pat: Csubst(Rep(Seq(And(And(Lit("a"))), 1).Or(Cstring(Any(1), ".")), 0, -1)), input: "aloal", want: "a..a."},
+		{lua: `Cs((- -P"a" * 1 + P(1) / ".")^0), "aloal"`,
+			pat: Csubst(Rep(Seq(Not(Not(Lit("a"))), 1).Or(Cstring(Any(1), ".")), 0, -1)), input: "aloal", want: "a..a."},
+		{lua: `Cs((C(1) / "%1%1")^0), "abc"`,
+			pat: Csubst(Rep(Cstring(Csimple(Any(1)), "{0}{0}"), 0, -1)), input: "abc", want: "aabbcc"},
+		{lua: `(C(1) * C(1)) / "%2%1", "ab"`,
+			pat: Cstring(Seq(Csimple(Any(1)), Csimple(Any(1))), "{1}{0}"), input: "ab", want: "ba"},
+		{lua: `C(1) / "%0%0", "a"`, input: "a", want: "aa",
+			skip: "Cstring() has no format for the whole match (%0)"},
+		{lua: `(C(1)^0) / function(...) return select("#", ...) end, "abc"`,
+			pat: Cfunc(Rep(Csimple(Any(1)), 0, -1), func(caps []*CaptureResult) (interface{}, error) {
+				return len(caps), nil
+			}), input: "abc", want: 3},
+		{lua: `C(1) / {a = 1}, "a"`, input: "a", want: 1, skip: "table lookup captures are not supported"},
+		{lua: `(C(1) * C(1)) / 2, "ab"`, input: "ab", want: "b", skip: "numbered capture selection is not supported"},
+		{lua: `Ct(Cg(C(1), "x")), "a"`, pat: Ctable(Cg(Csimple(Any(1)), "x")), input: "a",
+			want: map[string]interface{}{"x": "a"}},
+		{lua: `Ct(C(1) * Cg(C(1), "x") * C(1)), "abc"`,
+			pat:   Ctable(Seq(Csimple(Any(1)), Cg(Csimple(Any(1)), "x"), Csimple(Any(1)))),
+			input: "abc", want: map[string]interface{}{"1": "a", "2": "c", "x": "b"}},
+		{lua: `Ct(Cg(C(1), "x") * Cg(C(1), "x")), "ab"`,
+			pat:   Ctable(Seq(Cg(Csimple(Any(1)), "x"), Cg(Csimple(Any(1)), "x"))),
+			input: "ab", want: map[string]interface{}{"x": "b"}},
+		{lua: `Cg(C(1), "x") * Cb"x", "a"`, input: "a", want: "a", skip: "back captures (Cb) are not supported"},
+		{lua: `Cf(C(1)^1, f), "abc"`, input: "abc", want: "abc", skip: "folding captures (Cf) are not supported"},
+		{lua: `Cmt(1, f), "a"`, input: "a", want: 2, skip: "match-time captures (Cmt) are not supported"},
+		{lua: `Carg(1), "", 1, 10`, input: "", want: 10, skip: "extra match arguments (Carg) are not supported"},
+		{lua: `P"a", "ba", 2`, input: "ba", want: 3, skip: "matching from an initial position is not supported"},
+	}
+}
+
+func TestLPegConformance(t *testing.T) {
+	for _, c := range lpegCases() {
+		t.Run(c.lua, func(t *testing.T) {
+			if c.skip != "" {
+				t.Skip(c.skip)
+			}
+			r, err, pos := Match(c.pat, c.input)
+			if n, ok := c.want.(int); ok && r == nil {
+				// LPeg positions are 1-based, and 0 stands for nil.
+				if n == 0 && err == nil {
+					t.Errorf("%q: expected failure, matched up to %d\n%v", c.input, pos, c.pat)
+				} else if n > 0 && (err != nil || pos+1 != n) {
+					t.Errorf("%q: expected end position %d, got %d (%v)\n%v", c.input, n-1, pos, err, c.pat)
+				}
+				return
+			}
+			if err != nil || fmt.Sprint(r) != fmt.Sprint(c.want) {
+				t.Errorf("%q: expected %v, got %v (%v)\n%v", c.input, c.want, r, err, c.pat)
+			}
+		})
+	}
+}
+
+// Grammars for the benchmarks.
+var (
+	benchJSON = `
+		json    <- ws value ws !.
+		value   <- object / array / string / number / 'true' / 'false' / 'null'
+		object  <- '{' ws (member (ws ',' ws member)*)? ws '}'
+		member  <- string ws ':' ws value
+		array   <- '[' ws (value (ws ',' ws value)*)? ws ']'
+		string  <- '"' ([^"\\] / '\\' .)* '"'
+		number  <- '-'? [0-9]+ ('.' [0-9]+)? ([eE] [-+]? [0-9]+)?
+		ws      <- [ \t\r\n]*
+	`
+	benchCSV = `
+		file    <- {| record* |} !.
+		record  <- {| field (',' field)* |} '\r'? '\n'
+		field   <- '"' { ([^"] / '""')* } '"' / { [^,"\r\n]* }
+	`
+	benchArith = `
+		start   <- ws expr ws !.
+		expr    <- term (ws [-+] ws term)*
+		term    <- factor (ws [*/] ws factor)*
+		factor  <- [0-9]+ / '(' ws expr ws ')'
+		ws      <- ' '*
+	`
+	benchLog = `
+		line    <- {| { [0-9.]+ } ' - ' { [^ ]+ } ' [' { [^\]]+ } '] "'
+		           { [A-Z]+ } ' ' { [^ "]+ } ' ' { [^"]+ } '" '
+		           { [0-9]+ } ' ' { [0-9]+ / '-' } |} !.
+	`
+	benchLogRegexp = regexp.MustCompile(`^([0-9.]+) - (\S+) \[([^\]]+)\] "([A-Z]+) ([^ "]+) ([^"]+)" ([0-9]+) ([0-9]+|-)$`)
+)
+
+func mustParseGrammar(b *testing.B, src string) *Pattern {
+	pat, err := ParseGrammar(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return pat
+}
+
+// Random JSON document of about `size` bytes.
+func benchJSONInput(size int) string {
+	rng := rand.New(rand.NewSource(1))
+	var value func(depth int) interface{}
+	value = func(depth int) interface{} {
+		switch n := rng.Intn(8); {
+		case n < 2 && depth < 4:
+			obj := make(map[string]interface{})
+			for i := rng.Intn(6); i >= 0; i-- {
+				obj[fmt.Sprintf("key%d", rng.Intn(100))] = value(depth + 1)
+			}
+			return obj
+		case n < 4 && depth < 4:
+			var arr []interface{}
+			for i := rng.Intn(6); i >= 0; i-- {
+				arr = append(arr, value(depth+1))
+			}
+			return arr
+		case n < 5:
+			return fmt.Sprintf("str\"%d\\n", rng.Intn(1000))
+		case n < 7:
+			return rng.NormFloat64() * 1000
+		}
+		return rng.Intn(2) == 0
+	}
+	var docs []interface{}
+	for n := 0; n < size; {
+		v := value(0)
+		data, _ := json.Marshal(v)
+		docs = append(docs, v)
+		n += len(data)
+	}
+	data, _ := json.MarshalIndent(docs, "", "  ")
+	return string(data)
+}
+
+// CSV file with `rows` rows, some with quoted fields.
+func benchCSVInput(rows int) string {
+	rng := rand.New(rand.NewSource(1))
+	var buf strings.Builder
+	for i := 0; i < rows; i++ {
+		for j := 0; j < 8; j++ {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			switch rng.Intn(4) {
+			case 0:
+				fmt.Fprintf(&buf, `"quoted, ""field"" %d"`, rng.Intn(1000))
+			case 1:
+				fmt.Fprintf(&buf, "%.3f", rng.Float64()*100)
+			default:
+				fmt.Fprintf(&buf, "field%d", rng.Intn(1000))
+			}
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.String()
+}
+
+// Arithmetic expression of about `size` bytes.
+func benchArithInput(size int) string {
+	rng := rand.New(rand.NewSource(1))
+	var buf strings.Builder
+	var expr func(depth int)
+	expr = func(depth int) {
+		for i := rng.Intn(4); ; i-- {
+			if depth < 6 && rng.Intn(3) == 0 {
+				buf.WriteString("( ")
+				expr(depth + 1)
+				buf.WriteString(" )")
+			} else {
+				fmt.Fprint(&buf, rng.Intn(10000))
+			}
+			if i == 0 {
+				return
+			}
+			buf.WriteString([]string{" + ", " - ", " * ", "/"}[rng.Intn(4)])
+		}
+	}
+	expr(0)
+	for buf.Len() < size {
+		buf.WriteString(" + ")
+		expr(0)
+	}
+	return buf.String()
+}
+
+// Log lines in the common log format.
+func benchLogInput(lines int) []string {
+	rng := rand.New(rand.NewSource(1))
+	ret := make([]string, lines)
+	for i := range ret {
+		size := "-"
+		if rng.Intn(4) > 0 {
+			size = fmt.Sprint(rng.Intn(100000))
+		}
+		ret[i] = fmt.Sprintf(`10.0.%d.%d - user%d [10/Oct/2000:13:%02d:%02d -0700] "%s /path/%d/index.html HTTP/1.1" %d %s`,
+			rng.Intn(256), rng.Intn(256), rng.Intn(100), rng.Intn(60), rng.Intn(60),
+			[]string{"GET", "POST", "HEAD"}[rng.Intn(3)], rng.Intn(1000), []int{200, 304, 404}[rng.Intn(3)], size)
+	}
+	return ret
+}
+
+// Recursive descent recognizer for benchArith.
+type arithParser struct {
+	s   string
+	pos int
+}
+
+func (p *arithParser) ws() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *arithParser) expr(ops string, next func() bool) bool {
+	if !next() {
+		return false
+	}
+	for {
+		save := p.pos
+		p.ws()
+		if p.pos >= len(p.s) || strings.IndexByte(ops, p.s[p.pos]) < 0 {
+			p.pos = save
+			return true
+		}
+		p.pos++
+		p.ws()
+		if !next() {
+			return false
+		}
+	}
+}
+
+func (p *arithParser) sum() bool  { return p.expr("+-", p.term) }
+func (p *arithParser) term() bool { return p.expr("*/", p.factor) }
+
+func (p *arithParser) factor() bool {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos > start {
+		return true
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return false
+	}
+	p.pos++
+	p.ws()
+	if !p.sum() {
+		return false
+	}
+	p.ws()
+	if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *arithParser) parse() bool {
+	p.pos = 0
+	p.ws()
+	ok := p.sum()
+	p.ws()
+	return ok && p.pos == len(p.s)
+}
+
+// Benchmark matches of the pattern, one match per iteration.
+func benchMatch(b *testing.B, pat *Pattern, inputs ...string) {
+	size := 0
+	for _, input := range inputs {
+		if _, err, pos := Match(pat, input); err != nil || pos != len(input) {
+			b.Fatalf("%q: matched up to %d: %v", input, pos, err)
+		}
+		size += len(input)
+	}
+	b.SetBytes(int64(size / len(inputs)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Match(pat, inputs[i%len(inputs)])
+	}
+}
+
+func BenchmarkJSON(b *testing.B) {
+	input := benchJSONInput(64 << 10)
+	b.Run("pego", func(b *testing.B) {
+		benchMatch(b, mustParseGrammar(b, benchJSON), input)
+	})
+	b.Run("stdlib", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !json.Valid([]byte(input)) {
+				b.Fatal("Invalid JSON")
+			}
+		}
+	})
+}
+
+func BenchmarkCSV(b *testing.B) {
+	input := benchCSVInput(1000)
+	b.Run("pego", func(b *testing.B) {
+		benchMatch(b, mustParseGrammar(b, benchCSV), input)
+	})
+	b.Run("stdlib", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := csv.NewReader(strings.NewReader(input)).ReadAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkArith(b *testing.B) {
+	input := benchArithInput(16 << 10)
+	b.Run("pego", func(b *testing.B) {
+		benchMatch(b, mustParseGrammar(b, benchArith), input)
+	})
+	b.Run("handwritten", func(b *testing.B) {
+		p := &arithParser{s: input}
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !p.parse() {
+				b.Fatal("Invalid expression")
+			}
+		}
+	})
+}
+
+func BenchmarkLog(b *testing.B) {
+	lines := benchLogInput(100)
+	b.Run("pego", func(b *testing.B) {
+		benchMatch(b, mustParseGrammar(b, benchLog), lines...)
+	})
+	b.Run("regexp", func(b *testing.B) {
+		size := 0
+		for _, line := range lines {
+			size += len(line)
+		}
+		b.SetBytes(int64(size / len(lines)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if benchLogRegexp.FindStringSubmatch(lines[i%len(lines)]) == nil {
+				b.Fatal("No match")
+			}
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	for _, p := range binaryTestPatterns() {
+		if err := Verify(p); err != nil {
+			t.Errorf("%v\n%v", err, p)
+		}
+		for _, input := range binaryTestInputs {
+			r, err, pos := Match(p, input)
+			r2, err2, pos2 := MatchWithOptions(p, input, &MatchOptions{Verified: true})
+			if !sameResult(r, err, pos, r2, err2, pos2) {
+				t.Errorf("%q: expected %v %v %d, got %v %v %d\n%v", input, r, err, pos, r2, err2, pos2, p)
+			}
+		}
+	}
+	for _, c := range lpegCases() {
+		if c.pat != nil {
+			if err := Verify(c.pat); err != nil {
+				t.Errorf("%s: %v\n%v", c.lua, err, c.pat)
+			}
+		}
+	}
+	// The optimizer drops the code after an automaton that never
+	// accepts, like the close of this capture.
+	pat, _ := (&patternFuzzer{[]byte("98\xff")}).pattern(0)
+	never := CompileDFA(Optimize(pat))
+	if _, ok := (*never)[1].(*IDFA); !ok {
+		t.Errorf("Expected an automaton in\n%v", never)
+	} else if err := Verify(never); err != nil {
+		t.Errorf("%v\n%v", err, never)
+	}
+
+	tests := []struct {
+		pat *Pattern
+		err string
+	}{
+		{&Pattern{&IChar{'a'}}, "Pattern does not end with End"},
+		{&Pattern{&IJump{5}, &IEnd{}}, "Instruction 0: jump target 5 out of range"},
+		{&Pattern{&ICommit{1}, &IEnd{}}, "Instruction 0: Commit +1 without a failure address on the stack"},
+		{&Pattern{&IChoice{2}, &IChar{'a'}, &IEnd{}}, "Instruction 2: End with entries or open captures left"},
+		{&Pattern{&IPopCounter{}, &IEnd{}}, "Instruction 0: PopCounter without a counter on the stack"},
+		{&Pattern{&IChoice{3}, &IChar{'a'}, &IPartialCommit{-2}, &IEnd{}}, "Instruction 0: reached with different stacks"},
+		{&Pattern{&IOpenCapture{}, &IEnd{}}, "Instruction 1: End with entries or open captures left"},
+		{&Pattern{&ICloseCapture{}, &IEnd{}}, "Instruction 0: Capture close +0 without an open capture"},
+		{&Pattern{&IReturn{}, &IEnd{}}, "Instruction 0: Return outside of a rule"},
+		{&Pattern{&ICall{2, "A"}, &IJump{3}, &IPushCounter{}, &IReturn{}, &IEnd{}}, "Instruction 3: Return with entries or open captures left by the rule"},
+		{Ref("A"), `Instruction 0: OpenCall "A" is not resolved`},
+	}
+	for _, test := range tests {
+		if err := Verify(test.pat); err == nil || err.Error() != test.err {
+			t.Errorf("Expected %q, got %v\n%v", test.err, err, test.pat)
+		}
+	}
+}
+
+func TestDecompile(t *testing.T) {
+	// Parsing the decompiled source must give a pattern that decompiles
+	// to the same source, and matches the same way. Rules of grammars
+	// are laid out in random order, so the code may differ.
+	var pats []*Pattern
+	var inputs []string
+	for _, src := range []string{benchJSON, benchCSV, benchArith, benchLog} {
+		pat, err := ParseGrammar(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pats = append(pats, pat)
+		inputs = append(inputs, "")
+	}
+	inputs[0] = benchJSONInput(2)
+	// LPeg cases using what the notation has no syntax for: the
+	// predicates in B, the empty literal, constants, and the string,
+	// function, table and group captures.
+	unwritable := map[string]bool{
+		`b * -1, "(al())()"`:                                      true,
+		`b * -1, "((al())()(é))"`:                                 true,
+		`basiclookfor((#P(b) * 1) * Cp()), "  (  (a)"`:            true,
+		`{"S", S = "a" * V"S" * "b" + ""} * -1, "aabb"`:           true,
+		`{basiclookfor(C(letter^1))^0}, " two words, one more  "`: true,
+		`{C(digit^1 * Cc"d") + C(letter^1 * Cc"l")}, "123"`:       true,
+		`Cc(10), "x"`: true,
+		`Cs((##P"a" * 1 + P(1) / ".")^0), "aloal"`:                    true,
+		`Cs((- -P"a" * 1 + P(1) / ".")^0), "aloal"`:                   true,
+		`Cs((C(1) / "%1%1")^0), "abc"`:                                true,
+		`(C(1) * C(1)) / "%2%1", "ab"`:                                true,
+		`(C(1)^0) / function(...) return select("#", ...) end, "abc"`: true,
+		`Ct(Cg(C(1), "x")), "a"`:                                      true,
+		`Ct(C(1) * Cg(C(1), "x") * C(1)), "abc"`:                      true,
+		`Ct(Cg(C(1), "x") * Cg(C(1), "x")), "ab"`:                     true,
+	}
+	names := make([]string, len(pats))
+	for _, c := range lpegCases() {
+		if c.pat != nil {
+			pats = append(pats, c.pat)
+			inputs = append(inputs, c.input)
+			names = append(names, c.lua)
+		}
+	}
+	for i, pat := range pats {
+		src, err := Decompile(pat)
+		if unwritable[names[i]] {
+			if err == nil || !strings.HasSuffix(err.Error(), "can not be written in PEG notation") {
+				t.Errorf("%s: expected it can not be written in PEG notation, got %v\n%s", names[i], err, src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", names[i], err)
+			continue
+		}
+		pat2, err := ParseGrammar(src)
+		if err != nil {
+			t.Errorf("%v\n%s", err, src)
+			continue
+		}
+		if src2, _ := Decompile(pat2); src2 != src {
+			t.Errorf("Decompiled to\n%s\nthen to\n%s", src, src2)
+		}
+		r, err, pos := Match(pat, inputs[i])
+		r2, err2, pos2 := Match(pat2, inputs[i])
+		if !sameResult(r, err, pos, r2, err2, pos2) {
+			t.Errorf("%s on %q: expected %v %v %d, got %v %v %d", src, inputs[i], r, err, pos, r2, err2, pos2)
+		}
+	}
+
+	src, err := Decompile(Grm("S", map[string]*Pattern{
+		"S": Seq(Clist(Rep(Ref("A"), 0, -1)), Not(Any(1))),
+		"A": Or(Csimple(Rep(Set("abc"), 2, 4)), Seq("x", Cposition())),
+	}))
+	want := "S <- {| A* |} !.\nA <- { [a-c] [a-c] [a-c]^-2 } / 'x' {}"
+	if err != nil || src != want {
+		t.Errorf("Expected\n%s\ngot %v\n%s", want, err, src)
+	}
+
+	_, rules, err := ParseRules("A <- 'a' B\nB <- 'b'\nC <- 'c'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err = DecompileGrammar("A", rules)
+	want = "A <- 'a' B\nB <- 'b'\nC <- 'c'"
+	if err != nil || src != want {
+		t.Errorf("Expected\n%s\ngot %v\n%s", want, err, src)
+	}
+
+	src, err = Decompile(Seq("a", Csubst(Lit("b"))))
+	if err == nil || err.Error() != "subst{ 'b' } can not be written in PEG notation" {
+		t.Errorf("Unexpected error %v for %s", err, src)
+	}
+}
+
+func TestRailroad(t *testing.T) {
+	pat, err := ParseGrammar(benchJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagrams := Railroad(pat)
+	for _, name := range []string{"json", "value", "object", "array", "member", "string", "number", "ws"} {
+		if diagrams[name] == nil {
+			t.Errorf("No diagram for %s", name)
+		}
+	}
+	if len(diagrams) != 8 {
+		t.Errorf("Expected 8 diagrams, got %d", len(diagrams))
+	}
+	for name, svg := range diagrams {
+		d := xml.NewDecoder(bytes.NewReader(svg))
+		for {
+			if _, err := d.Token(); err != nil {
+				if err != io.EOF {
+					t.Errorf("%s: %v\n%s", name, err, svg)
+				}
+				break
+			}
+		}
+	}
+	for _, s := range []string{`href="member.svg"`, `&#39;{&#39;`, `class="title">object<`} {
+		if !bytes.Contains(diagrams["object"], []byte(s)) {
+			t.Errorf("Expected %q in\n%s", s, diagrams["object"])
+		}
+	}
+
+	diagrams = Railroad(Seq(Not(Lit("<")), Rep(Lit("ab"), 2, 4), Csimple(Rep(Set("xyz"), 0, -1))))
+	if len(diagrams) != 1 || diagrams[""] == nil {
+		t.Fatalf("Expected one diagram, got %v", diagrams)
+	}
+	for _, s := range []string{"&#39;&lt;&#39;", ">not<", ">0 to 2<", ">simple<", "[x-z]"} {
+		if !bytes.Contains(diagrams[""], []byte(s)) {
+			t.Errorf("Expected %q in\n%s", s, diagrams[""])
+		}
+	}
+}
+
+func TestDot(t *testing.T) {
+	pat, err := ParseGrammar(`S <- {| A |} !.
+		A <- { [^()"\\]* (B [^()]*)* }
+		B <- '(' A ')'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Grm lays the rules out in any order, so find where they are.
+	var ruleS, ruleA *Rule
+	var cluster int
+	rules := Rules(pat)
+	for i := range rules {
+		switch rules[i].Name {
+		case "S":
+			ruleS = &rules[i]
+		case "A":
+			ruleA, cluster = &rules[i], i
+		}
+	}
+	if ruleS == nil || ruleA == nil {
+		t.Fatalf("Expected rules S and A, got %v", rules)
+	}
+	dot := Dot(pat)
+	for _, s := range []string{
+		"digraph pego {\n",
+		fmt.Sprintf("\tsubgraph cluster_%d {\n\t\tlabel=\"A\";\n", cluster),
+		fmt.Sprintf(`b%d [label="%d  Capture open +0 (simple)\l%d  ISpan [^ \" ( ) \\\l"];`, ruleA.Start, ruleA.Start, ruleA.Start+1),
+		fmt.Sprintf("b0 -> b%d [color=blue label=\"call S\"];\n\tb0 -> b1 [style=dashed label=return];\n", ruleS.Start),
+		fmt.Sprintf("b1 -> b%d;\n", len(*pat)-1),
+		fmt.Sprintf("b%d -> b%d [style=dashed color=red label=fail];\n", ruleA.Start+2, ruleA.Start+6),
+		fmt.Sprintf("b%d -> b%d [label=\"Commit\"];\n", ruleA.Start+4, ruleA.Start+2),
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("Expected %q in\n%s", s, dot)
+		}
+	}
+	// Each instruction is in exactly one block.
+	for pc := range *pat {
+		if n := strings.Count(dot, fmt.Sprintf("\\l%d  ", pc)) + strings.Count(dot, fmt.Sprintf("\"%d  ", pc)); n != 1 {
+			t.Errorf("Instruction %d is in %d blocks", pc, n)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	key := Cg(Csimple(Rep(Range("az"), 1, -1)), "key")
+	pair := Seq(key, "=", Cg(Rep(Range("09"), 1, -1), "value"))
+	tests := []struct {
+		pat   *Pattern
+		input string
+		want  interface{}
+	}{
+		{Ctable(pair), "ab=12", map[string]interface{}{"key": "ab", "value": "12"}},
+		{Ctable(Seq(Csimple(Any(1)), pair, Csimple(Any(1)))), "<a=1>",
+			map[string]interface{}{"1": "<", "2": ">", "key": "a", "value": "1"}},
+		// Later groups replace earlier ones with the same name.
+		{Ctable(Rep(Seq(pair, Rep(Lit(","), 0, 1)), 0, -1)), "a=1,b=2",
+			map[string]interface{}{"key": "b", "value": "2"}},
+		{Ctable(Cg(Seq(Cposition(), "x"), "pos")), "x", map[string]interface{}{"pos": 0}},
+		{Ctable(Rep(Clist(Ctable(pair)), 0, -1)), "a=1",
+			map[string]interface{}{"1": []interface{}{map[string]interface{}{"key": "a", "value": "1"}}}},
+		// Lists leave named groups out.
+		{Clist(Seq(Csimple(Any(1)), pair)), "<a=1", []interface{}{"<"}},
+		{Cg(Any(1), "x"), "y", "y"},
+	}
+	for _, test := range tests {
+		r, err, _ := Match(test.pat, test.input)
+		if err != nil || !reflect.DeepEqual(r, test.want) {
+			t.Errorf("%q: expected %#v, got %#v %v", test.input, test.want, r, err)
+		}
+	}
+	r, _, _ := Match(Ctable(pair), "x=1")
+	if data, err := json.Marshal(r); err != nil || string(data) != `{"key":"x","value":"1"}` {
+		t.Errorf("Unexpected JSON %s %v", data, err)
+	}
+}
+
+type unmarshalPerson struct {
+	Name    string            `pego:"name"`
+	Age     uint8             `pego:"age"`
+	Score   *float64          `pego:"score"`
+	Born    time.Time         `pego:"born,layout=2006-01-02"`
+	Admin   bool              `pego:"admin"`
+	Tags    []string          `pego:"tags"`
+	Extra   map[string]string `pego:"extra"`
+	Initial string            `pego:"1"`
+	Skipped int               `pego:"-"`
+	Any     interface{}
+}
+
+func TestUnmarshal(t *testing.T) {
+	val := Rep(NegSet(";,"), 0, -1)
+	field := func(name string, p *Pattern) *Pattern {
+		return Rep(Seq(name, "=", Cg(p, name), Rep(Lit(";"), 0, 1)), 0, 1)
+	}
+	pat := Ctable(Seq(Csimple(Any(1)), ":",
+		field("name", val), field("age", val), field("score", val), field("born", val),
+		field("admin", val), field("tags", Clist(Seq(Csimple(val), Rep(Seq(",", Csimple(val)), 0, -1)))),
+		field("extra", Ctable(Cg(val, "k"))), field("Any", Cposition())))
+
+	input := "x:name=Bob;age=42;score=2.5;born=2001-02-03;admin=true;tags=a,b;extra=z;Any="
+	score := 2.5
+	want := unmarshalPerson{Name: "Bob", Age: 42, Score: &score, Born: time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC),
+		Admin: true, Tags: []string{"a", "b"}, Extra: map[string]string{"k": "z"}, Initial: "x", Any: len(input)}
+	for _, spans := range []bool{false, true} {
+		r, err, _ := MatchWithOptions(pat, input, &MatchOptions{Spans: spans})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := unmarshalPerson{Skipped: 7}
+		want.Skipped = 7
+		if err := Unmarshal(r, &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %+v, got %+v %v", want, got, err)
+		}
+	}
+
+	r, _, _ := MatchWithOptions(pat, "x:name=Bob;age=300", &MatchOptions{Spans: true})
+	var p *unmarshalPerson
+	if err := Unmarshal(r, &p); err == nil || err.Error() != `15-18: Age: Can not convert "300" to uint8` {
+		t.Errorf("Unexpected error %v", err)
+	}
+	r, _, _ = Match(pat, "x:name=Bob;age=300")
+	err := Unmarshal(r, &p)
+	if e, ok := err.(*UnmarshalError); !ok || e.Start != -1 || e.Error() != `Age: Can not convert "300" to uint8` {
+		t.Errorf("Unexpected error %v", err)
+	}
+	r, _, _ = Match(pat, "x:tags=a,b")
+	if err := Unmarshal(r, &p); err != nil || !reflect.DeepEqual(p.Tags, []string{"a", "b"}) {
+		t.Errorf("Unexpected %+v %v", p, err)
+	}
+	var bad struct {
+		Tags string `pego:"tags"`
+	}
+	if err := Unmarshal(r, &bad); err == nil || err.Error() != `Tags: Can not store []interface {} in string` {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	r, _, _ = MatchWithOptions(Clist(Seq(Csimple(Any(1)), Cg(Any(1), "x"), Csimple(Any(1)))), "abc", &MatchOptions{Spans: true})
+	var pair [2]string
+	if err := Unmarshal(r, &pair); err != nil || pair != [2]string{"a", "c"} {
+		t.Errorf("Unexpected %v %v", pair, err)
+	}
+	n := r.(*CaptureNode)
+	if n.Start != 0 || n.End != 3 || len(n.Subs) != 3 || n.Subs[1].Name != "x" || n.Subs[2].Start != 2 {
+		t.Errorf("Unexpected node %+v", n)
+	}
+}
+
+type buildProgram struct {
+	Stmts []*buildStmt `pego:"@@*"`
+}
+
+type buildStmt struct {
+	Let   bool       `pego:"(@'let')?"`
+	Name  string     `pego:"@Ident '='"`
+	Value *buildExpr `pego:"@@ ';'"`
+}
+
+type buildExpr struct {
+	Terms []buildTerm `pego:"@@ ('+' @@)*"`
+}
+
+type buildTerm struct {
+	Num  *int       `pego:"(@Int)?"`
+	Name string     `pego:"(@Ident)?"`
+	Sub  *buildExpr `pego:"('(' @@ ')')?"`
+	Pos  int
+}
+
+type buildFlag struct {
+	Name string `pego:"@[a-z]+"`
+	Loud bool   `pego:"@'!'?"`
+}
+
+type buildBad struct {
+	Name []byte `pego:"@Name"`
+}
+
+func TestBuild(t *testing.T) {
+	const rules = `
+		Space <- [ \t\n]*
+		Ident <- [a-z]+
+		Int   <- [0-9]+
+	`
+	parser, err := Build[buildProgram](rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(parser.Pattern()); err != nil {
+		t.Error(err)
+	}
+	r, err := parser.Parse(" let x = 1 + (y + 22);\nz=x ; ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := 1, 22
+	want := &buildProgram{[]*buildStmt{
+		{true, "x", &buildExpr{[]buildTerm{{Num: &one}, {Sub: &buildExpr{[]buildTerm{{Name: "y"}, {Num: &two}}}}}}},
+		{false, "z", &buildExpr{[]buildTerm{{Name: "x"}}}},
+	}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Expected %s, got %s", toJSON(want), toJSON(r))
+	}
+	flag, err := Build[buildFlag]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for input, loud := range map[string]bool{"hey!": true, "hey": false} {
+		if r, err := flag.Parse(input); err != nil || *r != (buildFlag{"hey", loud}) {
+			t.Errorf("%q: expected Loud %v, got %+v %v", input, loud, r, err)
+		}
+	}
+
+	for _, c := range []struct {
+		input, msg string
+	}{
+		{"x = 1", `5: Unexpected end of input`},
+		{"let x 1;", `6: Unexpected "1"`},
+		{"x = 1; y", `8: Unexpected end of input`},
+		{"x = (1 + 2;", `10: Unexpected ";"`},
+	} {
+		r, err := parser.Parse(c.input)
+		if e, ok := err.(*ParseError); !ok || e.Error() != c.msg {
+			t.Errorf("%q: expected %s, got %s %v", c.input, c.msg, toJSON(r), err)
+		}
+	}
+	if _, err := parser.Parse("x = 99999999999999999999;"); err == nil || err.Error() != `4-24: Stmts[0].Value.Terms[0].Num: Can not convert "99999999999999999999" to int` {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	for _, c := range []struct {
+		err error
+		msg string
+	}{
+		{func() error { _, err := Build[buildProgram](); return err }(), `pego.buildStmt.Name: Undefined rule "Ident"`},
+		{func() error { _, err := Build[buildBad]("Name <- 'a' buildBad <- 'b'"); return err }(), `Rule "buildBad" defined twice`},
+		{func() error { _, err := Build[int](); return err }(), `int is not a struct`},
+		{func() error { _, err := Build[buildProgram](rules, "Input <- 'x'"); return err }(), `Rule "Input" is reserved`},
+		{func() error { _, err := Build[buildStmt]("Ident <- [a-z]+ Int <- [0-9]+"); return err }(), ``},
+		{func() error {
+			_, err := Build[struct {
+				A string `pego:"@@"`
+			}]()
+			return err
+		}(), `struct { A string "pego:\"@@\"" } has no name`},
+	} {
+		if fmt.Sprint(c.err) != c.msg && !(c.err == nil && c.msg == "") {
+			t.Errorf("Expected %q, got %v", c.msg, c.err)
+		}
+	}
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestCfn(t *testing.T) {
+	digits := Csimple(Rep(Range("09"), 1, -1))
+	type point struct{ X, Y int }
+	for _, c := range []struct {
+		pat   *Pattern
+		input string
+		want  interface{}
+		err   string
+	}{
+		{Cfn(Seq(digits, "+", digits), func(a, b int) int { return a + b }), "12+30", 42, ""},
+		{Cfn(Seq(digits, "+", digits), func(a, b int8) int8 { return a + b }), "300+1", nil,
+			`0-3: Argument 1: Can not convert "300" to int8`},
+		{Cfn(Seq(digits, Cposition()), func(s string, pos float64) string { return fmt.Sprint(s, " ", pos) }), "12", "12 2", ""},
+		{Cfn(Rep(Seq(digits, Rep(Lit(","), 0, 1)), 0, -1), func(ns ...uint) (sum uint) {
+			for _, n := range ns {
+				sum += n
+			}
+			return
+		}), "1,2,3", uint(6), ""},
+		{Cfn(Ctable(Seq(Cg(digits, "X"), ",", Cg(digits, "Y"))), func(p point) (int, error) {
+			if p.Y == 0 {
+				return 0, errors.New("Division by zero")
+			}
+			return p.X / p.Y, nil
+		}), "7,2", 3, ""},
+		{Cfn(Ctable(Seq(Cg(digits, "X"), ",", Cg(digits, "Y"))), func(p *point) (int, error) {
+			return 0, errors.New("Division by zero")
+		}), "7,0", nil, "Division by zero"},
+		{Cfn(Clist(Rep(Seq(digits, Rep(Lit(","), 0, 1)), 0, -1)), func(l []string) string {
+			return strings.Join(l, "-")
+		}), "1,22", "1-22", ""},
+		{Cfn(Seq(Clist(Rep(Csimple(Range("az")), 0, -1)), Cg(Any(1), "g")), func(r *CaptureResult, l ...*CaptureResult) string {
+			return fmt.Sprintln(r.Start(), r.End(), r.Value(), l[0].Name(), l[0].Value())
+		}), "ab1", "0 2 [a b] g 1\n", ""},
+		{Cfn(Rep(digits, 0, -1).Or(Lit("x")), func(s string) {}), "x", nil, "Cfn: func(string) can not take 0 captures"},
+	} {
+		r, err, _ := Match(c.pat, c.input)
+		if fmt.Sprint(err) != c.err && !(err == nil && c.err == "") || !reflect.DeepEqual(r, c.want) {
+			t.Errorf("%q: Expected %#v %q, got %#v %v", c.input, c.want, c.err, r, err)
+		}
+	}
+
+	for _, c := range []struct {
+		f   func()
+		msg string
+	}{
+		{func() { Cfn(digits, 1) }, "Cfn: int is not a function"},
+		{func() { Cfn(digits, func(string) (int, int) { return 0, 0 }) }, "Cfn: func(string) (int, int) should return a value, an error, or both"},
+		{func() { Cfn(Seq(digits, digits), func(string) {}) }, "Cfn: func(string) can not take 2 captures"},
+		{func() { Cfn(Clist(digits), func(string) {}) }, "Cfn: capture 1 of type []interface {} does not fit argument of type string"},
+		{func() { Cfn(Cposition(), func(point) {}) }, "Cfn: capture 1 of type int does not fit argument of type pego.point"},
+	} {
+		func() {
+			defer func() {
+				if e := recover(); fmt.Sprint(e) != c.msg {
+					t.Errorf("Expected panic %q, got %v", c.msg, e)
+				}
+			}()
+			c.f()
+		}()
+	}
+}
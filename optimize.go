@@ -0,0 +1,366 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+// Rules with at most this many instructions are inlined.
+const maxInline = 8
+
+// Optimize a pattern. The result matches the same inputs with the same
+// captures as `p`, but with fewer instructions to execute.
+func Optimize(p *Pattern) *Pattern {
+	code := make(Pattern, len(*p))
+	copy(code, *p)
+	// Each pass returns whether it changed anything. Keep going until
+	// none of them do. The limit is only a safeguard.
+	for n := 0; n < 100; n++ {
+		changed := threadJumps(code)
+		changed = tailCalls(code) || changed
+		changed = dropChoices(code) || changed
+		changed = mergeCharsets(code) || changed
+		changed = foldSpans(code) || changed
+		var inlined bool
+		code, inlined = inlineCalls(code)
+		var removed bool
+		code, removed = removeDead(code)
+		if !changed && !inlined && !removed {
+			break
+		}
+	}
+	return &code
+}
+
+// Index of the instruction actually executed when jumping to `t`,
+// following jumps and skipping no-ops.
+func finalTarget(code Pattern, t int) int {
+	for n := 0; n < len(code) && 0 <= t && t < len(code); n++ {
+		switch op := code[t].(type) {
+		case nil:
+			t++
+		case *IJump:
+			t += op.offset
+		default:
+			return t
+		}
+	}
+	return t
+}
+
+// Number of jumps to each instruction, including calls returning to it.
+func jumpTargets(code Pattern) map[int]int {
+	targets := make(map[int]int)
+	for i, op := range code {
+		if offset, ok := jumpOffset(op); ok {
+			targets[i+offset]++
+		}
+		if _, ok := op.(*ICall); ok {
+			targets[i+1]++
+		}
+	}
+	return targets
+}
+
+// Retarget jumps to jumps, and replace jumps to returns with returns.
+func threadJumps(code Pattern) bool {
+	changed := false
+	for i, op := range code {
+		offset, ok := jumpOffset(op)
+		if !ok {
+			continue
+		}
+		t := finalTarget(code, i+offset)
+		if t < 0 || t >= len(code) {
+			continue
+		}
+		if _, ok := op.(*IJump); ok {
+			if _, ok := code[t].(*IReturn); ok {
+				code[i] = &IReturn{}
+				changed = true
+				continue
+			}
+			if finalTarget(code, i+1) == t {
+				code[i] = nil
+				changed = true
+				continue
+			}
+		}
+		if t != i+offset {
+			code[i] = withOffset(op, t-i)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Replace calls that are immediately followed by a return with jumps.
+func tailCalls(code Pattern) bool {
+	changed := false
+	for i, op := range code {
+		if op, ok := op.(*ICall); ok {
+			t := finalTarget(code, i+1)
+			if t < len(code) {
+				if _, ok := code[t].(*IReturn); ok {
+					code[i] = &IJump{op.offset}
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// Can the instruction never fail?
+func cannotFail(op Instruction) bool {
+	switch op.(type) {
+	case nil, *ISpan, *IOpenCapture, *ICloseCapture, *IFullCapture, *IEmptyCapture:
+		return true
+	}
+	return false
+}
+
+// Remove choices around patterns that can never fail.
+func dropChoices(code Pattern) bool {
+	changed := false
+	targets := jumpTargets(code)
+	for i, op := range code {
+		if _, ok := op.(*IChoice); !ok {
+			continue
+		}
+		j := i + 1
+		for j < len(code) && cannotFail(code[j]) && targets[j] == 0 {
+			j++
+		}
+		if j < len(code) && targets[j] == 0 {
+			if op, ok := code[j].(*ICommit); ok {
+				code[i] = nil
+				code[j] = &IJump{op.offset}
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// The set of characters matched by a single-character instruction.
+func byteset(op Instruction) (*ICharset, bool) {
+	switch op := op.(type) {
+	case *ICharset:
+		return op, true
+	case *IChar:
+		set := &ICharset{}
+		set.add(op.char, op.char)
+		return set, true
+	case *IKeywords:
+		set := &ICharset{}
+		for _, w := range op.words {
+			if len(w) != 1 {
+				return nil, false
+			}
+			set.add(w[0], w[0])
+		}
+		return set, true
+	}
+	return nil, false
+}
+
+// Replace choices between single characters with a charset.
+func mergeCharsets(code Pattern) bool {
+	changed := false
+	targets := jumpTargets(code)
+	for i := len(code) - 1; i >= 0; i-- {
+		switch op := code[i].(type) {
+		case *IKeywords:
+			if set, ok := byteset(op); ok {
+				code[i] = set
+				changed = true
+			}
+		case *IChoice:
+			// Only this choice may jump to the second alternative.
+			if op.offset != 3 || i+4 >= len(code) || targets[i+1] > 0 || targets[i+2] > 0 || targets[i+3] > 1 {
+				continue
+			}
+			commit, ok := code[i+2].(*ICommit)
+			if !ok || commit.offset != 2 {
+				continue
+			}
+			a, ok := byteset(code[i+1])
+			if !ok {
+				continue
+			}
+			b, ok := byteset(code[i+3])
+			if !ok {
+				continue
+			}
+			set := &ICharset{}
+			for k := range set.chars {
+				set.chars[k] = a.chars[k] | b.chars[k]
+			}
+			code[i] = set
+			code[i+1], code[i+2], code[i+3] = nil, nil, nil
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Replace repetitions of a charset with a span.
+func foldSpans(code Pattern) bool {
+	changed := false
+	targets := jumpTargets(code)
+	// Are the jumps to code[i+1:] exactly the expected internal ones?
+	internal := func(i int, counts ...int) bool {
+		for k, n := range counts {
+			if targets[i+1+k] != n {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range code {
+		if i+5 < len(code) && internal(i, 1, 0, 0, 1, 1) {
+			// PushCounter; Choice +4; Charset; Commit +1; Loop -3 x n; PopCounter
+			_, push := code[i].(*IPushCounter)
+			choice, _ := code[i+1].(*IChoice)
+			set, _ := code[i+2].(*ICharset)
+			commit, _ := code[i+3].(*ICommit)
+			loop, _ := code[i+4].(*ILoop)
+			_, pop := code[i+5].(*IPopCounter)
+			if push && pop && set != nil && choice != nil && choice.offset == 4 &&
+				commit != nil && commit.offset == 1 && loop != nil && loop.offset == -3 {
+				code[i] = &ISpan{*set, loop.count}
+				code[i+1], code[i+2], code[i+3], code[i+4], code[i+5] = nil, nil, nil, nil, nil
+				changed = true
+				continue
+			}
+		}
+		if i+3 < len(code) && internal(i, 0, 0, 1) {
+			// Choice +3; Charset; Commit -2
+			choice, _ := code[i].(*IChoice)
+			set, _ := code[i+1].(*ICharset)
+			commit, _ := code[i+2].(*ICommit)
+			if choice != nil && choice.offset == 3 && set != nil && commit != nil && commit.offset == -2 {
+				code[i] = &ISpan{*set, -1}
+				code[i+1], code[i+2] = nil, nil
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// Body of the rule starting at `t`, if it is small enough to be inlined
+// and does not call other rules.
+func inlineBody(code Pattern, t int) (Pattern, bool) {
+	r := t
+	for ; r < len(code); r++ {
+		if _, ok := code[r].(*IReturn); ok {
+			break
+		}
+		if r-t >= maxInline {
+			return nil, false
+		}
+	}
+	if t < 0 || r >= len(code) {
+		return nil, false
+	}
+	for i := t; i < r; i++ {
+		switch code[i].(type) {
+		case *ICall, *IOpenCall, *IEnd, *IGiveUp:
+			return nil, false
+		}
+		// Jumps must stay within the body.
+		if offset, ok := jumpOffset(code[i]); ok && (i+offset < t || i+offset > r) {
+			return nil, false
+		}
+	}
+	return code[t:r], true
+}
+
+// Inline calls to small rules.
+func inlineCalls(code Pattern) (Pattern, bool) {
+	inline := make(map[int]Pattern)
+	for i, op := range code {
+		if op, ok := op.(*ICall); ok {
+			if body, ok := inlineBody(code, i+op.offset); ok {
+				inline[i] = body
+			}
+		}
+	}
+	if len(inline) == 0 {
+		return code, false
+	}
+	keep := make([]bool, len(code))
+	for i := range keep {
+		keep[i] = true
+	}
+	return relocate(code, keep, inline), true
+}
+
+// Remove no-ops and unreachable instructions.
+func removeDead(code Pattern) (Pattern, bool) {
+	keep := make([]bool, len(code))
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i < 0 || i >= len(code) || keep[i] {
+			continue
+		}
+		keep[i] = true
+		if offset, ok := jumpOffset(code[i]); ok {
+			work = append(work, i+offset)
+		}
+		if fallsThrough(code[i]) {
+			work = append(work, i+1)
+		}
+	}
+	removed := false
+	for i, op := range code {
+		if op == nil {
+			keep[i] = false
+		}
+		// The last instruction is where embedding patterns continue.
+		if i == len(code)-1 {
+			keep[i] = true
+		}
+		if !keep[i] {
+			removed = true
+		}
+	}
+	if !removed {
+		return code, false
+	}
+	return relocate(code, keep, nil), true
+}
+
+// Rebuild the code without the instructions not in `keep`, and with
+// calls replaced by the bodies in `inline`. Jumps to removed
+// instructions continue on the next kept instruction.
+func relocate(code Pattern, keep []bool, inline map[int]Pattern) Pattern {
+	pos := make([]int, len(code)+1)
+	n := 0
+	for i := range code {
+		pos[i] = n
+		if body, ok := inline[i]; ok {
+			n += len(body)
+		} else if keep[i] {
+			n++
+		}
+	}
+	pos[len(code)] = n
+	ret := make(Pattern, 0, n)
+	for i, op := range code {
+		if body, ok := inline[i]; ok {
+			// Jumps within the body keep their relative offsets.
+			ret = append(ret, body...)
+			continue
+		}
+		if !keep[i] {
+			continue
+		}
+		if offset, ok := jumpOffset(op); ok && 0 <= i+offset && i+offset <= len(code) {
+			op = withOffset(op, pos[i+offset]-pos[i])
+		}
+		ret = append(ret, op)
+	}
+	return ret
+}
@@ -70,6 +70,11 @@ func (p *Pattern) Cfunc(f func([]*CaptureResult) (interface{}, error)) *Pattern
 	return Cfunc(p, f)
 }
 
+// A function capture of this pattern, with any function.
+func (p *Pattern) Cfn(f interface{}) *Pattern {
+	return Cfn(p, f)
+}
+
 // A string capture of this pattern.
 func (p *Pattern) Cstring(format string) *Pattern {
 	return Cstring(p, format)
@@ -80,6 +85,16 @@ func (p *Pattern) Csubst() *Pattern {
 	return Csubst(p)
 }
 
+// A table capture of this pattern.
+func (p *Pattern) Ctable() *Pattern {
+	return Ctable(p)
+}
+
+// A named group capture of this pattern.
+func (p *Pattern) Cg(name string) *Pattern {
+	return Cg(p, name)
+}
+
 // A sequence of values, instructions and other patterns.
 // (See Seq2)
 func Seq(args ...interface{}) *Pattern {
@@ -124,11 +139,14 @@ func Seq2(args []interface{}) *Pattern {
 			ret[pos] = &IChoice{offsets[i+v.offset] - pos}
 			pos++
 		case *ICall:
-			ret[pos] = &ICall{offsets[i+v.offset] - pos}
+			ret[pos] = &ICall{offsets[i+v.offset] - pos, v.name}
 			pos++
 		case *ICommit:
 			ret[pos] = &ICommit{offsets[i+v.offset] - pos}
 			pos++
+		case *ILoop:
+			ret[pos] = &ILoop{offsets[i+v.offset] - pos, v.count}
+			pos++
 		case Instruction:
 			ret[pos] = v
 			pos++
@@ -172,14 +190,44 @@ func issucc(p *Pattern) bool {
 	_, ok := (*p)[0].(*IEnd)
 	return ok
 }
+func ischarset(p *Pattern) (*ICharset, bool) {
+	if len(*p) != 2 {
+		return nil, false
+	}
+	op, ok := (*p)[0].(*ICharset)
+	return op, ok
+}
+
+// The literal strings matched by p, if p is a literal or a keyword set.
+func literals(p *Pattern) ([]string, bool) {
+	if op, ok := (*p)[0].(*IKeywords); ok && len(*p) == 2 {
+		return op.words, true
+	}
+	word := make([]byte, len(*p)-1)
+	for i := range word {
+		op, ok := (*p)[i].(*IChar)
+		if !ok {
+			return nil, false
+		}
+		word[i] = op.char
+	}
+	return []string{string(word)}, true
+}
 
 // Ordered choice of p1 and p2
+// A choice between literals is compiled into a keyword set.
 func Or(p1, p2 *Pattern) *Pattern {
 	if isfail(p1) {
 		return p2
 	} else if issucc(p1) || isfail(p2) {
 		return p1
 	}
+	if w1, ok := literals(p1); ok {
+		if w2, ok := literals(p2); ok {
+			words := make([]string, 0, len(w1)+len(w2))
+			return Keywords(append(append(words, w1...), w2...)...)
+		}
+	}
 	return Seq(
 		&IChoice{3},
 		p1,
@@ -190,37 +238,65 @@ func Or(p1, p2 *Pattern) *Pattern {
 
 // Repeat pattern between `min` and `max` times.
 // max == -1 means unlimited.
+// Large bounds are compiled into counted loops, so the size of the
+// result does not grow with `min` and `max`.
 func Rep(p *Pattern, min, max int) *Pattern {
-	var size int
-	if max < 0 {
-		size = min + 3
-	} else {
-		size = min + 2*(max-min) + 1
-	}
-	args := make([]interface{}, size)
-	for i := 0; i < min; i++ {
-		args[i] = p
+	args := repCount(p, min)
+	if cs, ok := ischarset(p); ok {
+		// Greedy repetition of a charset never backtracks, so the
+		// optional part can be done with a single span.
+		if max < 0 {
+			args = append(args, &ISpan{*cs, -1})
+		} else if max > min {
+			args = append(args, &ISpan{*cs, max - min})
+		}
+		return Seq2(args)
 	}
-	pos := min
 	if max < 0 {
-		args[pos+0] = &IChoice{3}
-		args[pos+1] = p
-		args[pos+2] = &ICommit{-2}
-		pos += 3
-	} else {
-		args[pos+0] = &IChoice{2 * (max - min)}
-		pos++
+		args = append(args,
+			&IChoice{3},
+			p,
+			&ICommit{-2},
+		)
+	} else if max-min > maxUnroll {
+		args = append(args,
+			&IPushCounter{},
+			&IChoice{4},
+			p,
+			&ICommit{1},
+			&ILoop{-3, max - min},
+			&IPopCounter{},
+		)
+	} else if max > min {
+		args = append(args, &IChoice{2*(max-min) + 2})
 		for i := min; i < max; i++ {
-			args[pos+0] = p
-			args[pos+1] = &IPartialCommit{1}
-			pos += 2
+			args = append(args, p, &IPartialCommit{1})
 		}
-		args[pos+0] = &ICommit{1}
-		pos++
+		args = append(args, &ICommit{1})
 	}
 	return Seq2(args)
 }
 
+// Repetitions larger than this are compiled into counted loops.
+const maxUnroll = 3
+
+// Arguments for matching `p` exactly `count` times.
+func repCount(p *Pattern, count int) []interface{} {
+	if count > maxUnroll {
+		return []interface{}{
+			&IPushCounter{},
+			p,
+			&ILoop{-1, count},
+			&IPopCounter{},
+		}
+	}
+	args := make([]interface{}, count)
+	for i := range args {
+		args[i] = p
+	}
+	return args
+}
+
 // Negative look-ahead for the pattern.
 func Not(p *Pattern) *Pattern {
 	return Seq(
@@ -256,10 +332,26 @@ func Lit(text string) *Pattern {
 	return Seq2(args)
 }
 
+// Match the first of the keywords that the input starts with.
+// Equivalent to Or(Lit(words[0]), Lit(words[1]), ...), but does not try
+// each keyword in turn.
+func Keywords(words ...string) *Pattern {
+	if len(words) == 0 {
+		return Fail()
+	}
+	return Seq(newKeywords(words))
+}
+
 // Match a grammar.
 // start: name of the first pattern
 // grammar: map of names to patterns
 func Grm(start string, grammar map[string]*Pattern) *Pattern {
+	p, _ := layoutGrammar(start, grammar)
+	return p
+}
+
+// Same as Grm(), and also returns where each rule starts.
+func layoutGrammar(start string, grammar map[string]*Pattern) (*Pattern, map[string]int) {
 	// Figure out where each pattern begins, so that open
 	// references can be resolved
 	refs := map[string]int{"": 0}
@@ -277,7 +369,7 @@ func Grm(start string, grammar map[string]*Pattern) *Pattern {
 	}
 	// Construct the final pattern
 	ret := make(Pattern, size+1)
-	ret[0] = &ICall{refs[start] - 0}
+	ret[0] = &ICall{refs[start] - 0, start}
 	ret[1] = &IJump{size - 1}
 	for _, name := range order {
 		copy(ret[refs[name]:], *grammar[name])
@@ -288,11 +380,12 @@ func Grm(start string, grammar map[string]*Pattern) *Pattern {
 	for i, op := range ret {
 		if op2, ok := op.(*IOpenCall); ok {
 			if offset, ok := refs[op2.name]; ok {
-				ret[i] = &ICall{offset - i}
+				ret[i] = &ICall{offset - i, op2.name}
 			}
 		}
 	}
-	return &ret
+	delete(refs, "")
+	return &ret, refs
 }
 
 // Match a set of characters.
@@ -316,6 +409,19 @@ func NegSet(chars string) *Pattern {
 	return Seq(&ICharset{mask})
 }
 
+// Match a character from any of the ranges. Each range is a
+// two-character string, so "az" matches 'a' through 'z'.
+func Range(ranges ...string) *Pattern {
+	op := &ICharset{}
+	for _, r := range ranges {
+		if len(r) != 2 {
+			panic("Invalid range")
+		}
+		op.add(r[0], r[1])
+	}
+	return Seq(op)
+}
+
 // Resolve a value to a pattern.
 // Patterns are return unmodified.
 // * true gives a pattern that always succeeds. Equivalent to Succ().
@@ -405,3 +511,27 @@ func Csubst(p *Pattern) *Pattern {
 		&ICloseCapture{},
 	)
 }
+
+// Does a table capture: a map[string]interface{} of the named groups
+// of the pattern by name, and of its other captures by position.
+func Ctable(p *Pattern) *Pattern {
+	return Seq(
+		&IOpenCapture{0, &TableCapture{}},
+		p,
+		&ICloseCapture{},
+	)
+}
+
+// Does a named group capture, for a table capture. The value is the
+// first capture of the pattern, or the matched substring if it has no
+// captures. List captures leave named groups out.
+func Cg(p *Pattern, name string) *Pattern {
+	if name == "" {
+		panic("Invalid name")
+	}
+	return Seq(
+		&IOpenCapture{0, &GroupCapture{name}},
+		p,
+		&ICloseCapture{},
+	)
+}
@@ -0,0 +1,345 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+// Package pegotest runs golden-file tests of pego grammars.
+//
+// A .pegotest file lists inputs, each followed by what matching it
+// must give:
+//
+//	# Comments start with '#'.
+//	input: "a(b)c"
+//	match: 5
+//	captures: ["a(b)c"]
+//
+//	input: ")"
+//	error: 0: Stack is empty
+//
+// `input` is a Go string literal, and starts a new case. `match` is
+// the end position of the match, `captures` the value returned by
+// pego.Match as JSON, and `error` the position and message of the
+// error. Lines that start with a space or a tab continue the line
+// before them, for long captures.
+package pegotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/losinggeneration/pego"
+)
+
+// A test case: an input and the expected results.
+type Case struct {
+	Line     int      // Line of the input in the file
+	Comments []string // Comment lines before the case
+	Input    string
+	Match    int    // End position of the match, or -1 if not checked
+	Captures string // Captures as JSON, or "" if not checked
+	Error    string // Error message, or "" if the match must succeed
+	ErrorPos int    // Position of the error
+}
+
+// Does the case check anything?
+func (c *Case) checks() bool {
+	return c.Match >= 0 || c.Captures != "" || c.Error != ""
+}
+
+// Test cases read from a file.
+type File struct {
+	Name    string
+	Cases   []*Case
+	Trailer []string // Comment lines after the last case
+}
+
+// Error in a .pegotest file.
+type SyntaxError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Read and parse a .pegotest file.
+func ParseFile(name string) (*File, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(name, string(src))
+}
+
+// Parse the source of a .pegotest file. The name is used in errors.
+func Parse(name, src string) (*File, error) {
+	f := &File{Name: name}
+	var c *Case
+	var comments []string
+	lines := strings.Split(strings.TrimRight(src, "\n"), "\n")
+	for n := 0; n < len(lines); n++ {
+		line := strings.TrimRight(lines[n], " \t\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			comments = append(comments, line)
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			return nil, &SyntaxError{name, n + 1, "Unexpected continuation line"}
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, &SyntaxError{name, n + 1, "Expected a key and a value"}
+		}
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		start := n
+		for n+1 < len(lines) && len(lines[n+1]) > 0 && (lines[n+1][0] == ' ' || lines[n+1][0] == '\t') {
+			n++
+			value += "\n" + strings.TrimRight(lines[n], " \t\r")
+		}
+		fail := func(format string, args ...interface{}) error {
+			return &SyntaxError{name, start + 1, fmt.Sprintf(format, args...)}
+		}
+		if key == "input" {
+			input, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fail("Invalid input: %v", err)
+			}
+			c = &Case{Line: start + 1, Comments: comments, Input: input, Match: -1}
+			comments = nil
+			f.Cases = append(f.Cases, c)
+			continue
+		}
+		if c == nil {
+			return nil, fail("Expected input before %s", key)
+		}
+		switch key {
+		case "match":
+			pos, err := strconv.Atoi(value)
+			if err != nil || pos < 0 {
+				return nil, fail("Invalid match position %q", value)
+			}
+			c.Match = pos
+		case "captures":
+			var v interface{}
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				return nil, fail("Invalid captures: %v", err)
+			}
+			c.Captures = value
+		case "error":
+			i := strings.IndexByte(value, ':')
+			if i < 0 {
+				return nil, fail("Expected position: message")
+			}
+			pos, err := strconv.Atoi(value[:i])
+			if err != nil || pos < 0 {
+				return nil, fail("Invalid error position %q", value[:i])
+			}
+			c.Error, c.ErrorPos = strings.TrimSpace(value[i+1:]), pos
+		default:
+			return nil, fail("Unknown key %q", key)
+		}
+	}
+	f.Trailer = comments
+	return f, nil
+}
+
+// A case whose results differ from the expected ones.
+type Failure struct {
+	File string
+	Case *Case
+	Msg  string // May span several lines
+}
+
+func (f *Failure) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.File, f.Case.Line, f.Msg)
+}
+
+// Results of a match of a case.
+type result struct {
+	captures interface{}
+	err      error
+	pos      int
+}
+
+func match(p *pego.Pattern, c *Case) *result {
+	r, err, pos := pego.Match(p, c.Input)
+	return &result{r, err, pos}
+}
+
+// Run the cases against the pattern, and return the ones that fail.
+func (f *File) Run(p *pego.Pattern) []*Failure {
+	var ret []*Failure
+	for _, c := range f.Cases {
+		if msg := check(c, match(p, c)); msg != "" {
+			ret = append(ret, &Failure{f.Name, c, msg})
+		}
+	}
+	return ret
+}
+
+// Run the .pegotest files against the pattern from a Go test, and
+// report each failing case as an error.
+func Test(t testing.TB, p *pego.Pattern, files ...string) {
+	t.Helper()
+	for _, name := range files {
+		f, err := ParseFile(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, fail := range f.Run(p) {
+			t.Error(fail)
+		}
+	}
+}
+
+// Compare the results of a case with the expected ones. Returns a
+// description of the differences, or "" if there are none.
+func check(c *Case, r *result) string {
+	if !c.checks() {
+		return "No expectations, run with -update to add them"
+	}
+	if r.err != nil {
+		if c.Error == "" {
+			return fmt.Sprintf("Expected a match, got error at %d: %v", r.pos, r.err)
+		}
+		if r.err.Error() != c.Error || r.pos != c.ErrorPos {
+			return fmt.Sprintf("Expected error at %d: %s\ngot error at %d: %v", c.ErrorPos, c.Error, r.pos, r.err)
+		}
+		return ""
+	}
+	if c.Error != "" {
+		return fmt.Sprintf("Expected error at %d: %s\ngot a match up to %d", c.ErrorPos, c.Error, r.pos)
+	}
+	var msgs []string
+	if c.Match >= 0 && r.pos != c.Match {
+		msgs = append(msgs, fmt.Sprintf("Expected a match up to %d, got %d", c.Match, r.pos))
+	}
+	if c.Captures != "" {
+		want, _ := indentJSON([]byte(c.Captures))
+		data, err := json.Marshal(r.captures)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("Captures can not be written as JSON: %v", err))
+		} else if got, _ := indentJSON(data); got != want {
+			msgs = append(msgs, "Captures differ (-want +got):\n"+diff(want, got))
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Reformat JSON, so that equal values give equal text.
+func indentJSON(data []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	return string(out), err
+}
+
+// Replace the expectations of all cases with the results of the
+// pattern.
+func (f *File) Update(p *pego.Pattern) error {
+	for _, c := range f.Cases {
+		r := match(p, c)
+		c.Match, c.Captures, c.Error, c.ErrorPos = -1, "", "", 0
+		if r.err != nil {
+			c.Error, c.ErrorPos = r.err.Error(), r.pos
+			continue
+		}
+		c.Match = r.pos
+		if r.captures == nil {
+			continue
+		}
+		data, err := json.Marshal(r.captures)
+		if err != nil {
+			return fmt.Errorf("%s:%d: Captures can not be written as JSON: %v", f.Name, c.Line, err)
+		}
+		if len(data) > 60 {
+			var buf bytes.Buffer
+			json.Indent(&buf, data, "\t", "\t")
+			data = buf.Bytes()
+		}
+		c.Captures = string(data)
+	}
+	return nil
+}
+
+// The file in the .pegotest format.
+func (f *File) Format() []byte {
+	var buf bytes.Buffer
+	for i, c := range f.Cases {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		for _, line := range c.Comments {
+			fmt.Fprintln(&buf, line)
+		}
+		fmt.Fprintf(&buf, "input: %s\n", strconv.Quote(c.Input))
+		if c.Error != "" {
+			fmt.Fprintf(&buf, "error: %d: %s\n", c.ErrorPos, c.Error)
+		}
+		if c.Match >= 0 {
+			fmt.Fprintf(&buf, "match: %d\n", c.Match)
+		}
+		if c.Captures != "" {
+			fmt.Fprintf(&buf, "captures: %s\n", c.Captures)
+		}
+	}
+	if len(f.Trailer) > 0 {
+		if len(f.Cases) > 0 {
+			buf.WriteByte('\n')
+		}
+		for _, line := range f.Trailer {
+			fmt.Fprintln(&buf, line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Line diff of a and b, with "-" for lines only in a, "+" for lines
+// only in b, and " " for common lines.
+func diff(a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of
+	// x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var buf strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(&buf, "  %s\n", x[i])
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&buf, "- %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&buf, "+ %s\n", y[j])
+			j++
+		}
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
@@ -0,0 +1,84 @@
+package pegotest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/losinggeneration/pego"
+)
+
+const testGrammar = `
+	S <- {| A |} !.
+	A <- { [^()]* (B [^()]*)* }
+	B <- '(' A ')'
+`
+
+const testFile = `# Balanced
+input: "a(b)c"
+match: 5
+captures: ["a(b)c", "b"]
+
+input: "x\n"
+match: 2
+captures: [
+		"x\n"
+	]
+
+# Unbalanced
+input: "(x"
+error: 0: Stack is empty
+
+# Trailer
+`
+
+func TestRun(t *testing.T) {
+	pat, err := pego.ParseGrammar(testGrammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Parse("test.pegotest", testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Cases) != 3 || f.Cases[1].Line != 6 {
+		t.Fatalf("Wrong cases: %+v", f.Cases)
+	}
+	if failures := f.Run(pat); len(failures) != 0 {
+		t.Errorf("Unexpected failures: %v", failures)
+	}
+
+	f.Cases[0].Captures = `["a(b)c", "x"]`
+	f.Cases[2].ErrorPos = 1
+	failures := f.Run(pat)
+	if len(failures) != 2 {
+		t.Fatalf("Expected 2 failures, got %v", failures)
+	}
+	if msg := failures[0].String(); !strings.Contains(msg, "test.pegotest:2:") || !strings.Contains(msg, "-   \"x\"\n+   \"b\"") {
+		t.Errorf("Wrong diff:\n%s", msg)
+	}
+
+	if err := f.Update(pat); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(testFile, `, "b"`, `,"b"`, 1)
+	want = strings.Replace(want, "[\n\t\t\"x\\n\"\n\t]", `["x\n"]`, 1)
+	if out := string(f.Format()); out != want {
+		t.Errorf("Wrong update:\n%s", out)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct{ src, err string }{
+		{"match: 1", "t:1: Expected input before match"},
+		{"input: x", "t:1: Invalid input: invalid syntax"},
+		{"input: \"x\"\n\nfoo: 1", "t:3: Unknown key \"foo\""},
+		{"input: \"x\"\ncaptures: [1,", "t:2: Invalid captures: unexpected end of JSON input"},
+		{"input: \"x\"\nerror: oops", "t:2: Expected position: message"},
+		{" input: \"x\"", "t:1: Unexpected continuation line"},
+	}
+	for _, test := range tests {
+		if _, err := Parse("t", test.src); err == nil || err.Error() != test.err {
+			t.Errorf("%q: expected %q, got %v", test.src, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Collects a profile of the rules of a grammar, over one or more
+// matches. Matches must be run through Profiler.Match(), or with the
+// profiler as the Tracer after a call to Reset().
+type Profiler struct {
+	rules   map[string]*RuleProfile
+	choices map[int]*ChoiceProfile
+	root    *profileNode
+	node    *profileNode // Innermost rule
+	depth   int          // Number of rules on the call stack
+	last    time.Time    // Time of the last step
+	start   time.Time
+	total   time.Duration // Time of all steps
+	// Choice for each fallback address, to map backtracks to choices.
+	fallbacks map[int]int
+}
+
+// Profile of a single rule.
+type RuleProfile struct {
+	Name        string
+	Calls       int           // Number of times the rule was called
+	Steps       int           // Instructions run in the rule itself
+	Time        time.Duration // Time spent in the rule itself
+	Failures    int           // Backtracks from within the rule
+	Backtracked int           // Input bytes given up by those backtracks
+}
+
+// Profile of a single choice instruction.
+type ChoiceProfile struct {
+	PC          int
+	Rule        string // Rule containing the choice
+	Pushes      int    // Number of times the choice was run
+	Backtracks  int    // Number of times the fallback was taken
+	Backtracked int    // Input bytes given up by those backtracks
+}
+
+// Node in the tree of rule call stacks.
+type profileNode struct {
+	rule     *RuleProfile
+	parent   *profileNode
+	children map[string]*profileNode
+	steps    int
+	time     time.Duration
+}
+
+// Name used for code outside of any rule.
+const profileMain = "(main)"
+
+func NewProfiler() *Profiler {
+	p := &Profiler{
+		rules:     make(map[string]*RuleProfile),
+		choices:   make(map[int]*ChoiceProfile),
+		fallbacks: make(map[int]int),
+	}
+	p.root = p.newNode(profileMain, nil)
+	p.Reset()
+	return p
+}
+
+func (p *Profiler) newNode(name string, parent *profileNode) *profileNode {
+	rule, ok := p.rules[name]
+	if !ok {
+		rule = &RuleProfile{Name: name}
+		p.rules[name] = rule
+	}
+	return &profileNode{rule: rule, parent: parent, children: make(map[string]*profileNode)}
+}
+
+// Prepare for a new match.
+func (p *Profiler) Reset() {
+	p.node, p.depth = p.root, 0
+	p.start = time.Now()
+	p.last = p.start
+}
+
+// Match and record the profile. Same as Match().
+func (p *Profiler) Match(program *Pattern, input string) (interface{}, error, int) {
+	p.Reset()
+	r, err, pos := MatchWithOptions(program, input, &MatchOptions{Tracer: p})
+	p.finish()
+	return r, err, pos
+}
+
+// Account the time since the last step.
+func (p *Profiler) finish() {
+	now := time.Now()
+	p.node.time += now.Sub(p.last)
+	p.node.rule.Time += now.Sub(p.last)
+	p.total += now.Sub(p.last)
+	p.last = now
+}
+
+func (p *Profiler) Trace(e *TraceEvent) {
+	switch e.Kind {
+	case TraceStep:
+		now := time.Now()
+		p.node.time += now.Sub(p.last)
+		p.node.rule.Time += now.Sub(p.last)
+		p.total += now.Sub(p.last)
+		p.last = now
+		p.node.steps++
+		p.node.rule.Steps++
+	case TraceCall:
+		name := e.Rule
+		if name == "" {
+			name = fmt.Sprintf("<%d>", e.Target)
+		}
+		child, ok := p.node.children[name]
+		if !ok {
+			child = p.newNode(name, p.node)
+			p.node.children[name] = child
+		}
+		child.rule.Calls++
+		p.node = child
+		p.depth++
+	case TraceReturn:
+		if p.node.parent != nil {
+			p.node = p.node.parent
+			p.depth--
+		}
+	case TraceChoice:
+		c, ok := p.choices[e.PC]
+		if !ok {
+			c = &ChoiceProfile{PC: e.PC, Rule: p.node.rule.Name}
+			p.choices[e.PC] = c
+		}
+		c.Pushes++
+		p.fallbacks[e.Target] = e.PC
+	case TraceBacktrack:
+		p.node.rule.Failures++
+		p.node.rule.Backtracked += e.Failed - e.Pos
+		if pc, ok := p.fallbacks[e.PC]; ok {
+			p.choices[pc].Backtracks++
+			p.choices[pc].Backtracked += e.Failed - e.Pos
+		}
+		// Backtracking drops the rules called after the choice.
+		for depth := callDepth(e.Stack); p.depth > depth && p.node.parent != nil; p.depth-- {
+			p.node = p.node.parent
+		}
+	}
+}
+
+// All rules, sorted by the time spent in them.
+func (p *Profiler) Rules() []*RuleProfile {
+	ret := make([]*RuleProfile, 0, len(p.rules))
+	for _, r := range p.rules {
+		if r.Steps > 0 || r.Calls > 0 {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Time != ret[j].Time {
+			return ret[i].Time > ret[j].Time
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// All choices that were run, sorted by the number of backtracks.
+func (p *Profiler) Choices() []*ChoiceProfile {
+	ret := make([]*ChoiceProfile, 0, len(p.choices))
+	for _, c := range p.choices {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Backtracks != ret[j].Backtracks {
+			return ret[i].Backtracks > ret[j].Backtracks
+		}
+		return ret[i].PC < ret[j].PC
+	})
+	return ret
+}
+
+// Write a report of the rules and the choices, most expensive first.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	steps := 0
+	for _, r := range p.rules {
+		steps += r.Steps
+	}
+	fmt.Fprintf(tw, "time\ttime%%\tsteps\tcalls\tfailures\tbacktracked\t rule\n")
+	for _, r := range p.Rules() {
+		fmt.Fprintf(tw, "%v\t%.1f%%\t%d\t%d\t%d\t%d\t %s\n", r.Time.Round(time.Microsecond),
+			percent(int64(r.Time), int64(p.total)), r.Steps, r.Calls, r.Failures, r.Backtracked, r.Name)
+	}
+	fmt.Fprintf(tw, "%v\t\t%d\t\t\t\t total\n", p.total.Round(time.Microsecond), steps)
+	fmt.Fprintf(tw, "\npc\tpushes\tbacktracks\tbacktracked\t rule\n")
+	for _, c := range p.Choices() {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t %s\n", c.PC, c.Pushes, c.Backtracks, c.Backtracked, c.Rule)
+	}
+	return tw.Flush()
+}
+
+func percent(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return 100 * float64(a) / float64(b)
+}
+
+// Write the profile in the gzipped protobuf format of pprof. Each rule
+// is a function, and each sample is a rule call stack, so `go tool
+// pprof` can show the hot spots of the grammar.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	var b protoBuffer
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		if i, ok := strs[s]; ok {
+			return uint64(i)
+		}
+		strs[s] = len(table)
+		table = append(table, s)
+		return uint64(strs[s])
+	}
+	sampleType := func(typ, unit string) {
+		var vt protoBuffer
+		vt.uint(1, str(typ))
+		vt.uint(2, str(unit))
+		b.bytes(1, vt)
+	}
+	sampleType("steps", "count")
+	sampleType("time", "nanoseconds")
+
+	// One function and location per rule.
+	names := make([]string, 0, len(p.rules))
+	for name := range p.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := make(map[string]uint64, len(names))
+	for i, name := range names {
+		ids[name] = uint64(i + 1)
+	}
+
+	var walk func(n *profileNode, stack []uint64)
+	walk = func(n *profileNode, stack []uint64) {
+		stack = append([]uint64{ids[n.rule.Name]}, stack...)
+		if n.steps > 0 {
+			var s protoBuffer
+			s.packed(1, stack...)
+			s.packed(2, uint64(n.steps), uint64(n.time))
+			b.bytes(2, s)
+		}
+		children := make([]string, 0, len(n.children))
+		for name := range n.children {
+			children = append(children, name)
+		}
+		sort.Strings(children)
+		for _, name := range children {
+			walk(n.children[name], stack)
+		}
+	}
+	walk(p.root, nil)
+
+	for _, name := range names {
+		var line, loc, fn protoBuffer
+		line.uint(1, ids[name])
+		loc.uint(1, ids[name])
+		loc.bytes(4, line)
+		b.bytes(4, loc)
+		fn.uint(1, ids[name])
+		fn.uint(2, str(name))
+		fn.uint(3, str(name))
+		fn.uint(4, str("grammar"))
+		b.bytes(5, fn)
+	}
+	// The string table must be written last, as the other fields add
+	// to it.
+	for _, s := range table {
+		b.bytes(6, protoBuffer(s))
+	}
+	b.uint(9, uint64(p.start.UnixNano()))
+	b.uint(10, uint64(p.total))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Minimal protocol buffer encoder for WritePprof.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *protoBuffer) uint(field int, x uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuffer) packed(field int, xs ...uint64) {
+	var data protoBuffer
+	for _, x := range xs {
+		data.varint(x)
+	}
+	b.bytes(field, data)
+}
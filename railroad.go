@@ -0,0 +1,353 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Railroad diagrams of the rules of a pattern, as SVG documents by rule
+// name. A pattern that is not a grammar gives one diagram, under the
+// name "". Boxes of rules link to the diagram of the rule, as
+// "<name>.svg" in the same directory.
+//
+// The documents need no scripts or other files. Parts of the pattern
+// that were not made by the constructors are drawn as a box with the
+// instructions they span.
+func Railroad(p *Pattern) map[string][]byte {
+	return railroad(decodeExpr(p))
+}
+
+// Same as Railroad(Grm(start, grammar)), but rules that are never used
+// get a diagram too.
+func RailroadGrammar(start string, grammar map[string]*Pattern) map[string][]byte {
+	return railroad(exprGrammarOf(start, grammar))
+}
+
+func railroad(top *expr) map[string][]byte {
+	ret := make(map[string][]byte)
+	if top.kind != exprGrammar {
+		ret[""] = railroadSVG("", top)
+	}
+	for _, r := range top.allRules() {
+		if _, ok := ret[r.String()]; !ok {
+			ret[r.String()] = railroadSVG(r.String(), r.body)
+		}
+	}
+	return ret
+}
+
+// Sizes in pixels.
+const (
+	rrChar   = 8  // Width of a character
+	rrBox    = 22 // Height of a box
+	rrRadius = 10 // Radius of the curves of the rails
+	rrGap    = 10 // Space between boxes
+	rrLabel  = 14 // Height of a label
+	rrMargin = 20
+)
+
+// Element of a diagram.
+type rrNode struct {
+	kind     rrKind
+	text     string // rrTerminal, rrRule, rrSpecial; label of rrGroup and rrLoop
+	args     []*rrNode
+	optional bool // rrLoop: can be skipped
+
+	// The rail enters on the left and leaves on the right, at height 0.
+	// up and down are the extents above and below the rail.
+	width, up, down int
+}
+
+type rrKind int
+
+const (
+	rrTerminal rrKind = iota // Matches text
+	rrRule                   // Call of a rule
+	rrSpecial                // Anything else
+	rrSkip                   // Empty
+	rrSeq                    // args one after the other
+	rrChoice                 // Ordered choice of args
+	rrLoop                   // args[0] repeated
+	rrGroup                  // args[0] in a box with a label
+)
+
+// Convert the structure of a pattern to diagram elements.
+func rrFromExpr(x *expr) *rrNode {
+	switch x.kind {
+	case exprOp:
+		switch op := x.op.(type) {
+		case *IKeywords:
+			if len(op.words) > 1 {
+				n := &rrNode{kind: rrChoice}
+				for _, w := range op.words {
+					n.args = append(n.args, &rrNode{kind: rrTerminal, text: quotePEG(w)})
+				}
+				return n
+			}
+		case *IFail:
+			return &rrNode{kind: rrSpecial, text: "fail"}
+		case *IEmptyCapture:
+			return &rrNode{kind: rrSpecial, text: fmt.Sprint(op.handler)}
+		case *IChar, *ICharset, *IAny:
+		default:
+			return &rrNode{kind: rrSpecial, text: op.String()}
+		}
+		var b strings.Builder
+		formatOp(&b, x.op)
+		return &rrNode{kind: rrTerminal, text: b.String()}
+	case exprSeq:
+		if x.literal() {
+			return &rrNode{kind: rrTerminal, text: x.String()}
+		}
+		n := &rrNode{kind: rrSeq}
+		for i := 0; i < len(x.args); i++ {
+			// Runs of characters are drawn as one literal.
+			j := i
+			for j < len(x.args) && x.args[j].kind == exprOp {
+				if _, ok := x.args[j].op.(*IChar); !ok {
+					break
+				}
+				j++
+			}
+			if j-i > 1 {
+				n.args = append(n.args, rrFromExpr(&expr{kind: exprSeq, args: x.args[i:j]}))
+				i = j - 1
+				continue
+			}
+			n.args = append(n.args, rrFromExpr(x.args[i]))
+		}
+		if len(n.args) == 0 {
+			return &rrNode{kind: rrSkip}
+		}
+		return n
+	case exprOr:
+		n := &rrNode{kind: rrChoice}
+		for _, arg := range x.args {
+			n.args = append(n.args, rrFromExpr(arg))
+		}
+		return n
+	case exprRep:
+		arg := rrFromExpr(x.args[0])
+		switch {
+		case x.min == 0 && x.max == 1:
+			return &rrNode{kind: rrChoice, args: []*rrNode{arg, {kind: rrSkip}}}
+		case x.min <= 1 && x.max < 0:
+			return &rrNode{kind: rrLoop, args: []*rrNode{arg}, optional: x.min == 0}
+		case x.max < 0:
+			return &rrNode{kind: rrLoop, args: []*rrNode{arg}, text: fmt.Sprintf("%d or more", x.min)}
+		}
+		return &rrNode{kind: rrLoop, args: []*rrNode{arg}, optional: x.min == 0,
+			text: fmt.Sprintf("%d to %d", x.min, x.max)}
+	case exprNot:
+		return &rrNode{kind: rrGroup, text: "not", args: []*rrNode{rrFromExpr(x.args[0])}}
+	case exprAnd:
+		return &rrNode{kind: rrGroup, text: "and", args: []*rrNode{rrFromExpr(x.args[0])}}
+	case exprCall:
+		name := x.name
+		if name == "" && x.rule != nil {
+			name = x.rule.String()
+		}
+		if name == "" {
+			return &rrNode{kind: rrSpecial, text: "call"}
+		}
+		return &rrNode{kind: rrRule, text: name}
+	case exprCapture:
+		return &rrNode{kind: rrGroup, text: fmt.Sprint(x.handler), args: []*rrNode{rrFromExpr(x.args[0])}}
+	case exprGrammar:
+		return &rrNode{kind: rrRule, text: x.rules[0].String()}
+	}
+	return &rrNode{kind: rrSpecial, text: fmt.Sprintf("code %d-%d", x.pc, x.end)}
+}
+
+// Compute the sizes of n and the nodes below it.
+func (n *rrNode) layout() {
+	for _, arg := range n.args {
+		arg.layout()
+	}
+	switch n.kind {
+	case rrTerminal, rrRule, rrSpecial:
+		n.width = rrChar*len(n.text) + 2*rrGap
+		n.up, n.down = rrBox/2, rrBox/2
+	case rrSkip:
+		n.width = 2 * rrGap
+	case rrSeq:
+		for i, arg := range n.args {
+			if i > 0 {
+				n.width += rrGap
+			}
+			n.width += arg.width
+			if arg.up > n.up {
+				n.up = arg.up
+			}
+			if arg.down > n.down {
+				n.down = arg.down
+			}
+		}
+	case rrChoice:
+		for i, arg := range n.args {
+			if arg.width > n.width {
+				n.width = arg.width
+			}
+			if i == 0 {
+				n.up, n.down = arg.up, arg.down
+			} else {
+				n.down += rrGap + arg.up + arg.down
+			}
+		}
+		n.width += 4 * rrRadius
+	case rrLoop:
+		arg := n.args[0]
+		n.width = arg.width + 2*rrRadius
+		n.up, n.down = arg.up, arg.down+rrGap+rrRadius
+		if n.text != "" {
+			n.down += rrLabel
+		}
+		if n.optional {
+			n.width += 4 * rrRadius
+			n.up += rrGap + rrRadius
+		}
+	case rrGroup:
+		arg := n.args[0]
+		n.width = arg.width + 2*rrGap
+		n.up, n.down = arg.up+rrGap+rrLabel, arg.down+rrGap
+	}
+}
+
+// Writes the SVG elements of a diagram.
+type rrWriter struct {
+	strings.Builder
+}
+
+func (w *rrWriter) line(x1, y1, x2, y2 int) {
+	fmt.Fprintf(w, "<path d=\"M%d %dL%d %d\"/>\n", x1, y1, x2, y2)
+}
+
+func (w *rrWriter) text(x, y int, class, text string) {
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" class=\"%s\">%s</text>\n", x, y, class, html.EscapeString(text))
+}
+
+// Draw n with its rail entering at (x, y).
+func (w *rrWriter) draw(n *rrNode, x, y int) {
+	const r = rrRadius
+	switch n.kind {
+	case rrTerminal, rrRule, rrSpecial:
+		class := map[rrKind]string{rrTerminal: "terminal", rrRule: "rule", rrSpecial: "special"}[n.kind]
+		if n.kind == rrRule {
+			ref := html.EscapeString(n.text + ".svg")
+			fmt.Fprintf(w, "<a href=\"%s\" xlink:href=\"%s\">\n", ref, ref)
+		}
+		rx := 0
+		if n.kind == rrTerminal {
+			rx = rrBox / 2
+		}
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"%d\" class=\"%s\"/>\n",
+			x, y-rrBox/2, n.width, rrBox, rx, class)
+		w.text(x+n.width/2, y+4, class, n.text)
+		if n.kind == rrRule {
+			w.WriteString("</a>\n")
+		}
+	case rrSkip:
+		w.line(x, y, x+n.width, y)
+	case rrSeq:
+		for i, arg := range n.args {
+			if i > 0 {
+				w.line(x, y, x+rrGap, y)
+				x += rrGap
+			}
+			w.draw(arg, x, y)
+			x += arg.width
+		}
+	case rrChoice:
+		right := x + n.width
+		dy := 0
+		for i, arg := range n.args {
+			if i > 0 {
+				dy += rrGap + arg.up
+				fmt.Fprintf(w, "<path d=\"M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 0 %d %d\"/>\n",
+					x, y, r, r, r, r, y+dy-r, r, r, r, r)
+				fmt.Fprintf(w, "<path d=\"M%d %da%d %d 0 0 0 %d %dV%da%d %d 0 0 1 %d %d\"/>\n",
+					right-2*r, y+dy, r, r, r, -r, y+r, r, r, r, -r)
+			} else {
+				w.line(x, y, x+2*r, y)
+				w.line(right-2*r, y, right, y)
+			}
+			w.draw(arg, x+2*r, y+dy)
+			w.line(x+2*r+arg.width, y+dy, right-2*r, y+dy)
+			dy += arg.down
+		}
+	case rrLoop:
+		arg := n.args[0]
+		if n.optional {
+			// Rail over the loop, for no repetition.
+			top := y - arg.up - rrGap - r
+			fmt.Fprintf(w, "<path d=\"M%d %da%d %d 0 0 0 %d %dV%da%d %d 0 0 1 %d %dH%da%d %d 0 0 1 %d %dV%da%d %d 0 0 0 %d %d\"/>\n",
+				x, y, r, r, r, -r, top+r, r, r, r, -r, x+n.width-2*r, r, r, r, r, y-r, r, r, r, r)
+			w.line(x, y, x+2*r, y)
+			w.line(x+n.width-2*r, y, x+n.width, y)
+			x += 2 * r
+		}
+		// Rail under the argument, back to its start.
+		bottom := y + arg.down + rrGap + r
+		end := x + arg.width + r
+		w.line(x, y, x+r, y)
+		w.draw(arg, x+r, y)
+		w.line(end, y, end+r, y)
+		fmt.Fprintf(w, "<path d=\"M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %dH%da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %d\"/>\n",
+			end, y, r, r, r, r, bottom-r, r, r, -r, r, x+r, r, r, -r, -r, y+r, r, r, r, -r)
+		if n.text != "" {
+			w.text(x+r+arg.width/2, bottom+rrLabel-2, "label", n.text)
+		}
+	case rrGroup:
+		arg := n.args[0]
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" class=\"group\"/>\n",
+			x, y-n.up+rrLabel, n.width, n.up+n.down-rrLabel)
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" class=\"label\" text-anchor=\"start\">%s</text>\n",
+			x, y-n.up+rrLabel-4, html.EscapeString(n.text))
+		w.line(x, y, x+rrGap, y)
+		w.draw(arg, x+rrGap, y)
+		w.line(x+rrGap+arg.width, y, x+n.width, y)
+	}
+}
+
+const rrStyle = `path { fill: none; stroke: #333; stroke-width: 2; }
+rect { stroke: #333; stroke-width: 2; }
+rect.terminal { fill: #ffc; }
+rect.rule { fill: #def; }
+rect.special { fill: #eee; stroke-dasharray: 4 2; }
+rect.group { fill: none; stroke: #999; stroke-width: 1; stroke-dasharray: 4 2; }
+text { font: 13px monospace; text-anchor: middle; }
+text.label { font-size: 11px; fill: #666; }
+text.title { font-weight: bold; text-anchor: start; }
+a:hover rect { fill: #bdf; }
+`
+
+// Draw the diagram of a rule.
+func railroadSVG(name string, body *expr) []byte {
+	n := rrFromExpr(body)
+	n.layout()
+	title := 0
+	if name != "" {
+		title = rrLabel + rrGap
+	}
+	// Bars at both ends, and a rail to them.
+	width := n.width + 2*rrMargin + 2*rrGap
+	height := n.up + n.down + 2*rrMargin + title
+	y := rrMargin + title + n.up
+	var w rrWriter
+	fmt.Fprintf(&w, "<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		width, height, width, height)
+	fmt.Fprintf(&w, "<style>\n%s</style>\n", rrStyle)
+	if name != "" {
+		w.text(rrMargin, rrMargin+rrLabel-4, "title", name)
+	}
+	fmt.Fprintf(&w, "<path d=\"M%d %dv%d\"/>\n", rrMargin, y-rrBox/2+3, rrBox-6)
+	w.line(rrMargin, y, rrMargin+rrGap, y)
+	w.draw(n, rrMargin+rrGap, y)
+	w.line(rrMargin+rrGap+n.width, y, width-rrMargin, y)
+	fmt.Fprintf(&w, "<path d=\"M%d %dv%d\"/>\n", width-rrMargin, y-rrBox/2+3, rrBox-6)
+	w.WriteString("</svg>\n")
+	return []byte(w.String())
+}
@@ -0,0 +1,62 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import "sort"
+
+// A named rule in a compiled grammar.
+type Rule struct {
+	Name  string
+	Start int // First instruction
+	End   int // One past the Return instruction
+}
+
+// The rules of a compiled grammar, in program order. Rules are found
+// through the calls to them, so rules that are never called are not
+// included.
+func Rules(p *Pattern) []Rule {
+	names := make(map[int]string)
+	for i, op := range *p {
+		if op, ok := op.(*ICall); ok && op.name != "" {
+			if _, ok := names[i+op.offset]; !ok {
+				names[i+op.offset] = op.name
+			}
+		}
+	}
+	ret := make([]Rule, 0, len(names))
+	for start, name := range names {
+		ret = append(ret, Rule{name, start, ruleEnd(*p, start)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start < ret[j].Start })
+	return ret
+}
+
+// One past the Return instruction ending the rule at `start`. Returns
+// of nested grammars are skipped, as the code jumps past them.
+func ruleEnd(code Pattern, start int) int {
+	reach := start
+	for i := start; i < len(code); i++ {
+		if _, ok := code[i].(*ICall); ok {
+			continue
+		}
+		if offset, ok := jumpOffset(code[i]); ok && i+offset > reach {
+			reach = i + offset
+		}
+		if _, ok := code[i].(*IReturn); ok && reach <= i {
+			return i + 1
+		}
+	}
+	return len(code)
+}
+
+// The rule containing instruction `pc`, or nil.
+func ruleAt(rules []Rule, pc int) *Rule {
+	var ret *Rule
+	for i := range rules {
+		if rules[i].Start <= pc && pc < rules[i].End {
+			// Prefer the innermost rule.
+			ret = &rules[i]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,398 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse a grammar written in PEG notation, similar to LPeg's re module.
+//
+//	grammar <- rule+ / expr
+//	rule    <- name '<-' expr
+//	expr    <- seq ('/' seq)*
+//	seq     <- prefix*
+//	prefix  <- ('&' / '!') prefix / suffix
+//	suffix  <- primary ('*' / '+' / '?' / '^' '-'? num)*
+//	primary <- '(' expr ')' / literal / class / '.' / name
+//	         / '{}' / '{|' expr '|}' / '{' expr '}'
+//
+// Literals are quoted with ' or ", and classes are written like
+// [a-z_] or [^"]. `p^n` matches at least n times, and `p^-n` at most n
+// times. `{}` is a position capture, `{ p }` a simple capture and
+// `{| p |}` a list capture. Comments start with `--`.
+// The first rule is the start rule.
+func ParseGrammar(src string) (*Pattern, error) {
+	p, err := parsePEG(src)
+	if err != nil {
+		return nil, err
+	}
+	if p.order != nil {
+		return Grm(p.order[0], p.rules), nil
+	}
+	return p.pat, nil
+}
+
+// Parse a grammar like ParseGrammar, but return the rules without
+// combining them. The source must be a list of rules.
+func ParseRules(src string) (start string, rules map[string]*Pattern, err error) {
+	p, err := parsePEG(src)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.order == nil {
+		return "", nil, &SyntaxError{1, 1, "Expected a rule"}
+	}
+	return p.order[0], p.rules, nil
+}
+
+func parsePEG(src string) (p *pegParser, err error) {
+	defer catchSyntax(&err)
+	p = &pegParser{src: src, rules: make(map[string]*Pattern)}
+	p.skip()
+	if p.ruleStart() {
+		for p.pos < len(p.src) {
+			name := p.name()
+			if _, ok := p.rules[name]; ok {
+				p.fail("Rule %q defined twice", name)
+			}
+			p.expect("<-")
+			p.order = append(p.order, name)
+			p.rules[name] = p.expr()
+		}
+		for _, ref := range p.refs {
+			if _, ok := p.rules[ref.name]; !ok {
+				p.pos = ref.pos
+				p.fail("Undefined rule %q", ref.name)
+			}
+		}
+		return p, nil
+	}
+	p.pat = p.expr()
+	if p.pos < len(p.src) {
+		p.fail("Unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	if len(p.refs) > 0 {
+		p.pos = p.refs[0].pos
+		p.fail("Undefined rule %q", p.refs[0].name)
+	}
+	return p, nil
+}
+
+// Turn the panic of pegParser.fail into an error. Must be deferred.
+func catchSyntax(err *error) {
+	if e := recover(); e != nil {
+		se, ok := e.(*SyntaxError)
+		if !ok {
+			panic(e)
+		}
+		*err = se
+	}
+}
+
+// Error in a grammar given to ParseGrammar.
+type SyntaxError struct {
+	Line, Column int
+	Msg          string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+type pegParser struct {
+	src   string
+	pos   int
+	rules map[string]*Pattern
+	order []string
+	refs  []pegRef
+	pat   *Pattern // Result, if the source is not a list of rules
+	build *builder // Set when parsing the tag of a field for Build
+}
+
+// Reference to a rule, kept to report undefined rules.
+type pegRef struct {
+	name string
+	pos  int
+}
+
+func (p *pegParser) fail(format string, args ...interface{}) {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	col := p.pos - strings.LastIndex(p.src[:p.pos], "\n")
+	panic(&SyntaxError{line, col, fmt.Sprintf(format, args...)})
+}
+
+// Skip whitespace and comments.
+func (p *pegParser) skip() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "--"):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// Consume `s` and following whitespace, if it is next.
+func (p *pegParser) accept(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		p.skip()
+		return true
+	}
+	return false
+}
+
+func (p *pegParser) expect(s string) {
+	if !p.accept(s) {
+		p.fail("Expected %q", s)
+	}
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+// Is the name a valid rule name?
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Is a rule definition next?
+func (p *pegParser) ruleStart() bool {
+	save := p.pos
+	defer func() { p.pos = save }()
+	if p.pos >= len(p.src) || !isNameChar(p.src[p.pos], true) {
+		return false
+	}
+	p.name()
+	return strings.HasPrefix(p.src[p.pos:], "<-")
+}
+
+func (p *pegParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		p.fail("Expected a name")
+	}
+	name := p.src[start:p.pos]
+	p.skip()
+	return name
+}
+
+func (p *pegParser) number() int {
+	start := p.pos
+	for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+		p.pos++
+	}
+	n, err := strconv.Atoi(p.src[start:p.pos])
+	if err != nil {
+		p.pos = start
+		p.fail("Expected a number")
+	}
+	p.skip()
+	return n
+}
+
+func (p *pegParser) expr() *Pattern {
+	first := p.seq()
+	var rest []interface{}
+	for p.accept("/") {
+		rest = append(rest, p.seq())
+	}
+	return first.Or(rest...)
+}
+
+func (p *pegParser) seq() *Pattern {
+	var args []interface{}
+	for p.pos < len(p.src) && !p.ruleStart() {
+		switch p.src[p.pos] {
+		case '/', ')', '}', '|':
+			return Seq(args...)
+		}
+		args = append(args, p.prefix())
+	}
+	return Seq(args...)
+}
+
+func (p *pegParser) prefix() *Pattern {
+	switch {
+	case p.accept("&"):
+		return And(p.prefix())
+	case p.accept("!"):
+		return Not(p.prefix())
+	case p.build != nil && p.accept("@"):
+		return p.build.capture(p)
+	}
+	return p.suffix()
+}
+
+func (p *pegParser) suffix() *Pattern {
+	return p.repeat(p.primary())
+}
+
+// Apply the suffixes that follow to pat.
+func (p *pegParser) repeat(pat *Pattern) *Pattern {
+	for {
+		switch {
+		case p.accept("*"):
+			pat = Rep(pat, 0, -1)
+		case p.accept("+"):
+			pat = Rep(pat, 1, -1)
+		case p.accept("?"):
+			pat = Rep(pat, 0, 1)
+		case p.accept("^"):
+			if p.accept("-") {
+				pat = Rep(pat, 0, p.number())
+			} else {
+				pat = Rep(pat, p.number(), -1)
+			}
+		default:
+			return pat
+		}
+	}
+}
+
+func (p *pegParser) primary() *Pattern {
+	if p.pos >= len(p.src) {
+		p.fail("Unexpected end of grammar")
+	}
+	switch c := p.src[p.pos]; {
+	case p.accept("("):
+		pat := p.expr()
+		p.expect(")")
+		return pat
+	case c == '\'' || c == '"':
+		return p.token(Lit(p.literal()))
+	case c == '[':
+		return p.token(Seq(p.class()))
+	case p.accept("."):
+		return p.token(Any(1))
+	case p.accept("{}"):
+		return Cposition()
+	case p.accept("{|"):
+		pat := p.expr()
+		p.expect("|}")
+		return Clist(pat)
+	case p.accept("{"):
+		pat := p.expr()
+		p.expect("}")
+		return Csimple(pat)
+	case isNameChar(c, true):
+		pos := p.pos
+		name := p.name()
+		p.refs = append(p.refs, pegRef{name, pos})
+		if p.build != nil && p.build.structs[name] != nil {
+			return Ref(name)
+		}
+		return p.token(Ref(name))
+	}
+	p.fail("Unexpected %q", p.src[p.pos:p.pos+1])
+	return nil
+}
+
+// A literal, class or rule that is not a struct of Build, which may
+// skip space before it.
+func (p *pegParser) token(pat *Pattern) *Pattern {
+	if p.build == nil {
+		return pat
+	}
+	return p.build.token(pat)
+}
+
+// Read one, possibly escaped, character.
+func (p *pegParser) char() byte {
+	if p.pos >= len(p.src) {
+		p.fail("Unexpected end of grammar")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	if c != '\\' {
+		return c
+	}
+	if p.pos >= len(p.src) {
+		p.fail("Unexpected end of grammar")
+	}
+	c = p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'x':
+		if p.pos+2 <= len(p.src) {
+			if n, err := strconv.ParseUint(p.src[p.pos:p.pos+2], 16, 8); err == nil {
+				p.pos += 2
+				return byte(n)
+			}
+		}
+		p.fail("Invalid escape")
+	}
+	return c
+}
+
+func (p *pegParser) literal() string {
+	quote := p.src[p.pos]
+	p.pos++
+	var ret []byte
+	for p.pos < len(p.src) && p.src[p.pos] != quote {
+		ret = append(ret, p.char())
+	}
+	if p.pos >= len(p.src) {
+		p.fail("Unterminated literal")
+	}
+	p.pos++
+	p.skip()
+	return string(ret)
+}
+
+func (p *pegParser) class() *ICharset {
+	p.pos++
+	op := &ICharset{}
+	negate := false
+	if p.pos < len(p.src) && p.src[p.pos] == '^' {
+		negate = true
+		p.pos++
+	}
+	for p.pos < len(p.src) && p.src[p.pos] != ']' {
+		lo := p.char()
+		hi := lo
+		if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+			p.pos++
+			hi = p.char()
+		}
+		if hi < lo {
+			p.fail("Invalid range")
+		}
+		op.add(lo, hi)
+	}
+	if p.pos >= len(p.src) {
+		p.fail("Unterminated class")
+	}
+	p.pos++
+	p.skip()
+	if negate {
+		op.negate()
+	}
+	return op
+}
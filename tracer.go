@@ -0,0 +1,172 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Interface for receiving the events of a match.
+// See MatchWithOptions.
+type Tracer interface {
+	Trace(e *TraceEvent)
+}
+
+// Kind of trace event.
+type TraceKind int
+
+const (
+	TraceStep         TraceKind = iota // About to run an instruction
+	TraceCall                          // Called a rule
+	TraceReturn                        // Returned from a rule
+	TraceChoice                        // Pushed a fallback point
+	TraceBacktrack                     // Rolled back to a fallback point
+	TraceCaptureOpen                   // Opened a capture
+	TraceCaptureClose                  // Closed a capture
+)
+
+var traceKindNames = [...]string{"step", "call", "return", "choice", "backtrack", "open", "close"}
+
+func (k TraceKind) String() string {
+	if 0 <= k && int(k) < len(traceKindNames) {
+		return traceKindNames[k]
+	}
+	return fmt.Sprintf("TraceKind(%d)", int(k))
+}
+
+// A single event of a match.
+// Stack and Captures are the live stacks of the match. They are only
+// valid during the call, and must not be modified.
+type TraceEvent struct {
+	Kind     TraceKind
+	PC       int            // Current instruction, or the fallback for TraceBacktrack
+	Pos      int            // Current input position
+	Op       Instruction    // Instruction about to run (TraceStep)
+	Rule     string         // Rule name, if known (TraceCall, TraceReturn)
+	Target   int            // Jump target (TraceCall, TraceReturn, TraceChoice)
+	Failed   int            // Position where the match failed (TraceBacktrack)
+	Handler  CaptureHandler // (TraceCaptureOpen, TraceCaptureClose)
+	Value    interface{}    // Captured value (TraceCaptureClose)
+	Stack    *Stack
+	Captures *CapStack
+}
+
+// Name of the rule called by the instruction at `p`, if any.
+func callName(program *Pattern, p int) string {
+	if 0 <= p && p < len(*program) {
+		if op, ok := (*program)[p].(*ICall); ok {
+			return op.name
+		}
+	}
+	return ""
+}
+
+// Number of return addresses on the stack.
+func callDepth(s *Stack) int {
+	depth := 0
+	for _, v := range s.slice {
+		if _, ok := v.(int); ok {
+			depth++
+		}
+	}
+	return depth
+}
+
+// Writes a readable line for each event, indented by call depth.
+type PrettyTracer struct {
+	w     io.Writer
+	input string
+}
+
+// Create a tracer writing to `w`. The input is used to show the text
+// following the current position.
+func NewPrettyTracer(w io.Writer, input string) *PrettyTracer {
+	return &PrettyTracer{w, input}
+}
+
+// Input following the position, shortened to a few characters.
+func (t *PrettyTracer) window(pos int) string {
+	const size = 12
+	if pos > len(t.input) {
+		pos = len(t.input)
+	}
+	if len(t.input)-pos > size {
+		return fmt.Sprintf("%q...", t.input[pos:pos+size])
+	}
+	return fmt.Sprintf("%q", t.input[pos:])
+}
+
+func (t *PrettyTracer) Trace(e *TraceEvent) {
+	var text string
+	switch e.Kind {
+	case TraceStep:
+		text = fmt.Sprintf("%-32s %s", e.Op, t.window(e.Pos))
+	case TraceCall:
+		text = fmt.Sprintf("> %s (%+d)", e.Rule, e.Target-e.PC)
+	case TraceReturn:
+		text = fmt.Sprintf("< %s", e.Rule)
+	case TraceChoice:
+		text = fmt.Sprintf("+ fallback at %d", e.Target)
+	case TraceBacktrack:
+		text = fmt.Sprintf("! failed at @%d, back to %s", e.Failed, t.window(e.Pos))
+	case TraceCaptureOpen:
+		text = fmt.Sprintf("( %v", e.Handler)
+	case TraceCaptureClose:
+		text = fmt.Sprintf(") %v = %#v", e.Handler, e.Value)
+	default:
+		text = e.Kind.String()
+	}
+	indent := strings.Repeat("  ", callDepth(e.Stack))
+	fmt.Fprintf(t.w, "%6d  %-6s %s%s\n", e.PC, fmt.Sprintf("@%d", e.Pos), indent, text)
+}
+
+// Writes each event as a line of JSON, for analysis by other tools.
+type JSONTracer struct {
+	enc *json.Encoder
+	err error
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{enc: json.NewEncoder(w)}
+}
+
+// The first error from writing the events.
+func (t *JSONTracer) Err() error {
+	return t.err
+}
+
+func (t *JSONTracer) Trace(e *TraceEvent) {
+	if t.err != nil {
+		return
+	}
+	rec := map[string]interface{}{
+		"kind":  e.Kind.String(),
+		"pc":    e.PC,
+		"pos":   e.Pos,
+		"depth": e.Stack.Len(),
+	}
+	switch e.Kind {
+	case TraceStep:
+		rec["op"] = fmt.Sprint(e.Op)
+	case TraceCall, TraceReturn:
+		rec["rule"] = e.Rule
+		rec["target"] = e.Target
+	case TraceChoice:
+		rec["target"] = e.Target
+	case TraceBacktrack:
+		rec["failed"] = e.Failed
+	case TraceCaptureOpen:
+		rec["handler"] = fmt.Sprint(e.Handler)
+	case TraceCaptureClose:
+		rec["handler"] = fmt.Sprint(e.Handler)
+		if _, err := json.Marshal(e.Value); err == nil {
+			rec["value"] = e.Value
+		} else {
+			rec["value"] = fmt.Sprintf("%v", e.Value)
+		}
+	}
+	t.err = t.enc.Encode(rec)
+}
@@ -0,0 +1,312 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error of Unmarshal.
+type UnmarshalError struct {
+	Field      string // Path of the field, like "Items[2].Price"
+	Start, End int    // Span of the capture, or -1 if not known
+	Msg        string
+}
+
+func (e *UnmarshalError) Error() string {
+	msg := e.Msg
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Start >= 0 {
+		msg = fmt.Sprintf("%d-%d: %s", e.Start, e.End, msg)
+	}
+	return msg
+}
+
+// Store the result of a match in the value pointed to by v:
+//   - table captures in structs, by the names of their groups. A field
+//     tagged with `pego:"name"` gets the group of that name, and other
+//     exported fields the group with the name of the field. `pego:"-"`
+//     skips a field, and the positional values of the table are named
+//     "1", "2", ...
+//   - table captures in maps with string keys
+//   - list captures, and the positional values of table captures, in
+//     slices and arrays
+//   - strings in strings, numbers and bools, converted by strconv, and
+//     in types that implement encoding.TextUnmarshaler
+//   - strings in time.Time, in the format given by a `layout=` option
+//     of the tag, like `pego:"date,layout=2006-01-02"`, or RFC 3339
+//   - any value in an interface{}
+//
+// Pointers are allocated as needed. The result is a value returned by
+// Match, or a *CaptureNode returned by MatchWithOptions with Spans set.
+// Only the latter knows where the captures are in the input: errors for
+// a value returned by Match have a Start and End of -1.
+func Unmarshal(result interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &UnmarshalError{Start: -1, Msg: fmt.Sprintf("Expected a non-nil pointer, got %T", v)}
+	}
+	n, ok := result.(*CaptureNode)
+	if !ok {
+		n = nodeOf(result)
+	}
+	return (&decoder{tags: true}).unmarshal(n, rv.Elem(), "", "")
+}
+
+// A tree of nodes without spans for a value returned by Match.
+func nodeOf(v interface{}) *CaptureNode {
+	n := &CaptureNode{Start: -1, End: -1, Value: v}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, x := range v {
+			n.Subs = append(n.Subs, nodeOf(x))
+		}
+	case map[string]interface{}:
+		var names []string
+		for i := 1; ; i++ {
+			x, ok := v[strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			n.Subs = append(n.Subs, nodeOf(x))
+		}
+		for name := range v {
+			if i, err := strconv.Atoi(name); err != nil || i < 1 || i > len(n.Subs) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// Like a group capture of the value.
+			sub := &CaptureNode{Start: -1, End: -1, Name: name, Value: v[name]}
+			sub.Subs = []*CaptureNode{nodeOf(v[name])}
+			n.Subs = append(n.Subs, sub)
+		}
+	}
+	return n
+}
+
+// The captures of a table or list node without a name, and the last
+// capture of each name.
+func (n *CaptureNode) split() (list []*CaptureNode, names map[string]*CaptureNode) {
+	names = make(map[string]*CaptureNode)
+	for _, sub := range n.Subs {
+		if sub.Name == "" {
+			list = append(list, sub)
+		} else {
+			names[sub.Name] = sub
+		}
+	}
+	return list, names
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// Options of unmarshal.
+type decoder struct {
+	tags bool // Read the names of fields from their pego tags
+}
+
+// Store the value of n in rv. `path` is the path of rv for errors, and
+// `layout` the layout of times from the tag of the field.
+func (d *decoder) unmarshal(n *CaptureNode, rv reflect.Value, path, layout string) error {
+	fail := func(format string, args ...interface{}) error {
+		return &UnmarshalError{path, n.Start, n.End, fmt.Sprintf(format, args...)}
+	}
+	// The value of a group is its first capture.
+	if n.Name != "" && len(n.Subs) > 0 {
+		return d.unmarshal(n.Subs[0], rv, path, layout)
+	}
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.unmarshal(n, rv.Elem(), path, layout)
+	}
+	s, isString := n.Value.(string)
+	if rv.Type() == timeType && isString {
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return fail("Can not convert %q to a time: %v", s, err)
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if isString && rv.CanAddr() && rv.Addr().Type().Implements(textUnmarshalerType) {
+		if err := rv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+			return fail("Can not convert %q to %v: %v", s, rv.Type(), err)
+		}
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			break
+		}
+		if n.Value == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(n.Value))
+		}
+		return nil
+	case reflect.Struct:
+		if _, ok := n.Value.(map[string]interface{}); !ok {
+			break
+		}
+		list, names := n.split()
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name, opts := f.Name, ""
+			if tag, ok := f.Tag.Lookup("pego"); ok && d.tags {
+				name = tag
+				if i := strings.IndexByte(tag, ','); i >= 0 {
+					name, opts = tag[:i], tag[i+1:]
+				}
+			}
+			if name == "-" {
+				continue
+			}
+			sub, ok := names[name]
+			if i, err := strconv.Atoi(name); err == nil && 0 < i && i <= len(list) {
+				sub, ok = list[i-1], true
+			}
+			if !ok {
+				continue
+			}
+			layout := ""
+			if strings.HasPrefix(opts, "layout=") {
+				layout = opts[len("layout="):]
+			}
+			if err := d.unmarshal(sub, rv.Field(i), strings.TrimPrefix(path+"."+f.Name, "."), layout); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if _, ok := n.Value.(map[string]interface{}); !ok || rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		list, names := n.split()
+		for i, sub := range list {
+			names[strconv.Itoa(i+1)] = sub
+		}
+		for name, sub := range names {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.unmarshal(sub, elem, fmt.Sprintf("%s[%q]", path, name), layout); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), elem)
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if isString && rv.Type().Elem().Kind() == reflect.Uint8 && rv.Kind() == reflect.Slice {
+			rv.SetBytes([]byte(s))
+			return nil
+		}
+		switch n.Value.(type) {
+		case []interface{}, map[string]interface{}:
+		default:
+			return fail("Can not store %T in %v", n.Value, rv.Type())
+		}
+		list, _ := n.split()
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), len(list), len(list)))
+		} else if len(list) > rv.Len() {
+			return fail("Can not store %d values in %v", len(list), rv.Type())
+		}
+		for i, sub := range list {
+			if err := d.unmarshal(sub, rv.Index(i), fmt.Sprintf("%s[%d]", path, i), layout); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.String:
+		if isString {
+			rv.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		switch v := n.Value.(type) {
+		case bool:
+			rv.SetBool(v)
+			return nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fail("Can not convert %q to bool", v)
+			}
+			rv.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch v := n.Value.(type) {
+		case int:
+			if rv.OverflowInt(int64(v)) {
+				return fail("%d overflows %v", v, rv.Type())
+			}
+			rv.SetInt(int64(v))
+			return nil
+		case string:
+			i, err := strconv.ParseInt(v, 10, rv.Type().Bits())
+			if err != nil {
+				return fail("Can not convert %q to %v", v, rv.Type())
+			}
+			rv.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch v := n.Value.(type) {
+		case int:
+			if v < 0 || rv.OverflowUint(uint64(v)) {
+				return fail("%d overflows %v", v, rv.Type())
+			}
+			rv.SetUint(uint64(v))
+			return nil
+		case string:
+			u, err := strconv.ParseUint(v, 10, rv.Type().Bits())
+			if err != nil {
+				return fail("Can not convert %q to %v", v, rv.Type())
+			}
+			rv.SetUint(u)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch v := n.Value.(type) {
+		case int:
+			rv.SetFloat(float64(v))
+			return nil
+		case float64:
+			rv.SetFloat(v)
+			return nil
+		case string:
+			f, err := strconv.ParseFloat(v, rv.Type().Bits())
+			if err != nil {
+				return fail("Can not convert %q to %v", v, rv.Type())
+			}
+			rv.SetFloat(f)
+			return nil
+		}
+	}
+	return fail("Can not store %T in %v", n.Value, rv.Type())
+}
@@ -0,0 +1,184 @@
+// vim: ff=unix ts=3 sw=3 noet
+
+package pego
+
+import (
+	"fmt"
+)
+
+// Kinds of entries of the VM stack, as seen by Verify.
+const (
+	frameChoice  = 'b' // Failure address of IChoice
+	frameCounter = 'c' // Counter of IPushCounter
+)
+
+// State of the VM before an instruction, as far as Verify can tell:
+// the entries pushed since the start of the current rule, and the
+// number of captures opened since then and not closed yet.
+type verifyState struct {
+	inRule bool // false in the main pattern
+	stack  string
+	open   int
+}
+
+// Check that a pattern can not make the VM fail on its own, whatever
+// the input:
+//   - jump targets are in range, and the pattern ends with IEnd
+//   - IOpenCall has been resolved
+//   - ICommit, IPartialCommit, IBackCommit and IFailTwice find a
+//     failure address on top of the stack, ILoop and IPopCounter a
+//     counter, and IReturn nothing above its return address
+//   - each instruction is always reached with the same stack, so the
+//     stack can not grow without bounds
+//   - captures are closed in the rule that opened them, and are all
+//     closed at IEnd
+//
+// Patterns made by the constructors always pass. Patterns built from
+// raw instructions, read by UnmarshalBinary or by Assemble, should be
+// verified before they are matched with MatchOptions.Verified.
+func Verify(p *Pattern) error {
+	code := *p
+	if err := validate(code); err != nil {
+		return err
+	}
+	states := make([]*verifyState, len(code))
+	// Rules found so far, and the ones still to look at.
+	rules := map[int]bool{}
+	var todo []int
+	call := func(target int) {
+		if !rules[target] {
+			rules[target] = true
+			todo = append(todo, target)
+		}
+	}
+	if err := verifyFrom(code, 0, false, states, call); err != nil {
+		return err
+	}
+	for len(todo) > 0 {
+		start := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if err := verifyFrom(code, start, true, states, call); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Follow every path from start, which is the main pattern or the
+// start of a rule. Calls are passed to call(). Rules may share code,
+// as the optimizer turns calls at the end of rules into jumps.
+func verifyFrom(code Pattern, start int, inRule bool, states []*verifyState, call func(int)) error {
+	type item struct {
+		pc int
+		s  verifyState
+	}
+	work := []item{{start, verifyState{inRule: inRule}}}
+	for len(work) > 0 {
+		pc, s := work[len(work)-1].pc, work[len(work)-1].s
+		work = work[:len(work)-1]
+		if pc >= len(code) {
+			return fmt.Errorf("Instruction %d: missing End", pc-1)
+		}
+		if old := states[pc]; old != nil {
+			if *old != s {
+				return fmt.Errorf("Instruction %d: reached with different stacks", pc)
+			}
+			continue
+		}
+		saved := s
+		states[pc] = &saved
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("Instruction %d: %v %s", pc, code[pc], fmt.Sprintf(format, args...))
+		}
+		pop := func(kind byte) bool {
+			if len(s.stack) == 0 || s.stack[len(s.stack)-1] != kind {
+				return false
+			}
+			s.stack = s.stack[:len(s.stack)-1]
+			return true
+		}
+		onTop := func(kind byte) bool {
+			return len(s.stack) > 0 && s.stack[len(s.stack)-1] == kind
+		}
+		next := func(pc int, s verifyState) {
+			work = append(work, item{pc, s})
+		}
+		offset, _ := jumpOffset(code[pc])
+		switch op := code[pc].(type) {
+		case *IOpenCall:
+			return fail("is not resolved")
+		case *IJump:
+			next(pc+offset, s)
+		case *IChoice:
+			next(pc+offset, s)
+			s.stack += string(frameChoice)
+			next(pc+1, s)
+		case *ICall:
+			call(pc + offset)
+			next(pc+1, s)
+		case *ICommit, *IBackCommit:
+			if !pop(frameChoice) {
+				return fail("without a failure address on the stack")
+			}
+			next(pc+offset, s)
+		case *IPartialCommit:
+			if !onTop(frameChoice) {
+				return fail("without a failure address on the stack")
+			}
+			next(pc+offset, s)
+		case *IFailTwice:
+			if !pop(frameChoice) {
+				return fail("without a failure address on the stack")
+			}
+		case *IPushCounter:
+			s.stack += string(frameCounter)
+			next(pc+1, s)
+		case *ILoop:
+			if !onTop(frameCounter) {
+				return fail("without a counter on the stack")
+			}
+			next(pc+offset, s)
+			next(pc+1, s)
+		case *IPopCounter:
+			if !pop(frameCounter) {
+				return fail("without a counter on the stack")
+			}
+			next(pc+1, s)
+		case *IOpenCapture:
+			s.open++
+			next(pc+1, s)
+		case *ICloseCapture:
+			if s.open == 0 {
+				return fail("without an open capture")
+			}
+			s.open--
+			next(pc+1, s)
+		case *IReturn:
+			if !s.inRule {
+				return fail("outside of a rule")
+			}
+			if s.stack != "" || s.open != 0 {
+				return fail("with entries or open captures left by the rule")
+			}
+		case *IEnd:
+			if s.inRule {
+				return fail("inside of a rule")
+			}
+			if s.stack != "" || s.open != 0 {
+				return fail("with entries or open captures left")
+			}
+		case *IDFA:
+			// An automaton that never accepts always fails, and the
+			// optimizer may drop the code after it.
+			if len(op.states) > 0 && dfaDistances(op)[0] >= 0 {
+				next(pc+1, s)
+			}
+		case nil, *IChar, *ICharset, *ISpan, *IAny, *IKeywords, *IFullCapture, *IEmptyCapture:
+			next(pc+1, s)
+		case *IFail, *IGiveUp:
+		default:
+			return fail("is not a known instruction")
+		}
+	}
+	return nil
+}